@@ -0,0 +1,561 @@
+package lilliput
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+const (
+	apngActlChunkLen = 8
+	apngFctlChunkLen = 26
+
+	apngDisposeOpNone       = 0
+	apngDisposeOpBackground = 1
+	apngDisposeOpPrevious   = 2
+
+	apngBlendOpSource = 0
+	apngBlendOpOver   = 1
+)
+
+var errInvalidAPNG = errors.New("invalid APNG animation chunks")
+
+// apngFrame describes one frame of an APNG as described by its fcTL chunk.
+// data holds the compressed image data of the frame, either from the
+// IDAT chunks of the default image or from fdAT chunks with the sequence
+// number removed.
+type apngFrame struct {
+	width    int
+	height   int
+	xOffset  int
+	yOffset  int
+	delayNum uint16
+	delayDen uint16
+	dispose  DisposeMethod
+	blend    BlendMethod
+	data     [][]byte
+}
+
+type apngDecoder struct {
+	buf          []byte
+	defaultImage *openCVDecoder
+	ihdr         []byte
+	sharedChunks [][]byte
+	frames       []apngFrame
+	frameIndex   int
+	numPlays     int
+}
+
+// appendPNGChunk serializes a chunk with the given type and data onto dst,
+// including its length prefix and CRC
+func appendPNGChunk(dst []byte, chunkType []byte, data []byte) []byte {
+	var field [4]byte
+	binary.BigEndian.PutUint32(field[:], uint32(len(data)))
+	dst = append(dst, field[:]...)
+	dst = append(dst, chunkType...)
+	dst = append(dst, data...)
+
+	crc := crc32.NewIEEE()
+	crc.Write(chunkType)
+	crc.Write(data)
+	binary.BigEndian.PutUint32(field[:], crc.Sum32())
+	return append(dst, field[:]...)
+}
+
+// isAPNGSharedChunk reports whether a chunk appearing before the image data
+// should be copied into every frame, e.g. the palette and color information
+func isAPNGSharedChunk(chunkType []byte) bool {
+	return !bytes.Equal(chunkType, pngIhdrChunkType) &&
+		!bytes.Equal(chunkType, pngActlChunkType) &&
+		!bytes.Equal(chunkType, pngFctlChunkType)
+}
+
+func parseAPNGFrame(fctl []byte, canvasWidth, canvasHeight int, isFirstFrame bool) (apngFrame, error) {
+	if len(fctl) < apngFctlChunkLen {
+		return apngFrame{}, errInvalidAPNG
+	}
+
+	frame := apngFrame{
+		width:    int(binary.BigEndian.Uint32(fctl[4:])),
+		height:   int(binary.BigEndian.Uint32(fctl[8:])),
+		xOffset:  int(binary.BigEndian.Uint32(fctl[12:])),
+		yOffset:  int(binary.BigEndian.Uint32(fctl[16:])),
+		delayNum: binary.BigEndian.Uint16(fctl[20:]),
+		delayDen: binary.BigEndian.Uint16(fctl[22:]),
+	}
+
+	if frame.width <= 0 || frame.height <= 0 || frame.xOffset < 0 || frame.yOffset < 0 {
+		return apngFrame{}, errInvalidAPNG
+	}
+	if frame.xOffset+frame.width > canvasWidth || frame.yOffset+frame.height > canvasHeight {
+		return apngFrame{}, errInvalidAPNG
+	}
+
+	switch fctl[24] {
+	case apngDisposeOpNone:
+		frame.dispose = NoDispose
+	case apngDisposeOpBackground:
+		frame.dispose = DisposeToBackgroundColor
+	case apngDisposeOpPrevious:
+		// the spec says to treat a first frame's "previous" disposal as background
+		if isFirstFrame {
+			frame.dispose = DisposeToBackgroundColor
+		} else {
+			frame.dispose = DisposeToPrevious
+		}
+	default:
+		return apngFrame{}, errInvalidAPNG
+	}
+
+	switch fctl[25] {
+	case apngBlendOpSource:
+		frame.blend = NoBlend
+	case apngBlendOpOver:
+		frame.blend = UseAlphaBlending
+	default:
+		return apngFrame{}, errInvalidAPNG
+	}
+
+	return frame, nil
+}
+
+func newAPNGDecoder(buf []byte) (*apngDecoder, error) {
+	chunkIter, err := makePngChunkIter(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &apngDecoder{
+		buf: buf,
+	}
+
+	var canvasWidth, canvasHeight int
+	haveActl := false
+	seenImageData := false
+	seenFdat := false
+	for chunkIter.next() {
+		chunkType := chunkIter.chunkType()
+		data := chunkIter.chunkData()
+
+		switch {
+		case bytes.Equal(chunkType, pngIhdrChunkType):
+			if len(data) < 8 {
+				return nil, ErrInvalidImage
+			}
+			d.ihdr = data
+			canvasWidth = int(binary.BigEndian.Uint32(data[0:]))
+			canvasHeight = int(binary.BigEndian.Uint32(data[4:]))
+		case bytes.Equal(chunkType, pngActlChunkType):
+			if len(data) < apngActlChunkLen {
+				return nil, errInvalidAPNG
+			}
+			haveActl = true
+			d.numPlays = int(binary.BigEndian.Uint32(data[4:]))
+		case bytes.Equal(chunkType, pngFctlChunkType):
+			frame, err := parseAPNGFrame(data, canvasWidth, canvasHeight, len(d.frames) == 0)
+			if err != nil {
+				return nil, err
+			}
+			if !seenImageData && (frame.xOffset != 0 || frame.yOffset != 0 ||
+				frame.width != canvasWidth || frame.height != canvasHeight) {
+				// the default image must fill the canvas when it is part of the animation
+				return nil, errInvalidAPNG
+			}
+			d.frames = append(d.frames, frame)
+		case bytes.Equal(chunkType, pngIdatChunkType):
+			seenImageData = true
+			// the default image is only part of the animation when an fcTL precedes it
+			if len(d.frames) == 1 && !seenFdat {
+				d.frames[0].data = append(d.frames[0].data, data)
+			}
+		case bytes.Equal(chunkType, pngFdatChunkType):
+			if len(data) < 4 || len(d.frames) == 0 {
+				return nil, errInvalidAPNG
+			}
+			seenFdat = true
+			current := &d.frames[len(d.frames)-1]
+			current.data = append(current.data, data[4:])
+		case bytes.Equal(chunkType, pngIendChunkType):
+		default:
+			if !seenImageData && isAPNGSharedChunk(chunkType) {
+				d.sharedChunks = append(d.sharedChunks, chunkIter.chunk())
+			}
+		}
+	}
+
+	if !haveActl || d.ihdr == nil || len(d.frames) == 0 {
+		return nil, errInvalidAPNG
+	}
+
+	for i := range d.frames {
+		if len(d.frames[i].data) == 0 {
+			return nil, errInvalidAPNG
+		}
+	}
+
+	defaultImage, err := newOpenCVDecoder(buf)
+	if err != nil {
+		return nil, err
+	}
+	d.defaultImage = defaultImage
+
+	return d, nil
+}
+
+// framePNG builds a standalone PNG holding just the given frame, so that
+// it can be decoded with the ordinary PNG decoder
+func (d *apngDecoder) framePNG(frame *apngFrame) []byte {
+	size := len(pngMagic) + 3*pngChunkAllFieldsLen + len(d.ihdr)
+	for _, chunk := range d.sharedChunks {
+		size += len(chunk)
+	}
+	for _, data := range frame.data {
+		size += pngChunkAllFieldsLen + len(data)
+	}
+
+	ihdr := make([]byte, len(d.ihdr))
+	copy(ihdr, d.ihdr)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(frame.width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(frame.height))
+
+	png := make([]byte, 0, size)
+	png = append(png, pngMagic...)
+	png = appendPNGChunk(png, pngIhdrChunkType, ihdr)
+	for _, chunk := range d.sharedChunks {
+		png = append(png, chunk...)
+	}
+	for _, data := range frame.data {
+		png = appendPNGChunk(png, pngIdatChunkType, data)
+	}
+	return appendPNGChunk(png, pngIendChunkType, nil)
+}
+
+func (d *apngDecoder) Header() (*ImageHeader, error) {
+	header, err := d.defaultImage.Header()
+	if err != nil {
+		return nil, err
+	}
+	header.numFrames = len(d.frames)
+	return header, nil
+}
+
+func (d *apngDecoder) Close() {
+	d.defaultImage.Close()
+	d.buf = nil
+}
+
+func (d *apngDecoder) Description() string {
+	return "PNG"
+}
+
+func (d *apngDecoder) Duration() time.Duration {
+	return time.Duration(0)
+}
+
+func (d *apngDecoder) HasSubtitles() bool {
+	return false
+}
+
+func (d *apngDecoder) IsStreamable() bool {
+	return true
+}
+
+// BackgroundColor returns transparent black, which is what APNG canvases
+// are initialized to before the first frame is drawn
+func (d *apngDecoder) BackgroundColor() uint32 {
+	return 0x00000000
+}
+
+// LoopCount returns the number of times the animation plays, where 0
+// means loop indefinitely
+func (d *apngDecoder) LoopCount() int {
+	return d.numPlays
+}
+
+func (d *apngDecoder) ICC() []byte {
+	return d.defaultImage.ICC()
+}
+
+func (d *apngDecoder) EXIF() []byte {
+	return d.defaultImage.EXIF()
+}
+
+func (d *apngDecoder) XMP() []byte {
+	return d.defaultImage.XMP()
+}
+
+func (d *apngDecoder) DecodeTo(f *Framebuffer) error {
+	if d.frameIndex >= len(d.frames) {
+		return io.EOF
+	}
+
+	frame := &d.frames[d.frameIndex]
+	frameDecoder, err := newOpenCVDecoder(d.framePNG(frame))
+	if err != nil {
+		return err
+	}
+	defer frameDecoder.Close()
+
+	if err = frameDecoder.DecodeTo(f); err != nil {
+		return err
+	}
+
+	delayDen := time.Duration(frame.delayDen)
+	if delayDen == 0 {
+		// a zero denominator means the delay is in hundredths of a second
+		delayDen = 100
+	}
+	f.duration = time.Duration(frame.delayNum) * time.Second / delayDen
+	f.xOffset = frame.xOffset
+	f.yOffset = frame.yOffset
+	f.dispose = frame.dispose
+	f.blend = frame.blend
+
+	d.frameIndex++
+	return nil
+}
+
+func (d *apngDecoder) SkipFrame() error {
+	if d.frameIndex >= len(d.frames) {
+		return io.EOF
+	}
+	d.frameIndex++
+	return nil
+}
+
+// apngEncodedFrame holds the compressed image data of a frame waiting to be
+// assembled into the animation
+type apngEncodedFrame struct {
+	width    int
+	height   int
+	duration time.Duration
+	dispose  DisposeMethod
+	blend    BlendMethod
+	data     [][]byte
+}
+
+type apngEncoder struct {
+	dstBuf     []byte
+	scratch    []byte
+	loopCount  int
+	metadata   []byte
+	ihdr       []byte
+	frames     []apngEncodedFrame
+	hasFlushed bool
+	growable   bool
+}
+
+func newAPNGEncoder(decodedBy Decoder, md encodeMetadata, dstBuf []byte, growable bool) (*apngEncoder, error) {
+	loopCount := 0
+	if decodedBy != nil {
+		loopCount = decodedBy.LoopCount()
+	}
+
+	return &apngEncoder{
+		dstBuf:    dstBuf[:0],
+		loopCount: loopCount,
+		metadata:  pngMetadataChunks(md),
+		growable:  growable,
+	}, nil
+}
+
+// isAnimatedDecoder reports whether the decoder's header describes multiple frames
+func isAnimatedDecoder(d Decoder) bool {
+	if d == nil {
+		return false
+	}
+	header, err := d.Header()
+	return err == nil && header.IsAnimated()
+}
+
+func (e *apngEncoder) Encode(f *Framebuffer, opt map[int]int) ([]byte, error) {
+	if e.hasFlushed {
+		return nil, io.EOF
+	}
+
+	if f == nil {
+		e.hasFlushed = true
+		return e.assemble()
+	}
+
+	if err := e.encodeFrame(f, opt); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// encodeFrame compresses f as a standalone PNG and keeps its image data
+func (e *apngEncoder) encodeFrame(f *Framebuffer, opt map[int]int) error {
+	// leave room for a completely incompressible frame
+	rawSize := f.Height() * (1 + f.Width()*f.PixelType().Channels()*f.PixelType().Depth()/8)
+	scratchSize := rawSize + rawSize/1000 + 4096
+	if cap(e.scratch) < scratchSize {
+		e.scratch = make([]byte, scratchSize)
+	}
+
+	enc, err := newOpenCVEncoder(".png", nil, e.scratch, true)
+	if err != nil {
+		return err
+	}
+	defer enc.Close()
+
+	png, err := enc.Encode(f, opt)
+	if err != nil {
+		return err
+	}
+
+	chunkIter, err := makePngChunkIter(png)
+	if err != nil {
+		return err
+	}
+
+	frame := apngEncodedFrame{
+		width:    f.Width(),
+		height:   f.Height(),
+		duration: f.duration,
+		dispose:  f.dispose,
+		blend:    f.blend,
+	}
+	for chunkIter.next() {
+		chunkType := chunkIter.chunkType()
+		switch {
+		case bytes.Equal(chunkType, pngIhdrChunkType):
+			ihdr := chunkIter.chunkData()
+			if e.ihdr == nil {
+				e.ihdr = append([]byte{}, ihdr...)
+			} else if len(ihdr) != len(e.ihdr) || !bytes.Equal(ihdr[8:], e.ihdr[8:]) {
+				// every frame must share the bit depth and color type of the first
+				return ErrInvalidImage
+			}
+		case bytes.Equal(chunkType, pngIdatChunkType):
+			frame.data = append(frame.data, append([]byte{}, chunkIter.chunkData()...))
+		}
+	}
+
+	if len(frame.data) == 0 {
+		return ErrInvalidImage
+	}
+
+	e.frames = append(e.frames, frame)
+	return nil
+}
+
+func apngFctl(seq int, frame *apngEncodedFrame) []byte {
+	// prefer millisecond precision, falling back to centiseconds for long frames
+	delayNum, delayDen := frame.duration.Milliseconds(), int64(1000)
+	if delayNum > 0xFFFF {
+		delayNum, delayDen = frame.duration.Milliseconds()/10, 100
+		if delayNum > 0xFFFF {
+			delayNum = 0xFFFF
+		}
+	}
+
+	fctl := make([]byte, apngFctlChunkLen)
+	binary.BigEndian.PutUint32(fctl[0:], uint32(seq))
+	binary.BigEndian.PutUint32(fctl[4:], uint32(frame.width))
+	binary.BigEndian.PutUint32(fctl[8:], uint32(frame.height))
+	binary.BigEndian.PutUint16(fctl[20:], uint16(delayNum))
+	binary.BigEndian.PutUint16(fctl[22:], uint16(delayDen))
+
+	switch frame.dispose {
+	case DisposeToBackgroundColor:
+		fctl[24] = apngDisposeOpBackground
+	case DisposeToPrevious:
+		fctl[24] = apngDisposeOpPrevious
+	default:
+		fctl[24] = apngDisposeOpNone
+	}
+
+	if frame.blend == UseAlphaBlending {
+		fctl[25] = apngBlendOpOver
+	} else {
+		fctl[25] = apngBlendOpSource
+	}
+	return fctl
+}
+
+// assemble writes the encoded frames into dstBuf. A single frame is written
+// as an ordinary PNG.
+func (e *apngEncoder) assemble() ([]byte, error) {
+	if len(e.frames) == 0 {
+		return nil, ErrInvalidImage
+	}
+
+	canvas := &e.frames[0]
+	isAnimated := len(e.frames) > 1
+
+	size := len(pngMagic) + 2*pngChunkAllFieldsLen + len(e.ihdr) + len(e.metadata)
+	if isAnimated {
+		size += pngChunkAllFieldsLen + apngActlChunkLen
+	}
+	for i := range e.frames {
+		frame := &e.frames[i]
+		if frame.width > canvas.width || frame.height > canvas.height {
+			return nil, ErrInvalidImage
+		}
+		if isAnimated {
+			size += pngChunkAllFieldsLen + apngFctlChunkLen
+		}
+		for _, data := range frame.data {
+			size += pngChunkAllFieldsLen + len(data)
+			if i > 0 {
+				size += 4
+			}
+		}
+	}
+
+	if size > cap(e.dstBuf) {
+		if !e.growable {
+			return nil, ErrBufTooSmall
+		}
+		e.dstBuf = make([]byte, 0, size)
+	}
+
+	ihdr := make([]byte, len(e.ihdr))
+	copy(ihdr, e.ihdr)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(canvas.width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(canvas.height))
+
+	out := append(e.dstBuf[:0], pngMagic...)
+	out = appendPNGChunk(out, pngIhdrChunkType, ihdr)
+	out = append(out, e.metadata...)
+
+	if isAnimated {
+		actl := make([]byte, apngActlChunkLen)
+		binary.BigEndian.PutUint32(actl[0:], uint32(len(e.frames)))
+		binary.BigEndian.PutUint32(actl[4:], uint32(e.loopCount))
+		out = appendPNGChunk(out, pngActlChunkType, actl)
+	}
+
+	seq := 0
+	for i := range e.frames {
+		frame := &e.frames[i]
+		if isAnimated {
+			out = appendPNGChunk(out, pngFctlChunkType, apngFctl(seq, frame))
+			seq++
+		}
+		for _, data := range frame.data {
+			if i == 0 {
+				// the first frame doubles as the default image for non-APNG decoders
+				out = appendPNGChunk(out, pngIdatChunkType, data)
+				continue
+			}
+			fdat := make([]byte, 4, 4+len(data))
+			binary.BigEndian.PutUint32(fdat, uint32(seq))
+			fdat = append(fdat, data...)
+			out = appendPNGChunk(out, pngFdatChunkType, fdat)
+			seq++
+		}
+	}
+
+	return appendPNGChunk(out, pngIendChunkType, nil), nil
+}
+
+func (e *apngEncoder) Close() {
+	e.frames = nil
+	e.scratch = nil
+}
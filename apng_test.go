@@ -0,0 +1,297 @@
+package lilliput
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"testing"
+	"time"
+)
+
+// encodeTestPNGFrame encodes a solid-color frame with image/png and returns
+// its IHDR data and the contents of its IDAT chunks
+func encodeTestPNGFrame(t *testing.T, width, height int, c color.NRGBA) ([]byte, [][]byte) {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode test frame: %v", err)
+	}
+
+	chunkIter, err := makePngChunkIter(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to walk test frame: %v", err)
+	}
+
+	var ihdr []byte
+	var idats [][]byte
+	for chunkIter.next() {
+		switch {
+		case bytes.Equal(chunkIter.chunkType(), pngIhdrChunkType):
+			ihdr = chunkIter.chunkData()
+		case bytes.Equal(chunkIter.chunkType(), pngIdatChunkType):
+			idats = append(idats, chunkIter.chunkData())
+		}
+	}
+	return ihdr, idats
+}
+
+func makeTestFctl(seq, width, height, x, y int, delayNum, delayDen uint16, dispose, blend byte) []byte {
+	fctl := make([]byte, apngFctlChunkLen)
+	binary.BigEndian.PutUint32(fctl[0:], uint32(seq))
+	binary.BigEndian.PutUint32(fctl[4:], uint32(width))
+	binary.BigEndian.PutUint32(fctl[8:], uint32(height))
+	binary.BigEndian.PutUint32(fctl[12:], uint32(x))
+	binary.BigEndian.PutUint32(fctl[16:], uint32(y))
+	binary.BigEndian.PutUint16(fctl[20:], delayNum)
+	binary.BigEndian.PutUint16(fctl[22:], delayDen)
+	fctl[24] = dispose
+	fctl[25] = blend
+	return fctl
+}
+
+// makeTestAPNG builds a 16x16 two frame APNG. The first frame is the default image,
+// the second frame is an 8x8 patch drawn at (4, 4).
+func makeTestAPNG(t *testing.T) []byte {
+	// both frames are translucent so that image/png picks the same RGBA color type
+	ihdr, firstIdats := encodeTestPNGFrame(t, 16, 16, color.NRGBA{R: 255, A: 192})
+	_, secondIdats := encodeTestPNGFrame(t, 8, 8, color.NRGBA{B: 255, A: 128})
+
+	actl := make([]byte, apngActlChunkLen)
+	binary.BigEndian.PutUint32(actl[0:], 2)
+	binary.BigEndian.PutUint32(actl[4:], 3)
+
+	apng := append([]byte{}, pngMagic...)
+	apng = appendPNGChunk(apng, pngIhdrChunkType, ihdr)
+	apng = appendPNGChunk(apng, pngActlChunkType, actl)
+	apng = appendPNGChunk(apng, pngFctlChunkType, makeTestFctl(0, 16, 16, 0, 0, 1, 10, apngDisposeOpNone, apngBlendOpSource))
+	for _, idat := range firstIdats {
+		apng = appendPNGChunk(apng, pngIdatChunkType, idat)
+	}
+	apng = appendPNGChunk(apng, pngFctlChunkType, makeTestFctl(1, 8, 8, 4, 4, 50, 0, apngDisposeOpPrevious, apngBlendOpOver))
+	seq := 2
+	for _, idat := range secondIdats {
+		fdat := make([]byte, 4, 4+len(idat))
+		binary.BigEndian.PutUint32(fdat, uint32(seq))
+		fdat = append(fdat, idat...)
+		apng = appendPNGChunk(apng, pngFdatChunkType, fdat)
+		seq++
+	}
+	return appendPNGChunk(apng, pngIendChunkType, nil)
+}
+
+func TestAPNGDecoder(t *testing.T) {
+	apng := makeTestAPNG(t)
+
+	decoder, err := NewDecoder(apng)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	defer decoder.Close()
+
+	if _, ok := decoder.(*apngDecoder); !ok {
+		t.Fatalf("Expected an APNG decoder, got %T", decoder)
+	}
+	if decoder.Description() != "PNG" {
+		t.Errorf("Description() = %s, want PNG", decoder.Description())
+	}
+	if decoder.LoopCount() != 3 {
+		t.Errorf("LoopCount() = %d, want 3", decoder.LoopCount())
+	}
+
+	header, err := decoder.Header()
+	if err != nil {
+		t.Fatalf("Header failed: %v", err)
+	}
+	if header.Width() != 16 || header.Height() != 16 {
+		t.Errorf("Header() size = %dx%d, want 16x16", header.Width(), header.Height())
+	}
+	if header.numFrames != 2 || !header.IsAnimated() {
+		t.Errorf("Header() frames = %d, want 2", header.numFrames)
+	}
+
+	expected := []struct {
+		width    int
+		height   int
+		xOffset  int
+		yOffset  int
+		duration time.Duration
+		dispose  DisposeMethod
+		blend    BlendMethod
+	}{
+		{16, 16, 0, 0, 100 * time.Millisecond, NoDispose, NoBlend},
+		{8, 8, 4, 4, 500 * time.Millisecond, DisposeToPrevious, UseAlphaBlending},
+	}
+
+	framebuffer := NewFramebuffer(16, 16)
+	defer framebuffer.Close()
+	for i, want := range expected {
+		if err = decoder.DecodeTo(framebuffer); err != nil {
+			t.Fatalf("DecodeTo frame %d failed: %v", i, err)
+		}
+		if framebuffer.Width() != want.width || framebuffer.Height() != want.height {
+			t.Errorf("frame %d size = %dx%d, want %dx%d", i, framebuffer.Width(), framebuffer.Height(), want.width, want.height)
+		}
+		if framebuffer.xOffset != want.xOffset || framebuffer.yOffset != want.yOffset {
+			t.Errorf("frame %d offset = (%d, %d), want (%d, %d)", i, framebuffer.xOffset, framebuffer.yOffset, want.xOffset, want.yOffset)
+		}
+		if framebuffer.Duration() != want.duration {
+			t.Errorf("frame %d duration = %v, want %v", i, framebuffer.Duration(), want.duration)
+		}
+		if framebuffer.dispose != want.dispose {
+			t.Errorf("frame %d dispose = %v, want %v", i, framebuffer.dispose, want.dispose)
+		}
+		if framebuffer.blend != want.blend {
+			t.Errorf("frame %d blend = %v, want %v", i, framebuffer.blend, want.blend)
+		}
+	}
+
+	if err = decoder.DecodeTo(framebuffer); err != io.EOF {
+		t.Errorf("DecodeTo after last frame = %v, want io.EOF", err)
+	}
+}
+
+func TestAPNGDecoder_InvalidAnimationFallsBack(t *testing.T) {
+	apng := makeTestAPNG(t)
+
+	// corrupt the acTL chunk type so only fcTL/fdAT remain
+	idx := bytes.Index(apng, pngActlChunkType)
+	apng[idx] = 'x'
+
+	decoder, err := NewDecoder(apng)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	defer decoder.Close()
+
+	if _, ok := decoder.(*openCVDecoder); !ok {
+		t.Fatalf("Expected fallback to the OpenCV decoder, got %T", decoder)
+	}
+}
+
+func TestAPNGTransform(t *testing.T) {
+	decoder, err := NewDecoder(makeTestAPNG(t))
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	defer decoder.Close()
+
+	ops := NewImageOps(64)
+	defer ops.Close()
+
+	options := &ImageOptions{
+		FileType:      ".webp",
+		Width:         8,
+		Height:        8,
+		ResizeMethod:  ImageOpsFit,
+		EncodeOptions: map[int]int{WebpQuality: 80},
+		EncodeTimeout: time.Second * 10,
+	}
+	dst := make([]byte, destinationBufferSize)
+	out, err := ops.Transform(decoder, options, dst)
+	if err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+
+	webpDecoder, err := newWebpDecoder(out)
+	if err != nil {
+		t.Fatalf("Failed to decode transformed output: %v", err)
+	}
+	defer webpDecoder.Close()
+
+	header, err := webpDecoder.Header()
+	if err != nil {
+		t.Fatalf("Header failed: %v", err)
+	}
+	if header.numFrames != 2 {
+		t.Errorf("Transformed output has %d frames, want 2", header.numFrames)
+	}
+}
+
+func TestAPNGEncoder(t *testing.T) {
+	decoder, err := NewDecoder(makeTestAPNG(t))
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	defer decoder.Close()
+
+	ops := NewImageOps(64)
+	defer ops.Close()
+
+	options := &ImageOptions{
+		FileType:      ".png",
+		Width:         8,
+		Height:        8,
+		ResizeMethod:  ImageOpsFit,
+		EncodeTimeout: time.Second * 10,
+	}
+	dst := make([]byte, destinationBufferSize)
+	out, err := ops.Transform(decoder, options, dst)
+	if err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+
+	outDecoder, err := NewDecoder(out)
+	if err != nil {
+		t.Fatalf("Failed to decode transformed output: %v", err)
+	}
+	defer outDecoder.Close()
+
+	if _, ok := outDecoder.(*apngDecoder); !ok {
+		t.Fatalf("Expected animated PNG output, got %T", outDecoder)
+	}
+	if outDecoder.LoopCount() != 3 {
+		t.Errorf("LoopCount() = %d, want 3", outDecoder.LoopCount())
+	}
+
+	framebuffer := NewFramebuffer(8, 8)
+	defer framebuffer.Close()
+	for i, want := range []time.Duration{100 * time.Millisecond, 500 * time.Millisecond} {
+		if err = outDecoder.DecodeTo(framebuffer); err != nil {
+			t.Fatalf("DecodeTo frame %d failed: %v", i, err)
+		}
+		if framebuffer.Width() != 8 || framebuffer.Height() != 8 {
+			t.Errorf("frame %d size = %dx%d, want 8x8", i, framebuffer.Width(), framebuffer.Height())
+		}
+		if framebuffer.Duration() != want {
+			t.Errorf("frame %d duration = %v, want %v", i, framebuffer.Duration(), want)
+		}
+	}
+}
+
+func TestAPNGEncoder_SingleFrameIsPlainPNG(t *testing.T) {
+	decoder, err := NewDecoder(makeTestAPNG(t))
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	defer decoder.Close()
+
+	ops := NewImageOps(64)
+	defer ops.Close()
+
+	options := &ImageOptions{
+		FileType:              ".png",
+		Width:                 8,
+		Height:                8,
+		ResizeMethod:          ImageOpsFit,
+		DisableAnimatedOutput: true,
+		EncodeTimeout:         time.Second * 10,
+	}
+	dst := make([]byte, destinationBufferSize)
+	out, err := ops.Transform(decoder, options, dst)
+	if err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+
+	if detectAPNG(out) {
+		t.Errorf("Expected a static PNG when animated output is disabled")
+	}
+}
@@ -1,5 +1,9 @@
 #include "avcodec.hpp"
 
+#include <cmath>
+#include <vector>
+#include <opencv2/imgproc.hpp>
+
 #ifdef __cplusplus
 extern "C" {
 #endif
@@ -37,23 +41,74 @@ extern AVCodec ff_flac_decoder;
 extern AVCodec ff_aac_decoder;
 extern AVCodec ff_vorbis_decoder;
 
+// the number of nearly black keyframes skipped before settling for one
+#define AVCODEC_MAX_BLACK_KEYFRAMES 20
+
+// the width which frames sampled for a representative frame are scored at
+#define AVCODEC_SCORED_FRAME_WIDTH 160
+
+// the number of audio samples summarized together before they are assigned
+// to the columns of a waveform, once the total number is known
+#define AVCODEC_WAVEFORM_BLOCK_SAMPLES 256
+
 void avcodec_init()
 {
     av_log_set_level(AV_LOG_ERROR);
 }
 
+// implemented in reader.go, reading from the io.ReadSeeker registered as reader
+extern "C" int avcodecReaderRead(uintptr_t reader, uint8_t* buf, int buf_size);
+extern "C" int64_t avcodecReaderSeek(uintptr_t reader, int64_t offset, int whence);
+
 struct avcodec_decoder_struct {
     const cv::Mat* mat;
     ptrdiff_t read_index;
+    uintptr_t reader;
     AVFormatContext* container;
     AVCodecContext* codec;
     AVIOContext* avio;
     int video_stream_index;
+    // frames shown before seek_pts, in the time base of the video stream, are skipped
+    int64_t seek_pts;
+    // only keyframes are decoded, and nearly black ones are skipped
+    bool skip_black_keyframes;
+    // frames closer than 1 / max_frame_rate seconds to the last one returned
+    // are dropped, unless it is 0
+    double max_frame_rate;
+    // frames shown before next_frame_time, in seconds, are dropped
+    double next_frame_time;
+    // how long the last frame returned is shown for, in seconds
+    double frame_duration;
+    // the decoder has returned its last frame
+    bool at_end;
+    // set from Go to abandon a decode part way through
+    const int* cancel_flag;
 };
 
+static bool avcodec_decoder_is_cancelled(const avcodec_decoder d)
+{
+    return d->cancel_flag && __atomic_load_n(d->cancel_flag, __ATOMIC_RELAXED);
+}
+
+static int avcodec_decoder_interrupt_callback(void* d_void)
+{
+    return avcodec_decoder_is_cancelled(static_cast<avcodec_decoder>(d_void));
+}
+
 static int avcodec_decoder_read_callback(void* d_void, uint8_t* buf, int buf_size)
 {
     avcodec_decoder d = static_cast<avcodec_decoder>(d_void);
+    if (!d->mat) {
+        int read_len = avcodecReaderRead(d->reader, buf, buf_size);
+        if (read_len == 0) {
+            return AVERROR_EOF;
+        }
+        if (read_len < 0) {
+            return AVERROR(EIO);
+        }
+        return read_len;
+    }
+
     size_t buf_len = d->mat->total() - d->read_index;
     size_t read_len = (buf_len > buf_size) ? buf_size : buf_len;
     if (read_len == 0) {
@@ -67,6 +122,19 @@ static int avcodec_decoder_read_callback(void* d_void, uint8_t* buf, int buf_siz
 static int64_t avcodec_decoder_seek_callback(void* d_void, int64_t offset, int whence)
 {
     avcodec_decoder d = static_cast<avcodec_decoder>(d_void);
+    if (!d->mat) {
+        whence &= ~AVSEEK_FORCE;
+        if (whence == AVSEEK_SIZE) {
+            int64_t current = avcodecReaderSeek(d->reader, 0, SEEK_CUR);
+            int64_t size = avcodecReaderSeek(d->reader, 0, SEEK_END);
+            if (current < 0 || avcodecReaderSeek(d->reader, current, SEEK_SET) < 0) {
+                return -1;
+            }
+            return size;
+        }
+        return avcodecReaderSeek(d->reader, offset, whence);
+    }
+
     uint8_t* to;
     switch (whence) {
     case SEEK_SET:
@@ -116,13 +184,14 @@ static bool avcodec_decoder_is_audio(const avcodec_decoder d)
     return false;
 }
 
-bool avcodec_decoder_is_streamable(const opencv_mat mat) {
+bool avcodec_decoder_is_streamable(const opencv_mat mat, size_t content_len) {
     const int64_t probeBytesLimit = 32 * 1024; // Define the probe limit
     const size_t atomHeaderSize = 8;
     int64_t bytesRead = 0;
     const cv::Mat* buf = static_cast<const cv::Mat*>(mat);
-    size_t bufSize = buf->total();
-    size_t peekSize = MIN(bufSize, probeBytesLimit);
+    // buf may only hold the start of the content
+    size_t bufSize = content_len;
+    size_t peekSize = MIN(buf->total(), probeBytesLimit);
 
     while(bytesRead + atomHeaderSize <= peekSize) {
         // Read atom size and type
@@ -153,12 +222,26 @@ bool avcodec_decoder_is_streamable(const opencv_mat mat) {
     return false;
 }
 
-avcodec_decoder avcodec_decoder_create(const opencv_mat buf, const bool hevc_enabled)
+// finds the video stream of the container. pictures attached as cover art,
+// such as the ID3 APIC frame of an MP3, are demuxed as video streams holding
+// a single packet, and are skipped
+static AVCodecParameters* avcodec_decoder_find_video_stream(avcodec_decoder d)
 {
-    avcodec_decoder d = new struct avcodec_decoder_struct();
-    memset(d, 0, sizeof(struct avcodec_decoder_struct));
-    d->mat = static_cast<const cv::Mat*>(buf);
+    for (int i = 0; i < d->container->nb_streams; i++) {
+        AVStream* st = d->container->streams[i];
+        if (st->codecpar->codec_type == AVMEDIA_TYPE_VIDEO &&
+            !(st->disposition & AV_DISPOSITION_ATTACHED_PIC)) {
+            d->video_stream_index = i;
+            return st->codecpar;
+        }
+    }
+    return NULL;
+}
 
+static avcodec_decoder avcodec_decoder_open(avcodec_decoder d, const bool hevc_enabled)
+{
+    d->seek_pts = AV_NOPTS_VALUE;
+    d->next_frame_time = -INFINITY;
     d->container = avformat_alloc_context();
     if (!d->container) {
         avcodec_decoder_release(d);
@@ -172,6 +255,8 @@ avcodec_decoder avcodec_decoder_create(const opencv_mat buf, const bool hevc_ena
         return NULL;
     }
     d->container->pb = d->avio;
+    d->container->interrupt_callback.callback = avcodec_decoder_interrupt_callback;
+    d->container->interrupt_callback.opaque = d;
 
     int res = avformat_open_input(&d->container, NULL, NULL, NULL);
     if (res < 0) {
@@ -182,14 +267,7 @@ avcodec_decoder avcodec_decoder_create(const opencv_mat buf, const bool hevc_ena
     }
 
     // perform a quick search for the video stream index in the container
-    AVCodecParameters* codec_params = NULL;
-    for (int i = 0; i < d->container->nb_streams; i++) {
-        if (d->container->streams[i]->codecpar->codec_type == AVMEDIA_TYPE_VIDEO) {
-            codec_params = d->container->streams[i]->codecpar;
-            d->video_stream_index = i;
-            break;
-        }
-    }
+    AVCodecParameters* codec_params = avcodec_decoder_find_video_stream(d);
 
     // call avformat_find_stream_info only if no header was found (i.e. mpeg-ts),
     // or if the duration, width, or height are unknown.
@@ -205,24 +283,22 @@ avcodec_decoder avcodec_decoder_create(const opencv_mat buf, const bool hevc_ena
 
         if (isAudioOnly) {
             // in this case, quit out fast since we won't be decoding this anyway
-            // (audio is metadata-only)
+            // (audio is metadata-only, apart from its cover art)
             return d;
         }
 
         // repeat the search for the video stream index
         if (!codec_params) {
-            for (int i = 0; i < d->container->nb_streams; i++) {
-                if (d->container->streams[i]->codecpar->codec_type == AVMEDIA_TYPE_VIDEO) {
-                    codec_params = d->container->streams[i]->codecpar;
-                    d->video_stream_index = i;
-                    break;
-                }
-            }
-            if (!codec_params) {
-                avcodec_decoder_release(d);
-                return NULL;
-            }
+            codec_params = avcodec_decoder_find_video_stream(d);
+        }
+    }
+
+    if (!codec_params) {
+        if (isAudioOnly) {
+            return d;
         }
+        avcodec_decoder_release(d);
+        return NULL;
     }
 
     const AVCodec* codec = avcodec_find_decoder(codec_params->codec_id);
@@ -253,6 +329,27 @@ avcodec_decoder avcodec_decoder_create(const opencv_mat buf, const bool hevc_ena
     return d;
 }
 
+avcodec_decoder avcodec_decoder_create(const opencv_mat buf, const bool hevc_enabled)
+{
+    avcodec_decoder d = new struct avcodec_decoder_struct();
+    memset(d, 0, sizeof(struct avcodec_decoder_struct));
+    d->mat = static_cast<const cv::Mat*>(buf);
+    return avcodec_decoder_open(d, hevc_enabled);
+}
+
+avcodec_decoder avcodec_decoder_create_from_reader(uintptr_t reader, const bool hevc_enabled)
+{
+    avcodec_decoder d = new struct avcodec_decoder_struct();
+    memset(d, 0, sizeof(struct avcodec_decoder_struct));
+    d->reader = reader;
+    return avcodec_decoder_open(d, hevc_enabled);
+}
+
+void avcodec_decoder_set_cancel_flag(avcodec_decoder d, const int* cancel_flag)
+{
+    d->cancel_flag = cancel_flag;
+}
+
 const uint8_t* avcodec_get_icc_profile(int color_primaries, size_t& profile_size) {
     switch (color_primaries) {
         case AVCOL_PRI_BT2020:
@@ -272,6 +369,9 @@ const uint8_t* avcodec_get_icc_profile(int color_primaries, size_t& profile_size
 }
 
 int avcodec_decoder_get_icc(const avcodec_decoder d, void* dest, size_t dest_len) {
+    if (!d->codec) {
+        return 0;
+    }
     size_t profile_size;
     const uint8_t* profile_data = avcodec_get_icc_profile(d->codec->color_primaries, profile_size);
 
@@ -380,6 +480,22 @@ const char* avcodec_decoder_get_description(const avcodec_decoder d)
     return "";
 }
 
+const void* avcodec_decoder_get_cover_art(const avcodec_decoder d, size_t* len)
+{
+    *len = 0;
+    if (!d->container) {
+        return NULL;
+    }
+    for (unsigned int i = 0; i < d->container->nb_streams; i++) {
+        AVStream* stream = d->container->streams[i];
+        if ((stream->disposition & AV_DISPOSITION_ATTACHED_PIC) && stream->attached_pic.size > 0) {
+            *len = stream->attached_pic.size;
+            return stream->attached_pic.data;
+        }
+    }
+    return NULL;
+}
+
 bool avcodec_decoder_has_subtitles(const avcodec_decoder d) {
     for (unsigned int i = 0; i < d->container->nb_streams; i++) {
         AVStream* stream = d->container->streams[i];
@@ -390,89 +506,311 @@ bool avcodec_decoder_has_subtitles(const avcodec_decoder d) {
     return false;
 }
 
-static int avcodec_decoder_copy_frame(const avcodec_decoder d, opencv_mat mat, AVFrame* frame) {
+static bool avcodec_copy_frame_to_mat(AVFrame* frame, cv::Mat* cvMat, int stepSize)
+{
+    // Create SwsContext for converting the frame format and scaling
+    struct SwsContext* sws = sws_getContext(
+      frame->width, frame->height, (AVPixelFormat)(frame->format), // Source dimensions and format
+      cvMat->cols, cvMat->rows, AV_PIX_FMT_BGRA, // Destination dimensions and format
+      SWS_BILINEAR, // Specify the scaling algorithm; you can choose another according to your needs
+      NULL, NULL, NULL);
+    if (!sws) {
+        return false;
+    }
+
+    // Configure colorspace
+    int colorspace;
+    switch (frame->colorspace) {
+        case AVCOL_SPC_BT2020_NCL:
+        case AVCOL_SPC_BT2020_CL:
+            colorspace = SWS_CS_BT2020;
+            break;
+        case AVCOL_SPC_BT470BG:
+            colorspace = SWS_CS_ITU601;
+            break;
+        case AVCOL_SPC_SMPTE170M:
+            colorspace = SWS_CS_SMPTE170M;
+            break;
+        case AVCOL_SPC_SMPTE240M:
+            colorspace = SWS_CS_SMPTE240M;
+            break;
+        default:
+            colorspace = SWS_CS_ITU709;
+            break;
+    }
+    const int* inv_table = sws_getCoefficients(colorspace);
+
+    // Configure color range
+    int srcRange = frame->color_range == AVCOL_RANGE_JPEG ? 1 : 0;
+
+    // Configure YUV conversion table
+    const int* table = sws_getCoefficients(SWS_CS_DEFAULT);
+
+    sws_setColorspaceDetails(sws, inv_table, srcRange, table, 1, 0, 1 << 16, 1 << 16);
+
+    // The linesizes and data pointers for the destination
+    int dstLinesizes[4];
+    av_image_fill_linesizes(dstLinesizes, AV_PIX_FMT_BGRA, stepSize / 4);
+    uint8_t* dstData[4] = {cvMat->data, NULL, NULL, NULL};
+
+    // Perform the scaling and format conversion
+    sws_scale(sws, frame->data, frame->linesize, 0, frame->height, dstData, dstLinesizes);
+
+    // Free the SwsContext
+    sws_freeContext(sws);
+    return true;
+}
+
+static bool avcodec_decoder_copy_frame(opencv_mat mat, AVFrame* frame)
+{
     auto cvMat = static_cast<cv::Mat*>(mat);
 
-    int res = avcodec_receive_frame(d->codec, frame);
-    if (res >= 0) {
-        // Calculate the step size based on the cv::Mat's width
-        int stepSize = 4 * cvMat->cols; // Assuming the cv::Mat is in BGRA format, which has 4 channels
-        if (cvMat->cols % 32 != 0) {
-            int width = cvMat->cols + 32 - (cvMat->cols % 32);
-            stepSize = 4 * width;
-        }
-        if (!opencv_mat_set_row_stride(mat, stepSize)) {
-            return -1;
-        }
-
-        // Create SwsContext for converting the frame format and scaling
-        struct SwsContext* sws = sws_getContext(
-            frame->width, frame->height, (AVPixelFormat)(frame->format), // Source dimensions and format
-            cvMat->cols, cvMat->rows, AV_PIX_FMT_BGRA, // Destination dimensions and format
-            SWS_BILINEAR, // Specify the scaling algorithm; you can choose another according to your needs
-            NULL, NULL, NULL);
-
-        // Configure colorspace
-        int colorspace;
-        switch (frame->colorspace) {
-            case AVCOL_SPC_BT2020_NCL:
-            case AVCOL_SPC_BT2020_CL:
-                colorspace = SWS_CS_BT2020;
-                break;
-            case AVCOL_SPC_BT470BG:
-                colorspace = SWS_CS_ITU601;
-                break;
-            case AVCOL_SPC_SMPTE170M:
-                colorspace = SWS_CS_SMPTE170M;
-                break;
-            case AVCOL_SPC_SMPTE240M:
-                colorspace = SWS_CS_SMPTE240M;
-                break;
-            default:
-                colorspace = SWS_CS_ITU709;
-                break;
+    // Calculate the step size based on the cv::Mat's width
+    int stepSize = 4 * cvMat->cols; // Assuming the cv::Mat is in BGRA format, which has 4 channels
+    if (cvMat->cols % 32 != 0) {
+        int width = cvMat->cols + 32 - (cvMat->cols % 32);
+        stepSize = 4 * width;
+    }
+    if (!opencv_mat_set_row_stride(mat, stepSize)) {
+        return false;
+    }
+
+    return avcodec_copy_frame_to_mat(frame, cvMat, stepSize);
+}
+
+// a frame is nearly black if fewer than 1 in 50 of a grid of its pixels are
+// brighter than a dim grey, so that a small title over black still counts
+static bool avcodec_mat_is_black(const cv::Mat* mat)
+{
+    int step_x = std::max(1, mat->cols / 64);
+    int step_y = std::max(1, mat->rows / 64);
+    int samples = 0;
+    int bright = 0;
+    for (int y = 0; y < mat->rows; y += step_y) {
+        const uint8_t* row = mat->ptr<uint8_t>(y);
+        for (int x = 0; x < mat->cols; x += step_x) {
+            const uint8_t* px = row + 4 * x;
+            int luma = (29 * px[0] + 150 * px[1] + 77 * px[2]) >> 8;
+            if (luma > 32) {
+                bright++;
+            }
+            samples++;
         }
-        const int* inv_table = sws_getCoefficients(colorspace);
+    }
+    return bright * 50 < samples;
+}
 
-        // Configure color range
-        int srcRange = frame->color_range == AVCOL_RANGE_JPEG ? 1 : 0;
+// scores how well a frame represents a video, from 0 to 1. frames with many
+// distinct tones and sharp edges score highly, and the score is reduced by the
+// share of pixels which are nearly black or nearly white, as in fades and titles
+static double avcodec_mat_score(const cv::Mat* mat)
+{
+    cv::Mat gray;
+    cv::cvtColor(*mat, gray, cv::COLOR_BGRA2GRAY);
 
-        // Configure YUV conversion table
-        const int* table = sws_getCoefficients(SWS_CS_DEFAULT);
+    int histogram[256] = {0};
+    int extreme = 0;
+    for (int y = 0; y < gray.rows; y++) {
+        const uint8_t* row = gray.ptr<uint8_t>(y);
+        for (int x = 0; x < gray.cols; x++) {
+            histogram[row[x]]++;
+            if (row[x] < 16 || row[x] > 239) {
+                extreme++;
+            }
+        }
+    }
+    double total = gray.total();
+    double entropy = 0;
+    for (int i = 0; i < 256; i++) {
+        if (histogram[i] > 0) {
+            double p = histogram[i] / total;
+            entropy -= p * std::log2(p);
+        }
+    }
 
-        sws_setColorspaceDetails(sws, inv_table, srcRange, table, 1, 0, 1 << 16, 1 << 16);
+    // the variance of the laplacian grows with the strength of edges, which blur removes
+    cv::Mat laplacian;
+    cv::Laplacian(gray, laplacian, CV_64F);
+    cv::Scalar mean, stddev;
+    cv::meanStdDev(laplacian, mean, stddev);
+    double variance = stddev[0] * stddev[0];
+    double sharpness = variance / (variance + 100);
 
-        // The linesizes and data pointers for the destination
-        int dstLinesizes[4];
-        av_image_fill_linesizes(dstLinesizes, AV_PIX_FMT_BGRA, stepSize / 4);
-        uint8_t* dstData[4] = {cvMat->data, NULL, NULL, NULL};
+    return (0.6 * entropy / 8 + 0.4 * sharpness) * (1 - extreme / total);
+}
 
-        // Perform the scaling and format conversion
-        sws_scale(sws, frame->data, frame->linesize, 0, frame->height, dstData, dstLinesizes);
+// positions the decoder so that the next frame decoded is the one shown at
+// ts, in the time base of the video stream
+static bool avcodec_decoder_seek_to_pts(avcodec_decoder d, int64_t ts, bool non_black_keyframe)
+{
+    // land on the keyframe at or before ts, then decode forward to it
+    if (av_seek_frame(d->container, d->video_stream_index, ts, AVSEEK_FLAG_BACKWARD) < 0) {
+        return false;
+    }
+    avcodec_flush_buffers(d->codec);
+    d->seek_pts = ts;
+    d->skip_black_keyframes = non_black_keyframe;
+    d->next_frame_time = -INFINITY;
+    d->at_end = false;
+    return true;
+}
+
+static int64_t avcodec_decoder_seconds_to_pts(const avcodec_decoder d, float seconds)
+{
+    AVStream* st = d->container->streams[d->video_stream_index];
+    int64_t ts = av_rescale_q((int64_t)(seconds * AV_TIME_BASE), AV_TIME_BASE_Q, st->time_base);
+    if (st->start_time != AV_NOPTS_VALUE) {
+        ts += st->start_time;
+    }
+    return ts;
+}
 
-        // Free the SwsContext
-        sws_freeContext(sws);
+bool avcodec_decoder_seek(avcodec_decoder d, float seconds, bool non_black_keyframe)
+{
+    if (!d || !d->container || !d->codec) {
+        return false;
     }
 
-    return res;
+    return avcodec_decoder_seek_to_pts(d, avcodec_decoder_seconds_to_pts(d, seconds), non_black_keyframe);
 }
 
-static int avcodec_decoder_decode_packet(const avcodec_decoder d, opencv_mat mat, AVPacket* packet)
+// decodes the first frame after the position the container was seeked to
+static bool avcodec_decoder_receive_first_frame(avcodec_decoder d, AVFrame* frame)
 {
-    int res = avcodec_send_packet(d->codec, packet);
-    if (res < 0) {
-        return res;
+    AVPacket packet;
+    while (!avcodec_decoder_is_cancelled(d)) {
+        int res = avcodec_receive_frame(d->codec, frame);
+        if (res >= 0) {
+            return true;
+        }
+        if (res != AVERROR(EAGAIN)) {
+            return false;
+        }
+
+        if (av_read_frame(d->container, &packet) < 0) {
+            avcodec_send_packet(d->codec, NULL);
+            continue;
+        }
+        if (packet.stream_index == d->video_stream_index) {
+            res = avcodec_send_packet(d->codec, &packet);
+            if (res < 0 && res != AVERROR_INVALIDDATA) {
+                av_packet_unref(&packet);
+                return false;
+            }
+        }
+        av_packet_unref(&packet);
     }
+    return false;
+}
+
+bool avcodec_decoder_seek_representative(avcodec_decoder d, int samples)
+{
+    if (!d || !d->container || !d->codec || samples < 1) {
+        return false;
+    }
+    float duration = avcodec_decoder_get_duration(d);
+    int width = avcodec_decoder_get_width(d);
+    int height = avcodec_decoder_get_height(d);
+    if (duration <= 0 || width <= 0 || height <= 0) {
+        return false;
+    }
+
+    // frames are scored at a small size, which sws scales them to as it converts them
+    int scored_width = std::min(width, AVCODEC_SCORED_FRAME_WIDTH);
+    int scored_height = std::max(1, (int)((int64_t)height * scored_width / width));
+    cv::Mat scored(scored_height, scored_width, CV_8UC4);
 
     AVFrame* frame = av_frame_alloc();
     if (!frame) {
-        return -1;
+        return false;
     }
 
-    res = avcodec_decoder_copy_frame(d, mat, frame);
+    // sample the keyframe at or before the middle of each of samples even
+    // spans of the video, as keyframes decode fastest and are the sharpest
+    double best_score = -1;
+    int64_t best_pts = AV_NOPTS_VALUE;
+    for (int i = 0; i < samples && !avcodec_decoder_is_cancelled(d); i++) {
+        int64_t ts = avcodec_decoder_seconds_to_pts(d, duration * (i + 0.5f) / samples);
+        if (!avcodec_decoder_seek_to_pts(d, ts, false)) {
+            break;
+        }
+        if (!avcodec_decoder_receive_first_frame(d, frame)) {
+            continue;
+        }
+        if (avcodec_copy_frame_to_mat(frame, &scored, scored.step)) {
+            double score = avcodec_mat_score(&scored);
+            if (score > best_score) {
+                best_score = score;
+                best_pts = frame->best_effort_timestamp != AV_NOPTS_VALUE ? frame->best_effort_timestamp : ts;
+            }
+        }
+        av_frame_unref(frame);
+    }
     av_frame_free(&frame);
 
-    return res;
+    if (best_pts == AV_NOPTS_VALUE) {
+        // leave the decoder at the start, where it would be otherwise
+        avcodec_decoder_seek_to_pts(d, avcodec_decoder_seconds_to_pts(d, 0), false);
+        return false;
+    }
+    return avcodec_decoder_seek_to_pts(d, best_pts, false);
+}
+
+void avcodec_decoder_set_max_frame_rate(avcodec_decoder d, double max_frame_rate)
+{
+    d->max_frame_rate = max_frame_rate > 0 ? max_frame_rate : 0;
+}
+
+double avcodec_decoder_get_frame_duration(const avcodec_decoder d)
+{
+    return d->frame_duration;
+}
+
+bool avcodec_decoder_has_more_frames(const avcodec_decoder d)
+{
+    return !d->at_end;
+}
+
+// the time a frame is shown for, in seconds, from its packet or else the
+// frame rate of the stream
+static double avcodec_decoder_get_native_duration(const avcodec_decoder d, const AVFrame* frame)
+{
+    AVStream* st = d->container->streams[d->video_stream_index];
+    if (frame->pkt_duration > 0) {
+        return frame->pkt_duration * av_q2d(st->time_base);
+    }
+    AVRational rate = st->avg_frame_rate.num > 0 ? st->avg_frame_rate : st->r_frame_rate;
+    if (rate.num > 0 && rate.den > 0) {
+        return av_q2d(av_inv_q(rate));
+    }
+    return 0;
+}
+
+// returns whether frame is to be dropped to respect max_frame_rate. frames
+// which are kept are shown until the next kept frame, so their duration
+// covers the frames dropped after them.
+static bool avcodec_decoder_limit_frame_rate(avcodec_decoder d, const AVFrame* frame)
+{
+    double duration = avcodec_decoder_get_native_duration(d, frame);
+    int64_t pts = frame->best_effort_timestamp;
+    if (pts == AV_NOPTS_VALUE) {
+        d->frame_duration = duration;
+        return false;
+    }
+
+    double time = pts * av_q2d(d->container->streams[d->video_stream_index]->time_base);
+    // tolerate jitter of up to half a frame in the timestamps
+    if (time < d->next_frame_time - duration / 2) {
+        return true;
+    }
+
+    if (d->max_frame_rate > 0 && duration > 0) {
+        double interval = 1 / d->max_frame_rate;
+        duration *= std::max(1.0, std::ceil(interval / duration - 1e-6));
+    }
+    d->frame_duration = duration;
+    d->next_frame_time = time + duration;
+    return false;
 }
 
 bool avcodec_decoder_decode(const avcodec_decoder d, opencv_mat mat)
@@ -486,26 +824,447 @@ bool avcodec_decoder_decode(const avcodec_decoder d, opencv_mat mat)
     if (!d->codec) {
         return false;
     }
+    if (d->at_end) {
+        return false;
+    }
+
+    AVFrame* frame = av_frame_alloc();
+    // the last frame shown before seek_pts, in case the video ends before it
+    AVFrame* last = av_frame_alloc();
+    if (!frame || !last) {
+        av_frame_free(&frame);
+        av_frame_free(&last);
+        return false;
+    }
+
     AVPacket packet;
-    bool done = false;
+    bool draining = false;
+    bool copied = false;
     bool success = false;
-    while (!done) {
-        int res = av_read_frame(d->container, &packet);
+    int black_keyframes = 0;
+    while (!avcodec_decoder_is_cancelled(d)) {
+        int res = avcodec_receive_frame(d->codec, frame);
+        if (res >= 0) {
+            int64_t pts = frame->best_effort_timestamp;
+            if (d->seek_pts != AV_NOPTS_VALUE && pts != AV_NOPTS_VALUE && pts < d->seek_pts) {
+                av_frame_unref(last);
+                av_frame_move_ref(last, frame);
+                continue;
+            }
+            if (avcodec_decoder_limit_frame_rate(d, frame)) {
+                av_frame_unref(frame);
+                continue;
+            }
+            if (!avcodec_decoder_copy_frame(mat, frame)) {
+                break;
+            }
+            copied = true;
+            if (d->skip_black_keyframes && black_keyframes < AVCODEC_MAX_BLACK_KEYFRAMES &&
+                avcodec_mat_is_black(static_cast<cv::Mat*>(mat))) {
+                black_keyframes++;
+                av_frame_unref(frame);
+                continue;
+            }
+            success = true;
+            break;
+        }
+        if (res == AVERROR_EOF) {
+            // every frame was black, or shown before seek_pts: settle for the last one
+            if (!copied && last->buf[0]) {
+                d->frame_duration = avcodec_decoder_get_native_duration(d, last);
+                copied = avcodec_decoder_copy_frame(mat, last);
+            }
+            success = copied;
+            d->at_end = true;
+            break;
+        }
+        if (res != AVERROR(EAGAIN) || draining) {
+            break;
+        }
+
+        // the decoder needs more input
+        res = av_read_frame(d->container, &packet);
         if (res < 0) {
+            avcodec_send_packet(d->codec, NULL);
+            draining = true;
+            continue;
+        }
+        bool is_key = packet.flags & AV_PKT_FLAG_KEY;
+        if (packet.stream_index == d->video_stream_index &&
+            (is_key || !d->skip_black_keyframes)) {
+            res = avcodec_send_packet(d->codec, &packet);
+            if (res < 0 && res != AVERROR_INVALIDDATA) {
+                av_packet_unref(&packet);
+                break;
+            }
+        }
+        av_packet_unref(&packet);
+    }
+
+    if (success) {
+        // later frames follow on from this one
+        d->seek_pts = AV_NOPTS_VALUE;
+        d->skip_black_keyframes = false;
+    }
+
+    av_frame_free(&frame);
+    av_frame_free(&last);
+    return success;
+}
+
+void avcodec_decoder_skip_to_end(avcodec_decoder d)
+{
+    // nothing follows the frames of a video, so rather than demuxing the rest
+    // of the content just to discard it, stop returning frames
+    if (d) {
+        d->at_end = true;
+    }
+}
+
+// the loudest sample and the sum of the squares of the samples of a block of audio
+struct avcodec_waveform_block {
+    float peak;
+    double sum_squares;
+    int count;
+};
+
+static void avcodec_waveform_add(std::vector<avcodec_waveform_block>& blocks, float peak, double square)
+{
+    if (blocks.empty() || blocks.back().count == AVCODEC_WAVEFORM_BLOCK_SAMPLES) {
+        blocks.push_back(avcodec_waveform_block());
+    }
+    avcodec_waveform_block& block = blocks.back();
+    block.peak = std::max(block.peak, peak);
+    block.sum_squares += square;
+    block.count++;
+}
+
+// returns the sample at p in the packed format fmt, from -1 to 1
+static float avcodec_read_sample(const uint8_t* p, AVSampleFormat fmt)
+{
+    switch (fmt) {
+    case AV_SAMPLE_FMT_U8:
+        return (p[0] - 128) / 128.0f;
+    case AV_SAMPLE_FMT_S16:
+        return *(const int16_t*)p / 32768.0f;
+    case AV_SAMPLE_FMT_S32:
+        return *(const int32_t*)p / 2147483648.0f;
+    case AV_SAMPLE_FMT_FLT:
+        return *(const float*)p;
+    case AV_SAMPLE_FMT_DBL:
+        return (float)*(const double*)p;
+    default:
+        return 0;
+    }
+}
+
+// adds the samples of the channels of a sample frame, counting the loudest
+// channel toward the peak and the mean of the channels toward the RMS
+static void avcodec_waveform_add_samples(std::vector<avcodec_waveform_block>& blocks,
+                                         const uint8_t* const* data,
+                                         AVSampleFormat fmt,
+                                         int channels,
+                                         int nb_samples)
+{
+    bool planar = av_sample_fmt_is_planar(fmt);
+    AVSampleFormat packed = av_get_packed_sample_fmt(fmt);
+    int size = av_get_bytes_per_sample(packed);
+    if (channels <= 0 || size <= 0) {
+        return;
+    }
+    for (int i = 0; i < nb_samples; i++) {
+        float peak = 0;
+        double square = 0;
+        for (int ch = 0; ch < channels; ch++) {
+            const uint8_t* p = planar ? data[ch] + i * size : data[0] + (i * channels + ch) * size;
+            float sample = std::min(1.0f, std::fabs(avcodec_read_sample(p, packed)));
+            peak = std::max(peak, sample);
+            square += sample * sample;
+        }
+        avcodec_waveform_add(blocks, peak, square / channels);
+    }
+}
+
+// the layout of the samples of PCM, which ffmpeg is built without decoders for,
+// as the samples of packets can be read directly. they are widened to their
+// sample format, in the byte order of the hosts lilliput runs on
+struct avcodec_pcm_layout {
+    AVSampleFormat format;
+    int bytes;
+    bool big_endian;
+};
+
+static avcodec_pcm_layout avcodec_pcm_sample_layout(AVCodecID codec_id)
+{
+    switch (codec_id) {
+    case AV_CODEC_ID_PCM_U8:
+        return {AV_SAMPLE_FMT_U8, 1, false};
+    case AV_CODEC_ID_PCM_S16LE:
+        return {AV_SAMPLE_FMT_S16, 2, false};
+    case AV_CODEC_ID_PCM_S16BE:
+        return {AV_SAMPLE_FMT_S16, 2, true};
+    case AV_CODEC_ID_PCM_S24LE:
+        return {AV_SAMPLE_FMT_S32, 3, false};
+    case AV_CODEC_ID_PCM_S24BE:
+        return {AV_SAMPLE_FMT_S32, 3, true};
+    case AV_CODEC_ID_PCM_S32LE:
+        return {AV_SAMPLE_FMT_S32, 4, false};
+    case AV_CODEC_ID_PCM_S32BE:
+        return {AV_SAMPLE_FMT_S32, 4, true};
+    case AV_CODEC_ID_PCM_F32LE:
+        return {AV_SAMPLE_FMT_FLT, 4, false};
+    case AV_CODEC_ID_PCM_F32BE:
+        return {AV_SAMPLE_FMT_FLT, 4, true};
+    case AV_CODEC_ID_PCM_F64LE:
+        return {AV_SAMPLE_FMT_DBL, 8, false};
+    case AV_CODEC_ID_PCM_F64BE:
+        return {AV_SAMPLE_FMT_DBL, 8, true};
+    default:
+        return {AV_SAMPLE_FMT_NONE, 0, false};
+    }
+}
+
+// returns the samples of a packet of PCM in their sample format, converting
+// them into converted if they are narrower or in the other byte order. 24-bit
+// samples fill the high bytes of 32-bit ones, keeping their scale
+static const uint8_t* avcodec_pcm_samples(const avcodec_pcm_layout& layout,
+                                          const uint8_t* data,
+                                          int count,
+                                          std::vector<uint8_t>& converted)
+{
+    int size = av_get_bytes_per_sample(layout.format);
+    if (size == layout.bytes && !layout.big_endian) {
+        return data;
+    }
+
+    converted.assign((size_t)count * size, 0);
+    for (int i = 0; i < count; i++) {
+        const uint8_t* src = data + i * layout.bytes;
+        uint8_t* dst = converted.data() + i * size;
+        // k counts bytes from the most significant
+        for (int k = 0; k < layout.bytes; k++) {
+            dst[size - 1 - k] = layout.big_endian ? src[k] : src[layout.bytes - 1 - k];
+        }
+    }
+    return converted.data();
+}
+
+static void avcodec_waveform_receive_frames(std::vector<avcodec_waveform_block>& blocks,
+                                            AVCodecContext* codec,
+                                            AVFrame* frame)
+{
+    while (avcodec_receive_frame(codec, frame) >= 0) {
+        avcodec_waveform_add_samples(blocks,
+                                     frame->extended_data,
+                                     (AVSampleFormat)frame->format,
+                                     frame->ch_layout.nb_channels,
+                                     frame->nb_samples);
+        av_frame_unref(frame);
+    }
+}
+
+// converts 0xAARRGGBB to a BGRA pixel
+static cv::Vec4b avcodec_waveform_color(uint32_t argb)
+{
+    return cv::Vec4b(argb & 0xFF, (argb >> 8) & 0xFF, (argb >> 16) & 0xFF, argb >> 24);
+}
+
+// fills the rows of column x of mat within extent of its middle with color
+static void avcodec_waveform_fill_column(cv::Mat* mat, int x, int extent, const cv::Vec4b& color)
+{
+    int middle = mat->rows / 2;
+    int top = std::max(0, middle - extent);
+    int bottom = std::min(mat->rows, middle + extent);
+    for (int y = top; y < bottom; y++) {
+        mat->at<cv::Vec4b>(y, x) = color;
+    }
+}
+
+static void avcodec_waveform_draw(cv::Mat* mat,
+                                  const std::vector<avcodec_waveform_block>& blocks,
+                                  uint32_t background,
+                                  uint32_t peak_color,
+                                  uint32_t rms_color)
+{
+    mat->setTo(cv::Scalar(avcodec_waveform_color(background)));
+
+    // the peaks of each column reach up and down from the middle, with full
+    // scale filling the height and silence a thin line through the middle.
+    // the RMS of the column is drawn over them
+    int n = blocks.size();
+    int width = mat->cols;
+    double half = mat->rows / 2.0;
+    for (int x = 0; x < width && n > 0; x++) {
+        int from = (int64_t)n * x / width;
+        int to = std::max(from + 1, (int)((int64_t)n * (x + 1) / width));
+        float peak = 0;
+        double sum_squares = 0;
+        int64_t count = 0;
+        for (int i = from; i < to; i++) {
+            peak = std::max(peak, blocks[i].peak);
+            sum_squares += blocks[i].sum_squares;
+            count += blocks[i].count;
+        }
+        double rms = count > 0 ? std::sqrt(sum_squares / count) : 0;
+
+        avcodec_waveform_fill_column(
+          mat, x, std::max(1, (int)std::lround(peak * half)), avcodec_waveform_color(peak_color));
+        avcodec_waveform_fill_column(
+          mat, x, (int)std::lround(rms * half), avcodec_waveform_color(rms_color));
+    }
+}
+
+bool avcodec_decoder_has_audio(const avcodec_decoder d)
+{
+    return d->container && av_find_best_stream(d->container, AVMEDIA_TYPE_AUDIO, -1, -1, NULL, 0) >= 0;
+}
+
+bool avcodec_decoder_can_decode_audio(const avcodec_decoder d)
+{
+    if (!d->container) {
+        return false;
+    }
+    int index = av_find_best_stream(d->container, AVMEDIA_TYPE_AUDIO, -1, -1, NULL, 0);
+    if (index < 0) {
+        return false;
+    }
+    AVCodecID codec_id = d->container->streams[index]->codecpar->codec_id;
+    return avcodec_pcm_sample_layout(codec_id).format != AV_SAMPLE_FMT_NONE ||
+      avcodec_find_decoder(codec_id);
+}
+
+bool avcodec_decoder_render_waveform(const avcodec_decoder d,
+                                     opencv_mat mat,
+                                     uint32_t background,
+                                     uint32_t peak_color,
+                                     uint32_t rms_color)
+{
+    auto cvMat = static_cast<cv::Mat*>(mat);
+    if (!d || !d->container || !cvMat || cvMat->type() != CV_8UC4) {
+        return false;
+    }
+    int index = av_find_best_stream(d->container, AVMEDIA_TYPE_AUDIO, -1, -1, NULL, 0);
+    if (index < 0) {
+        return false;
+    }
+
+    // the container may have been left part way through by seeking its video.
+    // content which cannot be seeked is still where it was opened
+    AVStream* stream = d->container->streams[index];
+    int64_t start = stream->start_time != AV_NOPTS_VALUE ? stream->start_time : 0;
+    av_seek_frame(d->container, index, start, AVSEEK_FLAG_BACKWARD);
+
+    AVCodecParameters* params = stream->codecpar;
+    avcodec_pcm_layout pcm = avcodec_pcm_sample_layout(params->codec_id);
+    AVCodecContext* codec = NULL;
+    if (pcm.format == AV_SAMPLE_FMT_NONE) {
+        const AVCodec* decoder = avcodec_find_decoder(params->codec_id);
+        if (!decoder) {
             return false;
         }
-        if (packet.stream_index == d->video_stream_index) {
-            res = avcodec_decoder_decode_packet(d, mat, &packet);
-            if (res >= 0) {
-                success = true;
-                done = true;
+        codec = avcodec_alloc_context3(decoder);
+        if (!codec || avcodec_parameters_to_context(codec, params) < 0 ||
+            avcodec_open2(codec, decoder, NULL) < 0) {
+            avcodec_free_context(&codec);
+            return false;
+        }
+    }
+
+    AVFrame* frame = av_frame_alloc();
+    if (!frame) {
+        avcodec_free_context(&codec);
+        return false;
+    }
+
+    std::vector<avcodec_waveform_block> blocks;
+    std::vector<uint8_t> converted;
+    int channels = params->ch_layout.nb_channels;
+    int pcm_frame_size = channels * pcm.bytes;
+    bool success = true;
+    AVPacket packet;
+    while (true) {
+        if (avcodec_decoder_is_cancelled(d)) {
+            success = false;
+            break;
+        }
+        if (av_read_frame(d->container, &packet) < 0) {
+            break;
+        }
+        if (packet.stream_index == index) {
+            if (!codec && pcm_frame_size > 0) {
+                int nb_samples = packet.size / pcm_frame_size;
+                const uint8_t* data[1] = {
+                  avcodec_pcm_samples(pcm, packet.data, nb_samples * channels, converted)};
+                avcodec_waveform_add_samples(blocks, data, pcm.format, channels, nb_samples);
             }
-            else if (res != AVERROR(EAGAIN) && res != AVERROR_INVALIDDATA) {
-                done = true;
+            else if (codec) {
+                int res = avcodec_send_packet(codec, &packet);
+                if (res < 0 && res != AVERROR_INVALIDDATA) {
+                    av_packet_unref(&packet);
+                    success = false;
+                    break;
+                }
+                avcodec_waveform_receive_frames(blocks, codec, frame);
             }
         }
         av_packet_unref(&packet);
     }
+
+    if (success && codec) {
+        // drain the frames the decoder holds back
+        avcodec_send_packet(codec, NULL);
+        avcodec_waveform_receive_frames(blocks, codec, frame);
+    }
+
+    av_frame_free(&frame);
+    avcodec_free_context(&codec);
+
+    if (success) {
+        avcodec_waveform_draw(cvMat, blocks, background, peak_color, rms_color);
+    }
+    return success;
+}
+
+bool avcodec_hevc_image_decode(const opencv_mat buf, opencv_mat dst)
+{
+    auto cvBuf = static_cast<const cv::Mat*>(buf);
+    auto cvDst = static_cast<cv::Mat*>(dst);
+    if (!cvBuf || !cvDst || cvDst->channels() != 4) {
+        return false;
+    }
+
+    const AVCodec* codec = avcodec_find_decoder(AV_CODEC_ID_HEVC);
+    if (!codec) {
+        return false;
+    }
+
+    AVCodecContext* ctx = avcodec_alloc_context3(codec);
+    if (!ctx) {
+        return false;
+    }
+
+    if (avcodec_open2(ctx, codec, NULL) < 0) {
+        avcodec_free_context(&ctx);
+        return false;
+    }
+
+    bool success = false;
+    AVPacket* packet = av_packet_alloc();
+    AVFrame* frame = av_frame_alloc();
+    if (packet && frame) {
+        packet->data = cvBuf->data;
+        packet->size = cvBuf->total();
+
+        // the bitstream holds exactly one picture, so flush right after sending it
+        if (avcodec_send_packet(ctx, packet) >= 0 && avcodec_send_packet(ctx, NULL) >= 0 &&
+            avcodec_receive_frame(ctx, frame) >= 0) {
+            success = avcodec_copy_frame_to_mat(frame, cvDst, cvDst->step);
+        }
+    }
+
+    av_frame_free(&frame);
+    av_packet_free(&packet);
+    avcodec_free_context(&ctx);
     return success;
 }
 
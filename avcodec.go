@@ -4,6 +4,8 @@ package lilliput
 import "C"
 
 import (
+	"errors"
+	"image/color"
 	"io"
 	"time"
 	"unsafe"
@@ -12,18 +14,105 @@ import (
 const probeBytesLimit = 32 * 1024
 const atomHeaderSize = 8
 
+var (
+	// ErrSeekNotSupported is returned when seeking content which has no
+	// video stream, or whose container cannot be seeked
+	ErrSeekNotSupported = errors.New("seek operation not supported by this decoder")
+
+	// ErrSeekOutOfRange is returned when seeking before the start or past the end of a video
+	ErrSeekOutOfRange = errors.New("seek position is outside of the video")
+
+	// ErrNoAudio is returned when rendering the waveform of content without an audio stream
+	ErrNoAudio = errors.New("content has no audio stream")
+
+	// ErrAudioNotSupported is returned when rendering the waveform of audio
+	// in a codec which cannot be decoded, such as A-law or µ-law PCM
+	ErrAudioNotSupported = errors.New("audio codec not supported")
+
+	// ErrInvalidWaveformSize is returned when rendering a waveform with no width or height
+	ErrInvalidWaveformSize = errors.New("waveform width and height must be positive")
+)
+
+// A VideoSeeker chooses the frame which DecodeTo returns from a video, which
+// is otherwise its first frame. Decoders of video implement it, and can be
+// seeked again after DecodeTo to return another frame.
+type VideoSeeker interface {
+	// SeekTo selects the frame shown at offset t from the start of the video.
+	SeekTo(t time.Duration) error
+
+	// SeekToPercent selects the frame shown after percent, from 0 to 100, of Duration().
+	SeekToPercent(percent float64) error
+
+	// SeekToNonBlackKeyframe selects the first keyframe which is not nearly
+	// black, skipping intros which fade in from black. If every keyframe
+	// examined is black, the last one is selected.
+	SeekToNonBlackKeyframe() error
+
+	// SeekToRepresentativeFrame samples keyframes from samples even spans of
+	// the video and selects the one which best represents it: the one with
+	// the most distinct tones and sharpest detail, and fewest nearly black
+	// or white pixels.
+	SeekToRepresentativeFrame(samples int) error
+}
+
+// A VideoAnimator makes DecodeTo return the successive frames of a video
+// rather than only its first, so that ImageOps can transform a clip into an
+// animated WebP. Decoders of video implement it. Until DecodeFrames is called,
+// Transform emits a single frame of a video.
+type VideoAnimator interface {
+	// DecodeFrames makes DecodeTo return every frame in turn, each lasting
+	// until the next, and then io.EOF. If maxFrameRate is positive, frames are
+	// dropped so that at most maxFrameRate are returned per second of video,
+	// and those kept last longer. As no data trails the frames of a video,
+	// SkipFrame ends it at once, returning io.EOF without reading the rest.
+	DecodeFrames(maxFrameRate float64)
+}
+
+// WaveformOptions describes the image of the waveform of audio rendered by a WaveformRenderer
+type WaveformOptions struct {
+	// Width and Height are the size of the image. Each column of pixels
+	// shows an even span of the audio.
+	Width  int
+	Height int
+
+	// BackgroundColor fills the image behind the waveform
+	BackgroundColor color.NRGBA
+
+	// PeakColor draws the loudest sample of each column, reaching up and down
+	// from the middle, with full scale filling the height. RMSColor draws the
+	// root mean square, the average loudness, of the column over it.
+	PeakColor color.NRGBA
+	RMSColor  color.NRGBA
+}
+
+// A WaveformRenderer makes DecodeTo render an image of the waveform of audio,
+// for audio without cover art to show. Decoders of audio and video implement it.
+type WaveformRenderer interface {
+	// DecodeWaveform makes DecodeTo decode the audio from the start of the
+	// content and render its waveform as opt describes, rather than a picture.
+	// It must be called before DecodeTo. ErrNoAudio is returned for content
+	// without an audio stream, and ErrAudioNotSupported for audio which
+	// cannot be decoded.
+	DecodeWaveform(opt WaveformOptions) error
+}
+
 // Set HEVC decoder enablement behind a build flag, defaults to off
 // Enable by building/running with "-ldflags=-X=github.com/discord/lilliput.hevcEnabled=true"
 var hevcEnabled string
 
 type avCodecDecoder struct {
-	decoder      C.avcodec_decoder
-	mat          C.opencv_mat
-	buf          []byte
-	hasDecoded   bool
-	maybeMP4     bool
-	isStreamable bool
-	hasSubtitles bool
+	decoder       C.avcodec_decoder
+	mat           C.opencv_mat
+	buf           []byte
+	reader        uintptr
+	contentLength int
+	hasDecoded    bool
+	animate       bool
+	maybeMP4      bool
+	isStreamable  bool
+	hasSubtitles  bool
+	cover         Decoder          // decodes the picture attached to audio as cover art
+	waveform      *WaveformOptions // rendered rather than a picture, if set
 }
 
 func newAVCodecDecoder(buf []byte) (*avCodecDecoder, error) {
@@ -39,12 +128,49 @@ func newAVCodecDecoder(buf []byte) (*avCodecDecoder, error) {
 	}
 
 	return &avCodecDecoder{
-		decoder:      decoder,
-		mat:          mat,
-		buf:          buf,
-		maybeMP4:     isMP4(buf),
-		isStreamable: isStreamable(mat),
-		hasSubtitles: hasSubtitles(decoder),
+		decoder:       decoder,
+		mat:           mat,
+		buf:           buf,
+		contentLength: len(buf),
+		maybeMP4:      isMP4(buf),
+		isStreamable:  isStreamable(mat, len(buf)),
+		hasSubtitles:  hasSubtitles(decoder),
+		cover:         newCoverArtDecoder(decoder),
+	}, nil
+}
+
+// newAVCodecDecoderFromReader creates a decoder which streams its content from r.
+// probe holds the start of the content and r must be positioned at its start.
+func newAVCodecDecoderFromReader(r io.ReadSeeker, probe []byte) (*avCodecDecoder, error) {
+	contentLength, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	probeMat := createMatFromBytes(probe)
+	if probeMat == nil {
+		return nil, ErrBufTooSmall
+	}
+	defer C.opencv_mat_release(probeMat)
+
+	reader := registerReader(r)
+	decoder := C.avcodec_decoder_create_from_reader(C.uintptr_t(reader), hevcEnabled == "true")
+	if decoder == nil {
+		unregisterReader(reader)
+		return nil, ErrInvalidImage
+	}
+
+	return &avCodecDecoder{
+		decoder:       decoder,
+		reader:        reader,
+		contentLength: int(contentLength),
+		maybeMP4:      isMP4(probe),
+		isStreamable:  isStreamable(probeMat, int(contentLength)),
+		hasSubtitles:  hasSubtitles(decoder),
+		cover:         newCoverArtDecoder(decoder),
 	}, nil
 }
 
@@ -56,8 +182,35 @@ func hasSubtitles(d C.avcodec_decoder) bool {
 	return bool(C.avcodec_decoder_has_subtitles(d))
 }
 
-func isStreamable(mat C.opencv_mat) bool {
-	return bool(C.avcodec_decoder_is_streamable(mat))
+// newCoverArtDecoder returns a Decoder of the picture attached as cover art
+// to audio, such as the APIC frame of an MP3 or the PICTURE block of a FLAC,
+// or nil if there is none which can be decoded. Videos decode their frames
+// rather than their cover art.
+func newCoverArtDecoder(d C.avcodec_decoder) Decoder {
+	if C.avcodec_decoder_get_width(d) > 0 {
+		return nil
+	}
+
+	var length C.size_t
+	data := C.avcodec_decoder_get_cover_art(d, &length)
+	if data == nil || length == 0 {
+		return nil
+	}
+
+	// the picture belongs to the container, which is closed independently
+	cover, err := NewDecoder(C.GoBytes(data, C.int(length)))
+	if err != nil {
+		return nil
+	}
+	if _, ok := cover.(*avCodecDecoder); ok {
+		cover.Close()
+		return nil
+	}
+	return cover
+}
+
+func isStreamable(mat C.opencv_mat, contentLength int) bool {
+	return bool(C.avcodec_decoder_is_streamable(mat, C.size_t(contentLength)))
 }
 
 func (d *avCodecDecoder) Description() string {
@@ -88,6 +241,13 @@ func (d *avCodecDecoder) LoopCount() int {
 }
 
 func (d *avCodecDecoder) ICC() []byte {
+	if d.waveform != nil {
+		// the colors of waveforms are sRGB
+		return []byte{}
+	}
+	if d.cover != nil {
+		return d.cover.ICC()
+	}
 	iccDst := make([]byte, 8192)
 	iccLength := C.avcodec_decoder_get_icc(d.decoder, unsafe.Pointer(&iccDst[0]), C.size_t(cap(iccDst)))
 	if iccLength <= 0 {
@@ -96,35 +256,143 @@ func (d *avCodecDecoder) ICC() []byte {
 	return iccDst[:iccLength]
 }
 
+// EXIF returns the metadata of the cover art of audio, and otherwise none,
+// as video containers do not carry EXIF
+func (d *avCodecDecoder) EXIF() []byte {
+	if exif := decodedEXIF(d.cover); exif != nil {
+		return exif
+	}
+	return []byte{}
+}
+
+// XMP returns the packet of the cover art of audio, and otherwise none, as
+// XMP boxes of video containers are not read
+func (d *avCodecDecoder) XMP() []byte {
+	if xmp := decodedXMP(d.cover); xmp != nil {
+		return xmp
+	}
+	return []byte{}
+}
+
 func (d *avCodecDecoder) Duration() time.Duration {
 	return time.Duration(float64(C.avcodec_decoder_get_duration(d.decoder)) * float64(time.Second))
 }
 
 func (d *avCodecDecoder) Header() (*ImageHeader, error) {
+	if d.waveform != nil {
+		return &ImageHeader{
+			width:         d.waveform.Width,
+			height:        d.waveform.Height,
+			pixelType:     PixelType(C.CV_8UC4),
+			orientation:   OrientationTopLeft,
+			numFrames:     1,
+			contentLength: d.contentLength,
+		}, nil
+	}
+
+	if d.cover != nil {
+		header, err := d.cover.Header()
+		if err != nil {
+			return nil, err
+		}
+		header.contentLength = d.contentLength
+		return header, nil
+	}
+
+	width := int(C.avcodec_decoder_get_width(d.decoder))
+	height := int(C.avcodec_decoder_get_height(d.decoder))
+	orientation := ImageOrientation(C.avcodec_decoder_get_orientation(d.decoder))
+	numFrames := 1
+	if d.animate {
+		// the number of frames is not known without decoding them. they are
+		// rotated as they are decoded, as every frame of an animation must
+		// have the size of its canvas
+		numFrames = 0
+		switch orientation {
+		case OrientationLeftTop, OrientationRightTop, OrientationRightBottom, OrientationLeftBottom:
+			width, height = height, width
+		}
+		orientation = OrientationTopLeft
+	}
+
 	return &ImageHeader{
-		width:         int(C.avcodec_decoder_get_width(d.decoder)),
-		height:        int(C.avcodec_decoder_get_height(d.decoder)),
+		width:         width,
+		height:        height,
 		pixelType:     PixelType(C.CV_8UC4),
-		orientation:   ImageOrientation(C.avcodec_decoder_get_orientation(d.decoder)),
-		numFrames:     1,
-		contentLength: len(d.buf),
+		orientation:   orientation,
+		numFrames:     numFrames,
+		contentLength: d.contentLength,
+		animated:      d.animate,
 	}, nil
 }
 
 func (d *avCodecDecoder) DecodeTo(f *Framebuffer) error {
-	if d.hasDecoded {
+	if d.waveform != nil {
+		return d.decodeWaveformTo(f)
+	}
+	if d.cover != nil {
+		return d.cover.DecodeTo(f)
+	}
+	if d.hasDecoded && !d.animate {
 		return io.EOF
 	}
-	h, err := d.Header()
+	err := f.resizeMat(int(C.avcodec_decoder_get_width(d.decoder)), int(C.avcodec_decoder_get_height(d.decoder)), PixelType(C.CV_8UC4))
 	if err != nil {
 		return err
 	}
-	err = f.resizeMat(h.Width(), h.Height(), h.PixelType())
+	ret := C.avcodec_decoder_decode(d.decoder, f.mat)
+	if !ret {
+		if d.hasDecoded && !bool(C.avcodec_decoder_has_more_frames(d.decoder)) {
+			return io.EOF
+		}
+		return ErrDecodingFailed
+	}
+	f.blend = NoBlend
+	f.dispose = DisposeToBackgroundColor
+	f.duration = time.Duration(0)
+	if d.animate {
+		f.OrientationTransform(ImageOrientation(C.avcodec_decoder_get_orientation(d.decoder)))
+		f.dispose = NoDispose
+		f.duration = time.Duration(float64(C.avcodec_decoder_get_frame_duration(d.decoder)) * float64(time.Second))
+	}
+	f.xOffset = 0
+	f.yOffset = 0
+	d.hasDecoded = true
+	return nil
+}
+
+func (d *avCodecDecoder) DecodeFrames(maxFrameRate float64) {
+	d.animate = true
+	C.avcodec_decoder_set_max_frame_rate(d.decoder, C.double(maxFrameRate))
+}
+
+func (d *avCodecDecoder) DecodeWaveform(opt WaveformOptions) error {
+	if opt.Width <= 0 || opt.Height <= 0 {
+		return ErrInvalidWaveformSize
+	}
+	if !C.avcodec_decoder_has_audio(d.decoder) {
+		return ErrNoAudio
+	}
+	if !C.avcodec_decoder_can_decode_audio(d.decoder) {
+		return ErrAudioNotSupported
+	}
+	if d.cover != nil {
+		d.cover.Close()
+		d.cover = nil
+	}
+	d.waveform = &opt
+	return nil
+}
+
+func (d *avCodecDecoder) decodeWaveformTo(f *Framebuffer) error {
+	if d.hasDecoded {
+		return io.EOF
+	}
+	err := f.resizeMat(d.waveform.Width, d.waveform.Height, PixelType(C.CV_8UC4))
 	if err != nil {
 		return err
 	}
-	ret := C.avcodec_decoder_decode(d.decoder, f.mat)
-	if !ret {
+	if !C.avcodec_decoder_render_waveform(d.decoder, f.mat, argb(d.waveform.BackgroundColor), argb(d.waveform.PeakColor), argb(d.waveform.RMSColor)) {
 		return ErrDecodingFailed
 	}
 	f.blend = NoBlend
@@ -136,13 +404,81 @@ func (d *avCodecDecoder) DecodeTo(f *Framebuffer) error {
 	return nil
 }
 
+// argb packs c as 0xAARRGGBB
+func argb(c color.NRGBA) C.uint32_t {
+	return C.uint32_t(c.A)<<24 | C.uint32_t(c.R)<<16 | C.uint32_t(c.G)<<8 | C.uint32_t(c.B)
+}
+
+func (d *avCodecDecoder) SeekTo(t time.Duration) error {
+	if t < 0 || (d.Duration() > 0 && t > d.Duration()) {
+		return ErrSeekOutOfRange
+	}
+	return d.seek(t, false)
+}
+
+func (d *avCodecDecoder) SeekToPercent(percent float64) error {
+	if percent < 0 || percent > 100 {
+		return ErrSeekOutOfRange
+	}
+	duration := d.Duration()
+	if duration <= 0 {
+		return ErrSeekNotSupported
+	}
+	return d.seek(time.Duration(float64(duration)*percent/100), false)
+}
+
+func (d *avCodecDecoder) SeekToNonBlackKeyframe() error {
+	return d.seek(0, true)
+}
+
+func (d *avCodecDecoder) SeekToRepresentativeFrame(samples int) error {
+	if samples < 1 {
+		samples = 1
+	}
+	if !C.avcodec_decoder_seek_representative(d.decoder, C.int(samples)) {
+		return ErrSeekNotSupported
+	}
+	d.hasDecoded = false
+	return nil
+}
+
+func (d *avCodecDecoder) seek(t time.Duration, nonBlackKeyframe bool) error {
+	if !C.avcodec_decoder_seek(d.decoder, C.float(t.Seconds()), C.bool(nonBlackKeyframe)) {
+		return ErrSeekNotSupported
+	}
+	d.hasDecoded = false
+	return nil
+}
+
 func (d *avCodecDecoder) SkipFrame() error {
-	return ErrSkipNotSupported
+	if d.waveform != nil {
+		return ErrSkipNotSupported
+	}
+	if d.cover != nil {
+		return d.cover.SkipFrame()
+	}
+	if !d.animate {
+		return ErrSkipNotSupported
+	}
+	C.avcodec_decoder_skip_to_end(d.decoder)
+	return io.EOF
+}
+
+func (d *avCodecDecoder) setCancelFlag(flag *C.int) {
+	C.avcodec_decoder_set_cancel_flag(d.decoder, flag)
 }
 
 func (d *avCodecDecoder) Close() {
+	if d.cover != nil {
+		d.cover.Close()
+	}
 	C.avcodec_decoder_release(d.decoder)
-	C.opencv_mat_release(d.mat)
+	if d.mat != nil {
+		C.opencv_mat_release(d.mat)
+	}
+	if d.reader != 0 {
+		unregisterReader(d.reader)
+	}
 	d.buf = nil
 }
 
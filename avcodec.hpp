@@ -3,6 +3,8 @@
 
 #include "opencv.hpp"
 
+#include <stdint.h>
+
 #ifdef __cplusplus
 extern "C" {
 #endif
@@ -12,16 +14,33 @@ typedef struct avcodec_decoder_struct* avcodec_decoder;
 void avcodec_init();
 
 avcodec_decoder avcodec_decoder_create(const opencv_mat buf, const bool hevc_enabled);
+avcodec_decoder avcodec_decoder_create_from_reader(uintptr_t reader, const bool hevc_enabled);
 void avcodec_decoder_release(avcodec_decoder d);
+void avcodec_decoder_set_cancel_flag(avcodec_decoder d, const int* cancel_flag);
 int avcodec_decoder_get_width(const avcodec_decoder d);
 int avcodec_decoder_get_height(const avcodec_decoder d);
 int avcodec_decoder_get_orientation(const avcodec_decoder d);
 float avcodec_decoder_get_duration(const avcodec_decoder d);
+bool avcodec_decoder_seek(avcodec_decoder d, float seconds, bool non_black_keyframe);
+bool avcodec_decoder_seek_representative(avcodec_decoder d, int samples);
+void avcodec_decoder_set_max_frame_rate(avcodec_decoder d, double max_frame_rate);
 bool avcodec_decoder_decode(const avcodec_decoder d, opencv_mat mat);
-bool avcodec_decoder_is_streamable(const opencv_mat buf);
+double avcodec_decoder_get_frame_duration(const avcodec_decoder d);
+bool avcodec_decoder_has_more_frames(const avcodec_decoder d);
+void avcodec_decoder_skip_to_end(avcodec_decoder d);
+bool avcodec_decoder_is_streamable(const opencv_mat buf, size_t content_len);
 bool avcodec_decoder_has_subtitles(const avcodec_decoder d);
+const void* avcodec_decoder_get_cover_art(const avcodec_decoder d, size_t* len);
+bool avcodec_decoder_has_audio(const avcodec_decoder d);
+bool avcodec_decoder_can_decode_audio(const avcodec_decoder d);
+bool avcodec_decoder_render_waveform(const avcodec_decoder d,
+                                     opencv_mat mat,
+                                     uint32_t background,
+                                     uint32_t peak_color,
+                                     uint32_t rms_color);
 const char* avcodec_decoder_get_description(const avcodec_decoder d);
 int avcodec_decoder_get_icc(const avcodec_decoder d, void* dest, size_t dest_len);
+bool avcodec_hevc_image_decode(const opencv_mat buf, opencv_mat dst);
 
 #ifdef __cplusplus
 }
@@ -1,8 +1,17 @@
 package lilliput
 
 import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestIsStreamable(t *testing.T) {
@@ -11,7 +20,7 @@ func TestIsStreamable(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open test file: %v", err)
 	}
-	if isStreamable(createMatFromBytes(stdMp4)) {
+	if isStreamable(createMatFromBytes(stdMp4), len(stdMp4)) {
 		t.Fatalf("expected file to not be streamable")
 	}
 
@@ -20,7 +29,7 @@ func TestIsStreamable(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open test file: %v", err)
 	}
-	if !isStreamable(createMatFromBytes(webMp4)) {
+	if !isStreamable(createMatFromBytes(webMp4), len(webMp4)) {
 		t.Fatalf("expected file to be streamable")
 	}
 
@@ -29,7 +38,7 @@ func TestIsStreamable(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open test file: %v", err)
 	}
-	if isStreamable(createMatFromBytes(bigAtomMp4)) {
+	if isStreamable(createMatFromBytes(bigAtomMp4), len(bigAtomMp4)) {
 		t.Fatalf("expected file to not be streamable")
 	}
 
@@ -38,7 +47,7 @@ func TestIsStreamable(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open test file: %v", err)
 	}
-	if isStreamable(createMatFromBytes(zeroLengthAtomMp4)) {
+	if isStreamable(createMatFromBytes(zeroLengthAtomMp4), len(zeroLengthAtomMp4)) {
 		t.Fatalf("expected file to not be streamable")
 	}
 }
@@ -59,6 +68,511 @@ func TestICCProfile(t *testing.T) {
 	}
 }
 
+// decodeTestVideoFrame decodes the selected frame of d, by way of a PNG
+func decodeTestVideoFrame(t *testing.T, d Decoder) image.Image {
+	fb := NewFramebuffer(1024, 1024)
+	defer fb.Close()
+	if err := d.DecodeTo(fb); err != nil {
+		t.Fatalf("DecodeTo failed: %v", err)
+	}
+
+	enc, err := NewEncoder(".png", d, make([]byte, 4*1024*1024))
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	defer enc.Close()
+	out, err := enc.Encode(fb, nil)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("png.Decode failed: %v", err)
+	}
+	return img
+}
+
+func TestVideoSeeker(t *testing.T) {
+	mp4, err := os.ReadFile("testdata/big_buck_bunny_480p_10s_std.mp4")
+	if err != nil {
+		t.Fatalf("failed to open test file: %v", err)
+	}
+
+	decoder, err := NewDecoder(mp4)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	defer decoder.Close()
+	first := decodeTestVideoFrame(t, decoder)
+
+	seeker, ok := decoder.(VideoSeeker)
+	if !ok {
+		t.Fatalf("Expected %T to be a VideoSeeker", decoder)
+	}
+	if err = seeker.SeekTo(-time.Second); err != ErrSeekOutOfRange {
+		t.Errorf("SeekTo(-1s) error = %v, want ErrSeekOutOfRange", err)
+	}
+	if err = seeker.SeekToPercent(101); err != ErrSeekOutOfRange {
+		t.Errorf("SeekToPercent(101) error = %v, want ErrSeekOutOfRange", err)
+	}
+
+	if err = seeker.SeekTo(5 * time.Second); err != nil {
+		t.Fatalf("SeekTo failed: %v", err)
+	}
+	middle := decodeTestVideoFrame(t, decoder)
+	if first.Bounds() != middle.Bounds() {
+		t.Fatalf("frame sizes differ: %v and %v", first.Bounds(), middle.Bounds())
+	}
+	differing := 0
+	for y := 0; y < first.Bounds().Dy(); y += 8 {
+		for x := 0; x < first.Bounds().Dx(); x += 8 {
+			if first.At(x, y) != middle.At(x, y) {
+				differing++
+			}
+		}
+	}
+	if differing == 0 {
+		t.Errorf("Expected the frame at 5s to differ from the first frame")
+	}
+
+	// seeking backwards, and to the very end, selects a frame too
+	for _, percent := range []float64{10, 100} {
+		if err = seeker.SeekToPercent(percent); err != nil {
+			t.Fatalf("SeekToPercent(%v) failed: %v", percent, err)
+		}
+		decodeTestVideoFrame(t, decoder)
+	}
+
+	if err = seeker.SeekToNonBlackKeyframe(); err != nil {
+		t.Fatalf("SeekToNonBlackKeyframe failed: %v", err)
+	}
+	frame := decodeTestVideoFrame(t, decoder)
+	bounds := frame.Bounds()
+	samples, bright := 0, 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += 8 {
+		for x := bounds.Min.X; x < bounds.Max.X; x += 8 {
+			r, g, b, _ := frame.At(x, y).RGBA()
+			if (77*r+150*g+29*b)>>16 > 32 {
+				bright++
+			}
+			samples++
+		}
+	}
+	if bright*50 < samples {
+		t.Errorf("Expected a frame which is not black, %d of %d pixels are bright", bright, samples)
+	}
+
+	if err = seeker.SeekToRepresentativeFrame(5); err != nil {
+		t.Fatalf("SeekToRepresentativeFrame failed: %v", err)
+	}
+	representative := decodeTestVideoFrame(t, decoder)
+	if representative.Bounds() != first.Bounds() {
+		t.Fatalf("frame sizes differ: %v and %v", first.Bounds(), representative.Bounds())
+	}
+	if countTestTones(representative) <= countTestTones(first) {
+		t.Errorf("Expected the representative frame to have more tones than the first frame")
+	}
+}
+
+// countTestTones counts the distinct grey levels of a grid of the pixels of img
+func countTestTones(img image.Image) int {
+	tones := make(map[uint32]bool)
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += 4 {
+		for x := bounds.Min.X; x < bounds.Max.X; x += 4 {
+			r, g, b, _ := img.At(x, y).RGBA()
+			tones[(77*r+150*g+29*b)>>16>>8] = true
+		}
+	}
+	return len(tones)
+}
+
+func TestVideoAnimator(t *testing.T) {
+	mp4, err := os.ReadFile("testdata/big_buck_bunny_480p_10s_std.mp4")
+	if err != nil {
+		t.Fatalf("failed to open test file: %v", err)
+	}
+
+	// count the frames of the first two seconds, and their durations, at the
+	// frame rate of the video and when capped at 5 frames per second
+	counts := make(map[float64]int)
+	for _, maxFrameRate := range []float64{0, 5} {
+		decoder, err := NewDecoder(mp4)
+		if err != nil {
+			t.Fatalf("NewDecoder failed: %v", err)
+		}
+		animator, ok := decoder.(VideoAnimator)
+		if !ok {
+			t.Fatalf("Expected %T to be a VideoAnimator", decoder)
+		}
+		animator.DecodeFrames(maxFrameRate)
+
+		header, err := decoder.Header()
+		if err != nil {
+			t.Fatalf("Header failed: %v", err)
+		}
+		if !header.IsAnimated() {
+			t.Errorf("Expected an animated header with DecodeFrames(%v)", maxFrameRate)
+		}
+		if header.numFrames != 0 {
+			t.Errorf("Expected an unknown number of frames, got %d", header.numFrames)
+		}
+
+		fb := NewFramebuffer(1024, 1024)
+		var total time.Duration
+		for total < 2*time.Second {
+			if err = decoder.DecodeTo(fb); err != nil {
+				t.Fatalf("DecodeTo failed after %v: %v", total, err)
+			}
+			if fb.Duration() <= 0 {
+				t.Fatalf("Expected frame %d to have a duration", counts[maxFrameRate])
+			}
+			if maxFrameRate > 0 && fb.Duration() < 200*time.Millisecond-time.Millisecond {
+				t.Errorf("frame duration = %v, want at least 200ms at 5fps", fb.Duration())
+			}
+			total += fb.Duration()
+			counts[maxFrameRate]++
+		}
+
+		// skip the rest of the video without reading it
+		if err = decoder.SkipFrame(); err != io.EOF {
+			t.Errorf("SkipFrame returned %v, want io.EOF", err)
+		}
+		if err = decoder.DecodeTo(fb); err != io.EOF {
+			t.Errorf("DecodeTo at the end returned %v, want io.EOF", err)
+		}
+		fb.Close()
+		decoder.Close()
+	}
+
+	if counts[0] < 40 || counts[5] > 11 {
+		t.Errorf("Expected about 48 frames, and 10 at 5fps, in 2s, got %d and %d", counts[0], counts[5])
+	}
+}
+
+// insertTestMP3Cover replaces the ID3 tag of mp3 with one holding an APIC frame of cover
+func insertTestMP3Cover(mp3, cover []byte) []byte {
+	if bytes.HasPrefix(mp3, []byte("ID3")) {
+		size := int(mp3[6])<<21 | int(mp3[7])<<14 | int(mp3[8])<<7 | int(mp3[9])
+		if mp3[5]&0x10 != 0 {
+			// the tag has a footer
+			size += 10
+		}
+		mp3 = mp3[10+size:]
+	}
+
+	body := append([]byte("\x00image/jpeg\x00\x03\x00"), cover...)
+	frame := append([]byte("APIC\x00\x00\x00\x00\x00\x00"), body...)
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(body)))
+
+	// ID3v2.3, with the size of the tag split into 7 bit bytes
+	size := len(frame)
+	tag := []byte{'I', 'D', '3', 3, 0, 0, byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)}
+	tag = append(tag, frame...)
+	return append(tag, mp3...)
+}
+
+// insertTestFLACCover adds a PICTURE metadata block of cover after the STREAMINFO block of flac
+func insertTestFLACCover(flac, cover []byte) []byte {
+	streamInfoEnd := 8 + (int(flac[5])<<16 | int(flac[6])<<8 | int(flac[7]))
+	isLast := flac[4]&0x80 != 0
+
+	mime := "image/jpeg"
+	body := make([]byte, 8, 32+len(mime)+len(cover))
+	binary.BigEndian.PutUint32(body, 3)
+	binary.BigEndian.PutUint32(body[4:], uint32(len(mime)))
+	body = append(body, mime...)
+	// an empty description, and a size, depth and palette which decoders do not need
+	body = append(body, make([]byte, 20)...)
+	binary.BigEndian.PutUint32(body[len(body)-4:], uint32(len(cover)))
+	body = append(body, cover...)
+
+	block := []byte{6, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	if isLast {
+		block[0] |= 0x80
+	}
+	block = append(block, body...)
+
+	out := append([]byte{}, flac[:streamInfoEnd]...)
+	out[4] &^= 0x80
+	out = append(out, block...)
+	return append(out, flac[streamInfoEnd:]...)
+}
+
+func TestAudioCoverArt(t *testing.T) {
+	cover, err := os.ReadFile("testdata/ferry_sunset.jpg")
+	if err != nil {
+		t.Fatalf("failed to open test file: %v", err)
+	}
+	coverConfig, err := jpeg.DecodeConfig(bytes.NewReader(cover))
+	if err != nil {
+		t.Fatalf("jpeg.DecodeConfig failed: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		sourceFilePath string
+		insert         func(audio, cover []byte) []byte
+	}{
+		{"MP3", "testdata/tos-intro-3s.mp3", insertTestMP3Cover},
+		{"FLAC", "testdata/tos-intro-3s.flac", insertTestFLACCover},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audio, err := os.ReadFile(tt.sourceFilePath)
+			if err != nil {
+				t.Fatalf("failed to open test file: %v", err)
+			}
+
+			decoder, err := NewDecoder(tt.insert(audio, cover))
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+			defer decoder.Close()
+			if decoder.Description() != tt.name {
+				t.Errorf("Description() = %q, want %q", decoder.Description(), tt.name)
+			}
+			if decoder.Duration() <= 0 {
+				t.Errorf("Expected the duration of the audio, got %v", decoder.Duration())
+			}
+			header, err := decoder.Header()
+			if err != nil {
+				t.Fatalf("Header failed: %v", err)
+			}
+			if header.Width() != coverConfig.Width || header.Height() != coverConfig.Height {
+				t.Errorf("header size = %dx%d, want the %dx%d cover", header.Width(), header.Height(), coverConfig.Width, coverConfig.Height)
+			}
+
+			img := decodeTestVideoFrame(t, decoder)
+			if img.Bounds().Dx() != coverConfig.Width || img.Bounds().Dy() != coverConfig.Height {
+				t.Errorf("decoded cover is %v, want %dx%d", img.Bounds(), coverConfig.Width, coverConfig.Height)
+			}
+			if countTestTones(img) < 32 {
+				t.Errorf("Expected the decoded cover to be a photo, got %d tones", countTestTones(img))
+			}
+			fb := NewFramebuffer(1024, 1024)
+			defer fb.Close()
+			if err = decoder.DecodeTo(fb); err != io.EOF {
+				t.Errorf("DecodeTo after the cover returned %v, want io.EOF", err)
+			}
+			if err = decoder.(VideoSeeker).SeekTo(time.Second); err != ErrSeekNotSupported {
+				t.Errorf("SeekTo error = %v, want ErrSeekNotSupported", err)
+			}
+
+			// Transform makes a thumbnail of the cover
+			thumbnailDecoder, err := NewDecoder(tt.insert(audio, cover))
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+			defer thumbnailDecoder.Close()
+			ops := NewImageOps(1024)
+			defer ops.Close()
+			options := &ImageOptions{FileType: ".png", Width: 64, Height: 64, ResizeMethod: ImageOpsFit}
+			thumbnail, err := ops.Transform(thumbnailDecoder, options, make([]byte, 1024*1024))
+			if err != nil {
+				t.Fatalf("Transform failed: %v", err)
+			}
+			thumbnailConfig, err := png.DecodeConfig(bytes.NewReader(thumbnail))
+			if err != nil || thumbnailConfig.Width != 64 || thumbnailConfig.Height != 64 {
+				t.Errorf("Expected a 64x64 PNG thumbnail, got %+v, %v", thumbnailConfig, err)
+			}
+		})
+	}
+}
+
+func TestWaveformRenderer(t *testing.T) {
+	background := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	peak := color.NRGBA{R: 88, G: 101, B: 242, A: 255}
+	rms := color.NRGBA{R: 30, G: 31, B: 34, A: 255}
+
+	for _, sourceFilePath := range []string{
+		"testdata/tos-intro-3s.mp3",
+		"testdata/tos-intro-3s.flac",
+		"testdata/tos-intro-3s.wav",
+		"testdata/tos-intro-3s.wav 24-bit",
+		"testdata/tos-intro-3s.ogg",
+		"testdata/tos-intro-3s.aac",
+	} {
+		t.Run(sourceFilePath, func(t *testing.T) {
+			audio, err := os.ReadFile(strings.TrimSuffix(sourceFilePath, " 24-bit"))
+			if err != nil {
+				t.Fatalf("failed to open test file: %v", err)
+			}
+			if strings.HasSuffix(sourceFilePath, " 24-bit") {
+				audio = rewriteTestWAV(audio, 1, 24)
+			}
+			decoder, err := NewDecoder(audio)
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+			defer decoder.Close()
+
+			renderer, ok := decoder.(WaveformRenderer)
+			if !ok {
+				t.Fatalf("Expected %T to be a WaveformRenderer", decoder)
+			}
+			if err = renderer.DecodeWaveform(WaveformOptions{Width: 0, Height: 80}); err != ErrInvalidWaveformSize {
+				t.Errorf("DecodeWaveform with no width returned %v, want ErrInvalidWaveformSize", err)
+			}
+			opt := WaveformOptions{Width: 320, Height: 80, BackgroundColor: background, PeakColor: peak, RMSColor: rms}
+			if err = renderer.DecodeWaveform(opt); err != nil {
+				t.Fatalf("DecodeWaveform failed: %v", err)
+			}
+
+			ops := NewImageOps(1024)
+			defer ops.Close()
+			options := &ImageOptions{FileType: ".png", ResizeMethod: ImageOpsNoResize}
+			output, err := ops.Transform(decoder, options, make([]byte, 1024*1024))
+			if err != nil {
+				t.Fatalf("Transform failed: %v", err)
+			}
+			img, err := png.Decode(bytes.NewReader(output))
+			if err != nil {
+				t.Fatalf("png.Decode failed: %v", err)
+			}
+			if img.Bounds().Dx() != 320 || img.Bounds().Dy() != 80 {
+				t.Fatalf("waveform is %v, want 320x80", img.Bounds())
+			}
+
+			// the music reaches a quarter of full scale in about 130 columns,
+			// and its RMS is drawn at the middle of nearly all of them
+			loud, drawnRMS := 0, 0
+			for x := 0; x < 320; x++ {
+				if c := color.NRGBAModel.Convert(img.At(x, 30)).(color.NRGBA); c == peak || c == rms {
+					loud++
+				}
+				if c := color.NRGBAModel.Convert(img.At(x, 39)).(color.NRGBA); c == rms {
+					drawnRMS++
+				}
+			}
+			if loud < 80 || drawnRMS < 160 {
+				t.Errorf("Expected a waveform across most columns, got %d loud columns and %d with RMS", loud, drawnRMS)
+			}
+			// no column reaches full scale, leaving the corners to the background
+			if c := color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA); c != background {
+				t.Errorf("Expected the background color in the corner, got %v", c)
+			}
+		})
+	}
+}
+
+// rewriteTestWAV rewrites the 16-bit PCM of a WAV with formatTag and
+// bitsPerSample, keeping the most significant bits of samples narrowed to 8
+// bits and padding those widened to 24 bits
+func rewriteTestWAV(wav []byte, formatTag uint16, bitsPerSample int) []byte {
+	var format, samples []byte
+	for pos := 12; pos+8 <= len(wav); {
+		length := int(binary.LittleEndian.Uint32(wav[pos+4:]))
+		switch string(wav[pos : pos+4]) {
+		case "fmt ":
+			format = append([]byte{}, wav[pos+8:pos+8+16]...)
+		case "data":
+			samples = wav[pos+8 : pos+8+length]
+		}
+		pos += 8 + length + length&1
+	}
+
+	var data []byte
+	for i := 0; i+1 < len(samples); i += 2 {
+		if bitsPerSample == 8 {
+			data = append(data, samples[i+1])
+		} else {
+			data = append(data, 0, samples[i], samples[i+1])
+		}
+	}
+
+	channels := int(binary.LittleEndian.Uint16(format[2:]))
+	sampleRate := int(binary.LittleEndian.Uint32(format[4:]))
+	blockAlign := channels * bitsPerSample / 8
+	binary.LittleEndian.PutUint16(format[0:], formatTag)
+	binary.LittleEndian.PutUint32(format[8:], uint32(sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(format[12:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(format[14:], uint16(bitsPerSample))
+
+	out := append([]byte("RIFF"), make([]byte, 4)...)
+	out = append(out, "WAVEfmt "...)
+	out = append(out, make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(out[len(out)-4:], uint32(len(format)))
+	out = append(out, format...)
+	out = append(out, "data"...)
+	out = append(out, make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(out[len(out)-4:], uint32(len(data)))
+	out = append(out, data...)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out
+}
+
+func TestWaveformRenderer_Unsupported(t *testing.T) {
+	wav, err := os.ReadFile("testdata/tos-intro-3s.wav")
+	if err != nil {
+		t.Fatalf("failed to open test file: %v", err)
+	}
+
+	// A-law, which ffmpeg is built without a decoder for
+	decoder, err := NewDecoder(rewriteTestWAV(wav, 6, 8))
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	defer decoder.Close()
+	err = decoder.(WaveformRenderer).DecodeWaveform(WaveformOptions{Width: 320, Height: 80})
+	if err != ErrAudioNotSupported {
+		t.Errorf("DecodeWaveform of A-law returned %v, want ErrAudioNotSupported", err)
+	}
+}
+
+func TestWaveformRenderer_AfterSeek(t *testing.T) {
+	video, err := os.ReadFile("testdata/big_buck_bunny_480p_10s_std.mp4")
+	if err != nil {
+		t.Fatalf("failed to open test file: %v", err)
+	}
+
+	// the waveform covers all of the audio, wherever the video was seeked to
+	var waveforms [2][]byte
+	for i, seek := range []bool{false, true} {
+		decoder, err := NewDecoder(video)
+		if err != nil {
+			t.Fatalf("NewDecoder failed: %v", err)
+		}
+		if seek {
+			if err = decoder.(VideoSeeker).SeekTo(8 * time.Second); err != nil {
+				t.Fatalf("SeekTo failed: %v", err)
+			}
+		}
+		if err = decoder.(WaveformRenderer).DecodeWaveform(WaveformOptions{Width: 320, Height: 80}); err != nil {
+			t.Fatalf("DecodeWaveform failed: %v", err)
+		}
+		fb := NewFramebuffer(320, 80)
+		if err = decoder.DecodeTo(fb); err != nil {
+			t.Fatalf("DecodeTo failed: %v", err)
+		}
+		waveforms[i] = append([]byte{}, fb.buf[:320*80*4]...)
+		fb.Close()
+		decoder.Close()
+	}
+	if !bytes.Equal(waveforms[0], waveforms[1]) {
+		t.Errorf("Expected the same waveform after seeking the video")
+	}
+}
+
+func TestVideoSeeker_Audio(t *testing.T) {
+	mp3, err := os.ReadFile("testdata/tos-intro-3s.mp3")
+	if err != nil {
+		t.Fatalf("failed to open test file: %v", err)
+	}
+
+	decoder, err := NewDecoder(mp3)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	defer decoder.Close()
+	if err = decoder.(VideoSeeker).SeekTo(time.Second); err != ErrSeekNotSupported {
+		t.Errorf("SeekTo error = %v, want ErrSeekNotSupported", err)
+	}
+	if err = decoder.(VideoSeeker).SeekToRepresentativeFrame(5); err != ErrSeekNotSupported {
+		t.Errorf("SeekToRepresentativeFrame error = %v, want ErrSeekNotSupported", err)
+	}
+}
+
 func BenchmarkIsStreamableWebMp4(b *testing.B) {
 	// Read the web-optimized streamable MP4 file
 	webMp4, err := os.ReadFile("testdata/big_buck_bunny_480p_10s_web.mp4")
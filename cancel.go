@@ -0,0 +1,37 @@
+package lilliput
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// A cancelFlag is polled by the long running loops of the C codecs. It lives
+// in C memory so that the codecs may keep it while it is set from another
+// goroutine.
+type cancelFlag struct {
+	ptr *C.int
+}
+
+func newCancelFlag() *cancelFlag {
+	return &cancelFlag{ptr: (*C.int)(C.calloc(1, C.sizeof_int))}
+}
+
+// cancel makes every codec polling the flag abandon its current frame
+func (c *cancelFlag) cancel() {
+	atomic.StoreInt32((*int32)(unsafe.Pointer(c.ptr)), 1)
+}
+
+// release frees the flag. No codec may be polling it anymore.
+func (c *cancelFlag) release() {
+	C.free(unsafe.Pointer(c.ptr))
+	c.ptr = nil
+}
+
+// cancellable is implemented by the Decoders and Encoders which poll a
+// cancelFlag while decoding or encoding a frame. A nil flag stops polling.
+type cancellable interface {
+	setCancelFlag(flag *C.int)
+}
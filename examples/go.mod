@@ -2,6 +2,6 @@ module example
 
 go 1.23.2
 
-require github.com/discord/lilliput v0.0.0-20241012171911-37dccacf7c50 // indirect
+require github.com/discord/lilliput v0.0.0-20241012171911-37dccacf7c50
 
 replace github.com/discord/lilliput => ..
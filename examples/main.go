@@ -39,14 +39,15 @@ func main() {
 		os.Exit(1)
 	}
 
-	// decoder wants []byte, so read the whole file into a buffer
-	inputBuf, err := os.ReadFile(inputFilename)
+	// videos are streamed from the file, images are read into memory
+	inputFile, err := os.Open(inputFilename)
 	if err != nil {
-		fmt.Printf("failed to read input file, %s\n", err)
+		fmt.Printf("failed to open input file, %s\n", err)
 		os.Exit(1)
 	}
+	defer inputFile.Close()
 
-	decoder, err := lilliput.NewDecoder(inputBuf)
+	decoder, err := lilliput.NewDecoderFromReader(inputFile)
 	// this error reflects very basic checks,
 	// mostly just for the magic bytes of the file to match known image formats
 	if err != nil {
@@ -77,8 +78,9 @@ func main() {
 	ops := lilliput.NewImageOps(8192)
 	defer ops.Close()
 
-	// create a buffer to store the output image, 50MB in this case
-	outputImg := make([]byte, 500*1024*1024)
+	// create a buffer to store the output image, 1MB in this case.
+	// GrowDestination below lets larger outputs be allocated as needed
+	outputImg := make([]byte, 1024*1024)
 
 	// use user supplied filename to guess output type if provided
 	// otherwise don't transcode (use existing type)
@@ -117,6 +119,7 @@ func main() {
 		NormalizeOrientation: true,
 		EncodeOptions:        EncodeOptions[outputType],
 		EncodeTimeout:        encodeTimeout,
+		GrowDestination:      true,
 	}
 
 	transformStartTime := time.Now()
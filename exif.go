@@ -0,0 +1,463 @@
+package lilliput
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+// EXIFIFD identifies a directory of EXIF tags.
+type EXIFIFD int
+
+const (
+	// EXIFIFD0 describes the main image, e.g. its camera make and model and orientation.
+	EXIFIFD0 EXIFIFD = iota
+	// EXIFIFDExif holds the capture settings and times.
+	EXIFIFDExif
+	// EXIFIFDGPS holds the capture location.
+	EXIFIFDGPS
+	// EXIFIFD1 describes the embedded thumbnail.
+	EXIFIFD1
+
+	numEXIFIFDs
+)
+
+// Tags of the EXIF data which are used by the EXIF accessors
+const (
+	EXIFTagImageWidth         uint16 = 0x0100
+	EXIFTagImageLength        uint16 = 0x0101
+	EXIFTagMake               uint16 = 0x010F
+	EXIFTagModel              uint16 = 0x0110
+	EXIFTagOrientation        uint16 = 0x0112
+	EXIFTagDateTime           uint16 = 0x0132
+	EXIFTagExifIFDPointer     uint16 = 0x8769
+	EXIFTagGPSIFDPointer      uint16 = 0x8825
+	EXIFTagDateTimeOriginal   uint16 = 0x9003
+	EXIFTagOffsetTimeOriginal uint16 = 0x9011
+	EXIFTagSubSecTimeOriginal uint16 = 0x9291
+	EXIFTagPixelXDimension    uint16 = 0xA002
+	EXIFTagPixelYDimension    uint16 = 0xA003
+
+	EXIFTagGPSLatitudeRef  uint16 = 0x0001
+	EXIFTagGPSLatitude     uint16 = 0x0002
+	EXIFTagGPSLongitudeRef uint16 = 0x0003
+	EXIFTagGPSLongitude    uint16 = 0x0004
+)
+
+// Tags which identify the camera or its owner, and which MetadataKeepSafe removes
+const (
+	EXIFTagMakerNote          uint16 = 0x927C
+	EXIFTagCameraOwnerName    uint16 = 0xA430
+	EXIFTagBodySerialNumber   uint16 = 0xA431
+	EXIFTagLensSerialNumber   uint16 = 0xA435
+	EXIFTagCameraSerialNumber uint16 = 0xC62F
+)
+
+// TIFF field types
+const (
+	exifTypeByte      = 1
+	exifTypeASCII     = 2
+	exifTypeShort     = 3
+	exifTypeLong      = 4
+	exifTypeRational  = 5
+	exifTypeSByte     = 6
+	exifTypeUndefined = 7
+	exifTypeSShort    = 8
+	exifTypeSLong     = 9
+	exifTypeSRational = 10
+	exifTypeFloat     = 11
+	exifTypeDouble    = 12
+
+	exifIFDEntryLen = 12
+
+	exifDateTimeLayout = "2006:01:02 15:04:05"
+)
+
+var (
+	// ErrInvalidEXIF is returned when EXIF data is missing or malformed
+	ErrInvalidEXIF = errors.New("invalid EXIF data")
+
+	exifJPEGSignature = []byte("Exif\x00\x00")
+
+	exifTypeSizes = map[uint16]int{
+		exifTypeByte:      1,
+		exifTypeASCII:     1,
+		exifTypeShort:     2,
+		exifTypeLong:      4,
+		exifTypeRational:  8,
+		exifTypeSByte:     1,
+		exifTypeUndefined: 1,
+		exifTypeSShort:    2,
+		exifTypeSLong:     4,
+		exifTypeSRational: 8,
+		exifTypeFloat:     4,
+		exifTypeDouble:    8,
+	}
+)
+
+// An EXIFTag is a single field of EXIF data. Value holds the raw bytes of
+// the field in the byte order of the EXIF data, which its accessors decode.
+type EXIFTag struct {
+	ID    uint16
+	Type  uint16
+	Count int
+	Value []byte
+	order binary.ByteOrder
+}
+
+// Text returns the value of an ASCII tag, without its terminating NULs.
+func (t EXIFTag) Text() (string, bool) {
+	if t.Type != exifTypeASCII {
+		return "", false
+	}
+	return strings.TrimRight(string(t.Value), "\x00 "), true
+}
+
+// Uint returns the i-th value of a BYTE, SHORT or LONG tag.
+func (t EXIFTag) Uint(i int) (uint32, bool) {
+	if i < 0 || i >= t.Count {
+		return 0, false
+	}
+	switch t.Type {
+	case exifTypeByte:
+		return uint32(t.Value[i]), true
+	case exifTypeShort:
+		return uint32(t.order.Uint16(t.Value[2*i:])), true
+	case exifTypeLong:
+		return t.order.Uint32(t.Value[4*i:]), true
+	}
+	return 0, false
+}
+
+// Rational returns the i-th value of a RATIONAL or SRATIONAL tag.
+func (t EXIFTag) Rational(i int) (float64, bool) {
+	if i < 0 || i >= t.Count {
+		return 0, false
+	}
+	var num, den float64
+	switch t.Type {
+	case exifTypeRational:
+		num = float64(t.order.Uint32(t.Value[8*i:]))
+		den = float64(t.order.Uint32(t.Value[8*i+4:]))
+	case exifTypeSRational:
+		num = float64(int32(t.order.Uint32(t.Value[8*i:])))
+		den = float64(int32(t.order.Uint32(t.Value[8*i+4:])))
+	default:
+		return 0, false
+	}
+	if den == 0 {
+		return 0, false
+	}
+	return num / den, true
+}
+
+// EXIF holds the tags of EXIF metadata, as returned by MetadataDecoder.EXIF().
+type EXIF struct {
+	raw     []byte
+	order   binary.ByteOrder
+	ifds    [numEXIFIFDs][]EXIFTag
+	offsets [numEXIFIFDs]uint32
+}
+
+// ParseEXIF parses EXIF data starting with its TIFF header, such as the
+// data returned by MetadataDecoder.EXIF().
+func ParseEXIF(raw []byte) (*EXIF, error) {
+	if len(raw) < 8 {
+		return nil, ErrInvalidEXIF
+	}
+
+	var order binary.ByteOrder
+	switch string(raw[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, ErrInvalidEXIF
+	}
+
+	e := &EXIF{raw: raw, order: order}
+	next, err := e.parseIFD(EXIFIFD0, order.Uint32(raw[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	// the other directories are optional, so damage to them is tolerated
+	if next != 0 {
+		e.parseIFD(EXIFIFD1, next)
+	}
+	if pointer, ok := e.Tag(EXIFIFD0, EXIFTagExifIFDPointer); ok {
+		if offset, ok := pointer.Uint(0); ok {
+			e.parseIFD(EXIFIFDExif, offset)
+		}
+	}
+	if pointer, ok := e.Tag(EXIFIFD0, EXIFTagGPSIFDPointer); ok {
+		if offset, ok := pointer.Uint(0); ok {
+			e.parseIFD(EXIFIFDGPS, offset)
+		}
+	}
+
+	return e, nil
+}
+
+// parseIFD reads the directory ifd at offset, returning the offset of the next directory
+func (e *EXIF) parseIFD(ifd EXIFIFD, offset uint32) (uint32, error) {
+	tags, next, err := parseEXIFIFD(e.raw, e.order, offset)
+	if err != nil {
+		return 0, err
+	}
+	e.ifds[ifd] = tags
+	e.offsets[ifd] = offset
+	return next, nil
+}
+
+// parseEXIFIFD reads the tags of the directory at offset, and the offset of the next directory
+func parseEXIFIFD(raw []byte, order binary.ByteOrder, offset uint32) ([]EXIFTag, uint32, error) {
+	if offset < 8 || uint64(offset)+2 > uint64(len(raw)) {
+		return nil, 0, ErrInvalidEXIF
+	}
+
+	count := int(order.Uint16(raw[offset:]))
+	entries := int(offset) + 2
+	if entries+count*exifIFDEntryLen > len(raw) {
+		return nil, 0, ErrInvalidEXIF
+	}
+
+	tags := make([]EXIFTag, 0, count)
+	for i := 0; i < count; i++ {
+		entry := raw[entries+i*exifIFDEntryLen:]
+		tag := EXIFTag{
+			ID:    order.Uint16(entry),
+			Type:  order.Uint16(entry[2:]),
+			Count: int(order.Uint32(entry[4:])),
+			order: order,
+		}
+
+		size, ok := exifTypeSizes[tag.Type]
+		if !ok || tag.Count < 0 || uint64(tag.Count)*uint64(size) > uint64(len(raw)) {
+			// unknown types are skipped, as their size is unknown too
+			continue
+		}
+
+		length := tag.Count * size
+		if length <= 4 {
+			tag.Value = entry[8 : 8+length]
+		} else {
+			valueOffset := uint64(order.Uint32(entry[8:]))
+			if valueOffset+uint64(length) > uint64(len(raw)) {
+				continue
+			}
+			tag.Value = raw[valueOffset : valueOffset+uint64(length)]
+		}
+		tags = append(tags, tag)
+	}
+
+	var next uint32
+	if end := entries + count*exifIFDEntryLen; end+4 <= len(raw) {
+		next = order.Uint32(raw[end:])
+	}
+	return tags, next, nil
+}
+
+// exifJPEGSegment returns an APP1 segment holding exif, or nil if there is
+// no EXIF data or it is too large to be embedded in a JPEG
+func exifJPEGSegment(exif []byte) []byte {
+	length := 2 + len(exifJPEGSignature) + len(exif)
+	if len(exif) == 0 || length > 0xFFFF {
+		return nil
+	}
+
+	segment := make([]byte, 0, 2+length)
+	segment = append(segment, 0xFF, jpegAPP1SegmentType, byte(length>>8), byte(length))
+	segment = append(segment, exifJPEGSignature...)
+	return append(segment, exif...)
+}
+
+// exifPNGChunk returns an eXIf chunk holding exif, or nil if there is no EXIF data
+func exifPNGChunk(exif []byte) []byte {
+	if len(exif) == 0 {
+		return nil
+	}
+	return appendPNGChunk(nil, pngExifChunkType, exif)
+}
+
+// Raw returns the EXIF data the tags were parsed from.
+func (e *EXIF) Raw() []byte {
+	return e.raw
+}
+
+// Tags returns every tag of the directory ifd, in the order they are stored.
+func (e *EXIF) Tags(ifd EXIFIFD) []EXIFTag {
+	if ifd < 0 || ifd >= numEXIFIFDs {
+		return nil
+	}
+	return e.ifds[ifd]
+}
+
+// Tag returns the tag id of the directory ifd, if present.
+func (e *EXIF) Tag(ifd EXIFIFD, id uint16) (EXIFTag, bool) {
+	for _, tag := range e.Tags(ifd) {
+		if tag.ID == id {
+			return tag, true
+		}
+	}
+	return EXIFTag{}, false
+}
+
+func (e *EXIF) text(ifd EXIFIFD, id uint16) string {
+	tag, ok := e.Tag(ifd, id)
+	if !ok {
+		return ""
+	}
+	text, _ := tag.Text()
+	return text
+}
+
+// Make returns the manufacturer of the camera, or "" if unknown.
+func (e *EXIF) Make() string {
+	return e.text(EXIFIFD0, EXIFTagMake)
+}
+
+// Model returns the model of the camera, or "" if unknown.
+func (e *EXIF) Model() string {
+	return e.text(EXIFIFD0, EXIFTagModel)
+}
+
+// Orientation returns the orientation of the image, defaulting to OrientationTopLeft.
+func (e *EXIF) Orientation() ImageOrientation {
+	tag, ok := e.Tag(EXIFIFD0, EXIFTagOrientation)
+	if !ok {
+		return OrientationTopLeft
+	}
+	orientation, ok := tag.Uint(0)
+	if !ok || orientation < 1 || orientation > 8 {
+		return OrientationTopLeft
+	}
+	return ImageOrientation(orientation)
+}
+
+// CaptureTime returns the time the image was captured, falling back to the
+// time it was last modified. Times without a recorded UTC offset are
+// returned in UTC, as the time zone of the camera is unknown.
+func (e *EXIF) CaptureTime() (time.Time, bool) {
+	value := e.text(EXIFIFDExif, EXIFTagDateTimeOriginal)
+	offset := e.text(EXIFIFDExif, EXIFTagOffsetTimeOriginal)
+	subSec := e.text(EXIFIFDExif, EXIFTagSubSecTimeOriginal)
+	if value == "" {
+		value, offset, subSec = e.text(EXIFIFD0, EXIFTagDateTime), "", ""
+	}
+
+	location := time.UTC
+	if zone, err := time.Parse("-07:00", offset); err == nil {
+		location = zone.Location()
+	}
+	t, err := time.ParseInLocation(exifDateTimeLayout, value, location)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	// the fraction of a second is written as its decimal digits, e.g. "25" for 0.25s
+	if digits := strings.TrimSpace(subSec); digits != "" {
+		if fraction, err := time.ParseDuration("0." + digits + "s"); err == nil {
+			t = t.Add(fraction)
+		}
+	}
+	return t, true
+}
+
+// GPS returns the location where the image was captured, in decimal degrees
+// with south and west negative.
+func (e *EXIF) GPS() (latitude, longitude float64, ok bool) {
+	latitude, ok = e.gpsCoordinate(EXIFTagGPSLatitude, EXIFTagGPSLatitudeRef, "S")
+	if !ok {
+		return 0, 0, false
+	}
+	longitude, ok = e.gpsCoordinate(EXIFTagGPSLongitude, EXIFTagGPSLongitudeRef, "W")
+	if !ok {
+		return 0, 0, false
+	}
+	return latitude, longitude, true
+}
+
+// gpsCoordinate reads a coordinate stored as degrees, minutes and seconds
+func (e *EXIF) gpsCoordinate(id, refID uint16, negativeRef string) (float64, bool) {
+	tag, ok := e.Tag(EXIFIFDGPS, id)
+	if !ok {
+		return 0, false
+	}
+
+	var coordinate float64
+	scale := 1.0
+	for i := 0; i < 3; i++ {
+		v, ok := tag.Rational(i)
+		if !ok {
+			return 0, false
+		}
+		coordinate += v / scale
+		scale *= 60
+	}
+	if math.IsNaN(coordinate) || math.IsInf(coordinate, 0) {
+		return 0, false
+	}
+
+	if e.text(EXIFIFDGPS, refID) == negativeRef {
+		coordinate = -coordinate
+	}
+	return coordinate, true
+}
+
+// Dimensions returns the width and height of the image recorded by the camera.
+// It may differ from the actual size if the image was edited.
+func (e *EXIF) Dimensions() (width, height int, ok bool) {
+	for _, ids := range []struct {
+		ifd           EXIFIFD
+		width, height uint16
+	}{
+		{EXIFIFDExif, EXIFTagPixelXDimension, EXIFTagPixelYDimension},
+		{EXIFIFD0, EXIFTagImageWidth, EXIFTagImageLength},
+	} {
+		widthTag, hasWidth := e.Tag(ids.ifd, ids.width)
+		heightTag, hasHeight := e.Tag(ids.ifd, ids.height)
+		if !hasWidth || !hasHeight {
+			continue
+		}
+		w, wOK := widthTag.Uint(0)
+		h, hOK := heightTag.Uint(0)
+		if wOK && hOK {
+			return int(w), int(h), true
+		}
+	}
+	return 0, 0, false
+}
+
+// jpegEXIF returns the EXIF data of the APP1 segment of a JPEG, if any
+func jpegEXIF(jpeg []byte) []byte {
+	return jpegAPP1Payload(jpeg, exifJPEGSignature)
+}
+
+// pngEXIF returns the data of the eXIf chunk of a PNG, if any
+func pngEXIF(png []byte) []byte {
+	chunkIter, err := makePngChunkIter(png)
+	if err != nil {
+		return nil
+	}
+	for chunkIter.next() {
+		if bytes.Equal(chunkIter.chunkType(), pngExifChunkType) {
+			return chunkIter.chunkData()
+		}
+	}
+	return nil
+}
+
+// webpEXIF returns the data of the EXIF chunk of a WebP, if any
+func webpEXIF(webp []byte) []byte {
+	exif := webpChunkData(webp, "EXIF")
+	if exif == nil {
+		return nil
+	}
+	// some writers keep the signature of the JPEG segment
+	return bytes.TrimPrefix(exif, exifJPEGSignature)
+}
@@ -0,0 +1,219 @@
+package lilliput
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+type testEXIFEntry struct {
+	id       uint16
+	tagType  uint16
+	count    int
+	value    []byte
+	children []testEXIFEntry
+}
+
+func testEXIFASCII(id uint16, s string) testEXIFEntry {
+	return testEXIFEntry{id: id, tagType: exifTypeASCII, count: len(s) + 1, value: append([]byte(s), 0)}
+}
+
+func testEXIFShort(id uint16, v uint16) testEXIFEntry {
+	value := make([]byte, 2)
+	binary.LittleEndian.PutUint16(value, v)
+	return testEXIFEntry{id: id, tagType: exifTypeShort, count: 1, value: value}
+}
+
+func testEXIFRationals(id uint16, values ...uint32) testEXIFEntry {
+	value := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(value[4*i:], v)
+	}
+	return testEXIFEntry{id: id, tagType: exifTypeRational, count: len(values) / 2, value: value}
+}
+
+// makeTestEXIF builds little endian EXIF data with an IFD0 holding entries.
+// Entries with children point to a sub-IFD holding them.
+func makeTestEXIF(entries ...testEXIFEntry) []byte {
+	raw := []byte("II*\x00\x08\x00\x00\x00")
+	raw = appendTestEXIFIFD(raw, entries)
+	return raw
+}
+
+func appendTestEXIFIFD(raw []byte, entries []testEXIFEntry) []byte {
+	start := len(raw)
+	data := start + 2 + len(entries)*exifIFDEntryLen + 4
+	raw = append(raw, make([]byte, data-start)...)
+	binary.LittleEndian.PutUint16(raw[start:], uint16(len(entries)))
+
+	for i, entry := range entries {
+		field := raw[start+2+i*exifIFDEntryLen:]
+		binary.LittleEndian.PutUint16(field, entry.id)
+		if entry.children != nil {
+			binary.LittleEndian.PutUint16(field[2:], exifTypeLong)
+			binary.LittleEndian.PutUint32(field[4:], 1)
+			binary.LittleEndian.PutUint32(field[8:], uint32(len(raw)))
+			raw = appendTestEXIFIFD(raw, entry.children)
+			continue
+		}
+		binary.LittleEndian.PutUint16(field[2:], entry.tagType)
+		binary.LittleEndian.PutUint32(field[4:], uint32(entry.count))
+		if len(entry.value) <= 4 {
+			copy(field[8:], entry.value)
+			continue
+		}
+		binary.LittleEndian.PutUint32(field[8:], uint32(len(raw)))
+		raw = append(raw, entry.value...)
+	}
+	return raw
+}
+
+func TestParseEXIF(t *testing.T) {
+	raw := makeTestEXIF(
+		testEXIFASCII(EXIFTagMake, "Apple"),
+		testEXIFASCII(EXIFTagModel, "iPhone XS"),
+		testEXIFShort(EXIFTagOrientation, 6),
+		testEXIFEntry{id: EXIFTagExifIFDPointer, children: []testEXIFEntry{
+			testEXIFASCII(EXIFTagDateTimeOriginal, "2019:06:27 20:44:45"),
+			testEXIFASCII(EXIFTagOffsetTimeOriginal, "-07:00"),
+			testEXIFASCII(EXIFTagSubSecTimeOriginal, "25"),
+			testEXIFShort(EXIFTagPixelXDimension, 4032),
+			testEXIFShort(EXIFTagPixelYDimension, 3024),
+		}},
+		testEXIFEntry{id: EXIFTagGPSIFDPointer, children: []testEXIFEntry{
+			testEXIFASCII(EXIFTagGPSLatitudeRef, "N"),
+			testEXIFRationals(EXIFTagGPSLatitude, 37, 1, 46, 1, 3000, 100),
+			testEXIFASCII(EXIFTagGPSLongitudeRef, "W"),
+			testEXIFRationals(EXIFTagGPSLongitude, 122, 1, 25, 1, 1200, 100),
+		}},
+	)
+
+	exif, err := ParseEXIF(raw)
+	if err != nil {
+		t.Fatalf("ParseEXIF failed: %v", err)
+	}
+
+	if exif.Make() != "Apple" || exif.Model() != "iPhone XS" {
+		t.Errorf("camera = %q %q, want Apple iPhone XS", exif.Make(), exif.Model())
+	}
+	if exif.Orientation() != OrientationRightTop {
+		t.Errorf("Orientation() = %d, want %d", exif.Orientation(), OrientationRightTop)
+	}
+
+	captured, ok := exif.CaptureTime()
+	want := time.Date(2019, 6, 28, 3, 44, 45, 250000000, time.UTC)
+	if !ok || !captured.Equal(want) {
+		t.Errorf("CaptureTime() = %v, want %v", captured, want)
+	}
+	if _, offset := captured.Zone(); offset != -7*60*60 {
+		t.Errorf("CaptureTime() has UTC offset %ds, want -7h", offset)
+	}
+
+	latitude, longitude, ok := exif.GPS()
+	if !ok || math.Abs(latitude-37.775) > 1e-9 || math.Abs(longitude+122.42) > 1e-9 {
+		t.Errorf("GPS() = %v, %v, %v, want 37.775, -122.42", latitude, longitude, ok)
+	}
+
+	width, height, ok := exif.Dimensions()
+	if !ok || width != 4032 || height != 3024 {
+		t.Errorf("Dimensions() = %dx%d, %v, want 4032x3024", width, height, ok)
+	}
+
+	tag, ok := exif.Tag(EXIFIFDExif, EXIFTagPixelXDimension)
+	if !ok || tag.Type != exifTypeShort || tag.Count != 1 {
+		t.Errorf("Tag() = %+v, %v, want a SHORT PixelXDimension", tag, ok)
+	}
+	if len(exif.Tags(EXIFIFD0)) != 5 || len(exif.Tags(EXIFIFD1)) != 0 {
+		t.Errorf("Expected 5 tags in IFD0 and none in IFD1")
+	}
+	if !bytes.Equal(exif.Raw(), raw) {
+		t.Errorf("Raw() does not return the parsed data")
+	}
+}
+
+func TestParseEXIF_Invalid(t *testing.T) {
+	valid := makeTestEXIF(testEXIFASCII(EXIFTagMake, "Apple"))
+	for _, raw := range [][]byte{
+		nil,
+		[]byte("not EXIF data"),
+		valid[:12],
+		append([]byte("MM\x00*"), valid[4:]...),
+	} {
+		if _, err := ParseEXIF(raw); err != ErrInvalidEXIF {
+			t.Errorf("ParseEXIF(%q) error = %v, want ErrInvalidEXIF", raw, err)
+		}
+	}
+
+	// values pointing outside of the data are skipped
+	raw := makeTestEXIF(testEXIFASCII(EXIFTagMake, "Apple"), testEXIFASCII(EXIFTagModel, "iPhone XS"))
+	exif, err := ParseEXIF(raw[:len(raw)-1])
+	if err != nil {
+		t.Fatalf("ParseEXIF failed: %v", err)
+	}
+	if exif.Make() != "Apple" || exif.Model() != "" {
+		t.Errorf("camera = %q %q, want only the make", exif.Make(), exif.Model())
+	}
+}
+
+func TestEXIF_JPEG(t *testing.T) {
+	testData, err := os.ReadFile("testdata/ferry_sunset.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+
+	decoder, err := NewDecoder(testData)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	defer decoder.Close()
+
+	exif, err := ParseEXIF(decoder.(MetadataDecoder).EXIF())
+	if err != nil {
+		t.Fatalf("ParseEXIF failed: %v", err)
+	}
+	if exif.Make() != "Apple" || exif.Model() != "iPhone XS" {
+		t.Errorf("camera = %q %q, want Apple iPhone XS", exif.Make(), exif.Model())
+	}
+	captured, ok := exif.CaptureTime()
+	if want := time.Date(2019, 6, 27, 20, 44, 45, 0, time.FixedZone("", -7*60*60)); !ok || !captured.Truncate(time.Second).Equal(want) {
+		t.Errorf("CaptureTime() = %v, want %v", captured, want)
+	}
+}
+
+func TestEXIF_Containers(t *testing.T) {
+	raw := makeTestEXIF(testEXIFASCII(EXIFTagMake, "Apple"))
+
+	png := append([]byte{}, pngMagic...)
+	png = appendPNGChunk(png, pngIhdrChunkType, make([]byte, 13))
+	png = appendPNGChunk(png, pngExifChunkType, raw)
+	png = appendPNGChunk(png, pngIendChunkType, nil)
+	if got := pngEXIF(png); !bytes.Equal(got, raw) {
+		t.Errorf("pngEXIF() = %q, want %q", got, raw)
+	}
+
+	// an odd sized chunk ahead of the EXIF chunk is padded
+	webpChunk := func(fourCC string, data []byte) []byte {
+		chunk := append([]byte(fourCC), make([]byte, 4)...)
+		binary.LittleEndian.PutUint32(chunk[4:], uint32(len(data)))
+		chunk = append(chunk, data...)
+		if len(data)%2 == 1 {
+			chunk = append(chunk, 0)
+		}
+		return chunk
+	}
+	body := append([]byte("WEBP"), webpChunk("VP8X", make([]byte, 9))...)
+	body = append(body, webpChunk("EXIF", append(append([]byte{}, exifJPEGSignature...), raw...))...)
+	webp := append([]byte("RIFF"), make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(webp[4:], uint32(len(body)))
+	webp = append(webp, body...)
+	if got := webpEXIF(webp); !bytes.Equal(got, raw) {
+		t.Errorf("webpEXIF() = %q, want %q", got, raw)
+	}
+
+	if pngEXIF(pngMagic) != nil || webpEXIF([]byte("RIFF")) != nil || jpegEXIF([]byte{0xFF, 0xD8}) != nil {
+		t.Errorf("Expected no EXIF in truncated containers")
+	}
+}
@@ -20,6 +20,8 @@ struct giflib_decoder_struct {
     uint8_t bg_alpha;
     bool have_read_first_frame;
     bool seek_clear_extensions;
+    // set from Go to abandon a frame part way through
+    const int* cancel_flag;
 };
 
 // this structure will help save us work of "reversing" a palette
@@ -37,6 +39,10 @@ struct giflib_encoder_struct {
     size_t dst_len;
     ptrdiff_t dst_offset;
 
+    // when growable, output that outgrows the borrowed dst moves to owned_dst
+    bool growable;
+    uint8_t* owned_dst;
+
     // palette lookup is a computational-saving structure to convert
     // (reduced-depth) RGB values into the frame's 256-entry palette
     encoder_palette_lookup* palette_lookup;
@@ -53,6 +59,14 @@ struct giflib_encoder_struct {
 
     bool have_written_first_frame;
 
+    // drop comments and application data other than the loop count,
+    // and separately the XMP packet
+    bool strip_metadata;
+    bool strip_xmp;
+
+    // set from Go to abandon a frame part way through
+    const int* cancel_flag;
+
     // keep track of all of the things we've allocated
     // we could technically just stuff all of these into a vector
     // of void*s but it might be interesting to build a pool
@@ -66,6 +80,11 @@ struct giflib_encoder_struct {
     std::vector<SavedImage*> saved_images;
 };
 
+static bool giflib_is_cancelled(const int* cancel_flag)
+{
+    return cancel_flag && __atomic_load_n(cancel_flag, __ATOMIC_RELAXED);
+}
+
 int decode_func(GifFileType* gif, GifByteType* buf, int len)
 {
     auto d = static_cast<giflib_decoder>(gif->UserData);
@@ -93,6 +112,11 @@ giflib_decoder giflib_decoder_create(const opencv_mat buf)
     return d;
 }
 
+void giflib_decoder_set_cancel_flag(giflib_decoder d, const int* cancel_flag)
+{
+    d->cancel_flag = cancel_flag;
+}
+
 int giflib_decoder_get_width(const giflib_decoder d)
 {
     return d->gif->SWidth;
@@ -548,6 +572,9 @@ bool giflib_decoder_decode_frame(giflib_decoder d, opencv_mat mat)
     if (desc.Interlace) {
         for (int i = 0; i < sizeof(interlace_offset) / sizeof(int); i++) {
             for (int j = interlace_offset[i]; j < desc.Height; j += interlace_jumps[i]) {
+                if (giflib_is_cancelled(d->cancel_flag)) {
+                    return false;
+                }
                 int res = DGifGetLine(d->gif, d->pixels + j * desc.Width, desc.Width);
                 if (res == GIF_ERROR) {
                     fprintf(stderr, "encountered error, could not rasterize gif line\n");
@@ -557,10 +584,16 @@ bool giflib_decoder_decode_frame(giflib_decoder d, opencv_mat mat)
         }
     }
     else {
-        int res = DGifGetLine(d->gif, d->pixels, image_size);
-        if (res == GIF_ERROR) {
-            fprintf(stderr, "encountered error, could not rasterize gif\n");
-            return false;
+        // rasterize row by row so that a cancelled decode stops early
+        for (int j = 0; j < desc.Height; j++) {
+            if (giflib_is_cancelled(d->cancel_flag)) {
+                return false;
+            }
+            int res = DGifGetLine(d->gif, d->pixels + j * desc.Width, desc.Width);
+            if (res == GIF_ERROR) {
+                fprintf(stderr, "encountered error, could not rasterize gif\n");
+                return false;
+            }
         }
     }
 
@@ -624,23 +657,49 @@ SavedImage* giflib_encoder_allocate_saved_images(giflib_encoder e, size_t count)
     return saved_images;
 }
 
+static bool giflib_encoder_grow(giflib_encoder e, size_t needed)
+{
+    size_t grown_len = e->dst_len * 2;
+    if (grown_len < needed) {
+        grown_len = needed;
+    }
+
+    uint8_t* grown = (uint8_t*)(realloc(e->owned_dst, grown_len));
+    if (!grown) {
+        return false;
+    }
+    if (!e->owned_dst) {
+        memcpy(grown, e->dst, e->dst_offset);
+    }
+
+    e->owned_dst = grown;
+    e->dst = grown;
+    e->dst_len = grown_len;
+    return true;
+}
+
 int encode_func(GifFileType* gif, const GifByteType* buf, int len)
 {
     giflib_encoder e = static_cast<giflib_encoder>(gif->UserData);
     if (e->dst_offset + len > e->dst_len) {
-        return 0;
+        if (!e->growable || !giflib_encoder_grow(e, e->dst_offset + len)) {
+            return 0;
+        }
     }
     memcpy(e->dst + e->dst_offset, &buf[0], len);
     e->dst_offset += len;
     return len;
 }
 
-giflib_encoder giflib_encoder_create(void* buf, size_t buf_len)
+giflib_encoder giflib_encoder_create(void* buf, size_t buf_len, bool growable, bool strip_metadata, bool strip_xmp)
 {
     giflib_encoder e = new struct giflib_encoder_struct();
     memset(e, 0, sizeof(struct giflib_encoder_struct));
     e->dst = (uint8_t*)(buf);
     e->dst_len = buf_len;
+    e->growable = growable;
+    e->strip_metadata = strip_metadata;
+    e->strip_xmp = strip_xmp;
 
     int error = 0;
     GifFileType* gif_out = EGifOpen(e, encode_func, &error);
@@ -660,6 +719,11 @@ giflib_encoder giflib_encoder_create(void* buf, size_t buf_len)
     return e;
 }
 
+void giflib_encoder_set_cancel_flag(giflib_encoder e, const int* cancel_flag)
+{
+    e->cancel_flag = cancel_flag;
+}
+
 // this function should be called just once when we know the global dimensions
 bool giflib_encoder_init(giflib_encoder e, const giflib_decoder d, int width, int height)
 {
@@ -698,6 +762,61 @@ bool giflib_encoder_init(giflib_encoder e, const giflib_decoder d, int width, in
     return true;
 }
 
+// extensions needed to display the animation are always kept. comments and
+// application data other than the loop count are metadata, which is kept
+// unless stripped
+static bool giflib_encoder_keeps_extension(giflib_encoder e, const ExtensionBlock* b)
+{
+    switch (b->Function) {
+    case COMMENT_EXT_FUNC_CODE:
+        return !e->strip_metadata;
+    case APPLICATION_EXT_FUNC_CODE:
+        if (b->ByteCount >= 11 &&
+            (memcmp(b->Bytes, "NETSCAPE2.0", 11) == 0 || memcmp(b->Bytes, "ANIMEXTS1.0", 11) == 0)) {
+            return true;
+        }
+        if (b->ByteCount >= 11 && memcmp(b->Bytes, "XMP DataXMP", 11) == 0) {
+            return !e->strip_xmp;
+        }
+        return !e->strip_metadata;
+    default:
+        return true;
+    }
+}
+
+// copy the decoder's pending extension blocks to the encoder, leaving out
+// metadata if it is being stripped. continuation blocks follow the extension
+// they continue in or out
+static void giflib_encoder_copy_extensions(giflib_encoder e, const giflib_decoder d)
+{
+    std::vector<const ExtensionBlock*> kept;
+    bool keeping = true;
+    for (int i = 0; i < d->gif->ExtensionBlockCount; i++) {
+        const ExtensionBlock* b = &(d->gif->ExtensionBlocks[i]);
+        if (b->Function != CONTINUE_EXT_FUNC_CODE) {
+            keeping = giflib_encoder_keeps_extension(e, b);
+        }
+        if (keeping) {
+            kept.push_back(b);
+        }
+    }
+
+    e->gif->ExtensionBlockCount = kept.size();
+    e->gif->ExtensionBlocks = NULL;
+    if (e->gif->ExtensionBlockCount > 0) {
+        e->gif->ExtensionBlocks =
+          giflib_encoder_allocate_extension_blocks(e, e->gif->ExtensionBlockCount);
+        for (int i = 0; i < e->gif->ExtensionBlockCount; i++) {
+            const ExtensionBlock* eb_in = kept[i];
+            ExtensionBlock* eb_out = &(e->gif->ExtensionBlocks[i]);
+            eb_out->ByteCount = eb_in->ByteCount;
+            eb_out->Function = eb_in->Function;
+            eb_out->Bytes = giflib_encoder_allocate_gif_bytes(e, eb_out->ByteCount);
+            memmove(eb_out->Bytes, eb_in->Bytes, eb_out->ByteCount);
+        }
+    }
+}
+
 static bool giflib_encoder_setup_frame(giflib_encoder e, const giflib_decoder d)
 {
     // initialize frame with input gif's frame metadata
@@ -725,23 +844,7 @@ static bool giflib_encoder_setup_frame(giflib_encoder e, const giflib_decoder d)
 
     // copy extension blocks specific to this frame
     // this sets up the frame delay as well as which palette entry is transparent, if any
-    e->gif->ExtensionBlockCount = d->gif->ExtensionBlockCount;
-    e->gif->ExtensionBlocks = NULL;
-    if (e->gif->ExtensionBlockCount > 0) {
-        // TODO here and in global extension blocks, we should filter out worthless blocks
-        // we're only really interested in ExtensionBlock.Function = GRAPHICS_EXT_FUNC_CODE
-        // other values like COMMENT_ and PLAINTEXT_ are not essential to viewing the image
-        e->gif->ExtensionBlocks =
-          giflib_encoder_allocate_extension_blocks(e, e->gif->ExtensionBlockCount);
-        for (int i = 0; i < e->gif->ExtensionBlockCount; i++) {
-            ExtensionBlock* eb_in = &(d->gif->ExtensionBlocks[i]);
-            ExtensionBlock* eb_out = &(e->gif->ExtensionBlocks[i]);
-            eb_out->ByteCount = eb_in->ByteCount;
-            eb_out->Function = eb_in->Function;
-            eb_out->Bytes = giflib_encoder_allocate_gif_bytes(e, eb_out->ByteCount);
-            memmove(eb_out->Bytes, eb_in->Bytes, eb_out->ByteCount);
-        }
-    }
+    giflib_encoder_copy_extensions(e, d);
 
     return true;
 }
@@ -838,6 +941,9 @@ static bool giflib_encoder_render_frame(giflib_encoder e,
 
     int raster_index = 0;
     for (int y = frame_top; y < frame_top + frame_height; y++) {
+        if (giflib_is_cancelled(e->cancel_flag)) {
+            return false;
+        }
         uint8_t* src = frame->data + y * frame->step + (frame_left * 4);
         for (int x = frame_left; x < frame_left + frame_width; x++) {
             uint32_t B = *src++;
@@ -963,7 +1069,9 @@ bool giflib_encoder_encode_frame(giflib_encoder e,
                                  const opencv_mat opaque_frame)
 {
     giflib_encoder_setup_frame(e, d);
-    giflib_encoder_render_frame(e, d, opaque_frame);
+    if (!giflib_encoder_render_frame(e, d, opaque_frame)) {
+        return false;
+    }
 
     GifImageDesc* im_out = &e->gif->Image;
     int frame_height = im_out->Height;
@@ -989,6 +1097,9 @@ bool giflib_encoder_encode_frame(giflib_encoder e,
         /* Need to perform 4 passes on the images: */
         for (int i = 0; i < 4; i++) {
             for (int j = interlace_offset[i]; j < frame_height; j += interlace_jumps[i]) {
+                if (giflib_is_cancelled(e->cancel_flag)) {
+                    return false;
+                }
                 res = EGifPutLine(e->gif, e->pixels + j * frame_width, frame_width);
                 if (res == GIF_ERROR) {
                     fprintf(stderr, "encountered error, could not serialize gif line\n");
@@ -999,6 +1110,9 @@ bool giflib_encoder_encode_frame(giflib_encoder e,
     }
     else {
         for (int i = 0; i < frame_height; i++) {
+            if (giflib_is_cancelled(e->cancel_flag)) {
+                return false;
+            }
             res = EGifPutLine(e->gif, e->pixels + i * frame_width, frame_width);
             if (res == GIF_ERROR) {
                 return false;
@@ -1018,19 +1132,7 @@ bool giflib_encoder_flush(giflib_encoder e, const giflib_decoder d)
 
     // set up "trailing" extension blocks, which appear after all the frames
     // brian note: what do these do? do we actually need them?
-    e->gif->ExtensionBlockCount = d->gif->ExtensionBlockCount;
-    e->gif->ExtensionBlocks = NULL;
-    if (e->gif->ExtensionBlockCount > 0) {
-        e->gif->ExtensionBlocks =
-          giflib_encoder_allocate_extension_blocks(e, e->gif->ExtensionBlockCount);
-        for (int i = 0; i < e->gif->ExtensionBlockCount; i++) {
-            ExtensionBlock* eb = &(e->gif->ExtensionBlocks[i]);
-            eb->ByteCount = d->gif->ExtensionBlocks[i].ByteCount;
-            eb->Function = d->gif->ExtensionBlocks[i].Function;
-            eb->Bytes = giflib_encoder_allocate_gif_bytes(e, eb->ByteCount);
-            memmove(eb->Bytes, d->gif->ExtensionBlocks[i].Bytes, eb->ByteCount);
-        }
-    }
+    giflib_encoder_copy_extensions(e, d);
 
     int res = giflib_encoder_write_extensions(e);
     if (res == GIF_ERROR) {
@@ -1048,7 +1150,10 @@ bool giflib_encoder_flush(giflib_encoder e, const giflib_decoder d)
 
 void giflib_encoder_release(giflib_encoder e)
 {
-    // don't free dst -- we're borrowing it
+    // don't free dst -- we're borrowing it, unless it had to grow
+    if (e->owned_dst) {
+        free(e->owned_dst);
+    }
 
     if (e->prev_frame_bgra) {
         free(e->prev_frame_bgra);
@@ -1130,6 +1235,11 @@ int giflib_encoder_get_output_length(giflib_encoder e)
     return e->dst_offset;
 }
 
+const void* giflib_encoder_get_output(giflib_encoder e)
+{
+    return e->dst;
+}
+
 struct GifAnimationInfo giflib_decoder_get_animation_info(const giflib_decoder d) {
     // Default to 1 loop (play once) if no NETSCAPE2.0 extension is found
     GifAnimationInfo info = {1, 0, 255, 255, 255, 0};  // loop_count, frame_count, bg_r, bg_g, bg_b, bg_a
@@ -96,6 +96,10 @@ func (d *gifDecoder) Close() {
 	d.buf = nil
 }
 
+func (d *gifDecoder) setCancelFlag(flag *C.int) {
+	C.giflib_decoder_set_cancel_flag(d.decoder, flag)
+}
+
 func (d *gifDecoder) Description() string {
 	return "GIF"
 }
@@ -112,6 +116,17 @@ func (d *gifDecoder) ICC() []byte {
 	return []byte{}
 }
 
+func (d *gifDecoder) EXIF() []byte {
+	return []byte{}
+}
+
+func (d *gifDecoder) XMP() []byte {
+	if xmp := gifXMP(d.buf); xmp != nil {
+		return xmp
+	}
+	return []byte{}
+}
+
 func (d *gifDecoder) Duration() time.Duration {
 	return time.Duration(0)
 }
@@ -201,7 +216,9 @@ func (d *gifDecoder) SkipFrame() error {
 	return nil
 }
 
-func newGifEncoder(decodedBy Decoder, buf []byte) (*gifEncoder, error) {
+// newGifEncoder returns a gifEncoder which copies comments, application data
+// and the XMP packet from the source GIF as md allows
+func newGifEncoder(decodedBy Decoder, md encodeMetadata, buf []byte, growable bool) (*gifEncoder, error) {
 	// we must have a decoder since we can't build our own palettes
 	// so if we don't get a gif decoder, bail out
 	if decodedBy == nil {
@@ -214,7 +231,7 @@ func newGifEncoder(decodedBy Decoder, buf []byte) (*gifEncoder, error) {
 	}
 
 	buf = buf[:1]
-	enc := C.giflib_encoder_create(unsafe.Pointer(&buf[0]), C.size_t(cap(buf)))
+	enc := C.giflib_encoder_create(unsafe.Pointer(&buf[0]), C.size_t(cap(buf)), C.bool(growable), C.bool(!md.keepGIFExtensions), C.bool(!md.keepGIFXMP))
 	if enc == nil {
 		return nil, ErrBufTooSmall
 	}
@@ -241,6 +258,11 @@ func (e *gifEncoder) Encode(f *Framebuffer, opt map[int]int) ([]byte, error) {
 
 		len := C.int(C.giflib_encoder_get_output_length(e.encoder))
 
+		output := C.giflib_encoder_get_output(e.encoder)
+		if output != unsafe.Pointer(&e.buf[0]) {
+			// the encoder moved its output once it outgrew buf
+			return C.GoBytes(output, len), nil
+		}
 		return e.buf[:len], nil
 	}
 
@@ -259,6 +281,10 @@ func (e *gifEncoder) Encode(f *Framebuffer, opt map[int]int) ([]byte, error) {
 	return nil, nil
 }
 
+func (e *gifEncoder) setCancelFlag(flag *C.int) {
+	C.giflib_encoder_set_cancel_flag(e.encoder, flag)
+}
+
 func (e *gifEncoder) Close() {
 	C.giflib_encoder_release(e.encoder)
 }
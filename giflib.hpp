@@ -29,6 +29,7 @@ typedef enum {
 } giflib_decoder_frame_state;
 
 giflib_decoder giflib_decoder_create(const opencv_mat buf);
+void giflib_decoder_set_cancel_flag(giflib_decoder d, const int* cancel_flag);
 int giflib_decoder_get_width(const giflib_decoder d);
 int giflib_decoder_get_height(const giflib_decoder d);
 int giflib_decoder_get_num_frames(const giflib_decoder d);
@@ -40,12 +41,14 @@ giflib_decoder_frame_state giflib_decoder_decode_frame_header(giflib_decoder d);
 bool giflib_decoder_decode_frame(giflib_decoder d, opencv_mat mat);
 giflib_decoder_frame_state giflib_decoder_skip_frame(giflib_decoder d);
 
-giflib_encoder giflib_encoder_create(void* buf, size_t buf_len);
+giflib_encoder giflib_encoder_create(void* buf, size_t buf_len, bool growable, bool strip_metadata, bool strip_xmp);
+void giflib_encoder_set_cancel_flag(giflib_encoder e, const int* cancel_flag);
 bool giflib_encoder_init(giflib_encoder e, const giflib_decoder d, int width, int height);
 bool giflib_encoder_encode_frame(giflib_encoder e, const giflib_decoder d, const opencv_mat frame);
 bool giflib_encoder_flush(giflib_encoder e, const giflib_decoder d);
 void giflib_encoder_release(giflib_encoder e);
 int giflib_encoder_get_output_length(giflib_encoder e);
+const void* giflib_encoder_get_output(giflib_encoder e);
 struct GifAnimationInfo giflib_decoder_get_animation_info(const giflib_decoder d);
 int giflib_decoder_get_prev_frame_disposal(const giflib_decoder d);
 #ifdef __cplusplus
@@ -0,0 +1,1029 @@
+package lilliput
+
+// #include "avcodec.hpp"
+import "C"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrHEVCNotEnabled is returned for HEIC images when HEVC decoding has not
+	// been enabled through hevcEnabled
+	ErrHEVCNotEnabled = errors.New("HEVC decoding is not enabled")
+
+	errInvalidHEIF = errors.New("invalid HEIF container")
+
+	heifFtypBoxType = []byte("ftyp")
+
+	// brands which promise HEVC coded images
+	heifBrands = [][]byte{
+		[]byte("heic"),
+		[]byte("heix"),
+		[]byte("heim"),
+		[]byte("heis"),
+		[]byte("hevc"),
+		[]byte("hevx"),
+	}
+
+	heifAlphaAuxTypes = []string{
+		"urn:mpeg:hevc:2015:auxid:1",
+		"urn:mpeg:mpegB:cicp:systems:auxiliary:alpha",
+	}
+
+	annexBStartCode = []byte{0, 0, 0, 1}
+)
+
+const (
+	// ffmpeg reads past the end of its input in bulk, so bitstreams are padded
+	// with AV_INPUT_BUFFER_PADDING_SIZE zero bytes
+	hevcInputPadding = 64
+
+	heifMaxDimension = 16384
+)
+
+// isoBoxIter walks the sibling boxes of an ISOBMFF payload
+type isoBoxIter struct {
+	buf     []byte
+	boxType string
+	payload []byte
+	err     error
+}
+
+func (it *isoBoxIter) next() bool {
+	if it.err != nil || len(it.buf) == 0 {
+		return false
+	}
+
+	if len(it.buf) < 8 {
+		it.err = errInvalidHEIF
+		return false
+	}
+
+	size := uint64(binary.BigEndian.Uint32(it.buf))
+	headerLen := uint64(8)
+	switch size {
+	case 0:
+		// box extends to the end of its container
+		size = uint64(len(it.buf))
+	case 1:
+		if len(it.buf) < 16 {
+			it.err = errInvalidHEIF
+			return false
+		}
+		size = binary.BigEndian.Uint64(it.buf[8:])
+		headerLen = 16
+	}
+
+	if size < headerLen || size > uint64(len(it.buf)) {
+		it.err = errInvalidHEIF
+		return false
+	}
+
+	it.boxType = string(it.buf[4:8])
+	it.payload = it.buf[headerLen:size]
+	it.buf = it.buf[size:]
+	return true
+}
+
+// isoReader reads big endian fields, latching the first out of bounds read
+type isoReader struct {
+	buf []byte
+	off int
+	err error
+}
+
+func (r *isoReader) readUint(n int) uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if n < 0 || n > 8 || r.off+n > len(r.buf) {
+		r.err = errInvalidHEIF
+		return 0
+	}
+
+	var v uint64
+	for _, b := range r.buf[r.off : r.off+n] {
+		v = v<<8 | uint64(b)
+	}
+	r.off += n
+	return v
+}
+
+func (r *isoReader) readBytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.off+n > len(r.buf) {
+		r.err = errInvalidHEIF
+		return nil
+	}
+
+	b := r.buf[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *isoReader) remaining() int {
+	return len(r.buf) - r.off
+}
+
+type heifExtent struct {
+	offset uint64
+	length uint64
+}
+
+type heifProperty struct {
+	boxType string
+	payload []byte
+}
+
+type heifItem struct {
+	id                 uint32
+	itemType           string
+	contentType        string
+	constructionMethod uint64
+	extents            []heifExtent
+	// properties are kept in association order, which is the order
+	// transformative properties are applied in
+	properties []heifProperty
+	dimg       []uint32
+	auxl       []uint32
+	cdsc       []uint32
+}
+
+func (item *heifItem) property(boxType string) []byte {
+	for _, p := range item.properties {
+		if p.boxType == boxType {
+			return p.payload
+		}
+	}
+	return nil
+}
+
+// heifContainer holds the item structure of a HEIF file's meta box
+type heifContainer struct {
+	buf       []byte
+	idat      []byte
+	primaryID uint32
+	items     []*heifItem
+}
+
+func isHEIFBrand(brand []byte) bool {
+	for _, b := range heifBrands {
+		if bytes.Equal(brand, b) {
+			return true
+		}
+	}
+	return false
+}
+
+func isHEIF(maybeHEIF []byte) bool {
+	if len(maybeHEIF) < 16 || !bytes.Equal(maybeHEIF[4:8], heifFtypBoxType) {
+		return false
+	}
+
+	size := int(binary.BigEndian.Uint32(maybeHEIF))
+	if size < 16 || size > len(maybeHEIF) {
+		return false
+	}
+
+	if isHEIFBrand(maybeHEIF[8:12]) {
+		return true
+	}
+
+	// files with a structural major brand such as mif1 list the codec brand
+	// as a compatible brand
+	for off := 16; off+4 <= size; off += 4 {
+		if isHEIFBrand(maybeHEIF[off : off+4]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *heifContainer) item(id uint32) *heifItem {
+	for _, item := range c.items {
+		if item.id == id {
+			return item
+		}
+	}
+	item := &heifItem{id: id}
+	c.items = append(c.items, item)
+	return item
+}
+
+func (c *heifContainer) findItem(id uint32) *heifItem {
+	for _, item := range c.items {
+		if item.id == id {
+			return item
+		}
+	}
+	return nil
+}
+
+func parseHEIF(buf []byte) (*heifContainer, error) {
+	var meta []byte
+	it := isoBoxIter{buf: buf}
+	for it.next() {
+		if it.boxType == "meta" {
+			meta = it.payload
+			break
+		}
+	}
+	if it.err != nil {
+		return nil, it.err
+	}
+	if len(meta) < 4 {
+		return nil, errInvalidHEIF
+	}
+
+	c := &heifContainer{buf: buf}
+	var properties []heifProperty
+	var associations []byte
+	hasPrimary := false
+
+	it = isoBoxIter{buf: meta[4:]}
+	for it.next() {
+		var err error
+		switch it.boxType {
+		case "hdlr":
+			if len(it.payload) < 12 || string(it.payload[8:12]) != "pict" {
+				return nil, errInvalidHEIF
+			}
+		case "pitm":
+			r := isoReader{buf: it.payload}
+			version := r.readUint(1)
+			r.readUint(3)
+			if version == 0 {
+				c.primaryID = uint32(r.readUint(2))
+			} else {
+				c.primaryID = uint32(r.readUint(4))
+			}
+			err = r.err
+			hasPrimary = true
+		case "iinf":
+			err = c.parseItemInfo(it.payload)
+		case "iloc":
+			err = c.parseItemLocations(it.payload)
+		case "iref":
+			err = c.parseItemReferences(it.payload)
+		case "iprp":
+			properties, associations, err = parseItemProperties(it.payload)
+		case "idat":
+			c.idat = it.payload
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if it.err != nil {
+		return nil, it.err
+	}
+
+	if !hasPrimary {
+		return nil, errInvalidHEIF
+	}
+
+	if err := c.associateProperties(properties, associations); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *heifContainer) parseItemInfo(payload []byte) error {
+	r := isoReader{buf: payload}
+	version := r.readUint(1)
+	r.readUint(3)
+	if version == 0 {
+		r.readUint(2)
+	} else {
+		r.readUint(4)
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	it := isoBoxIter{buf: payload[r.off:]}
+	for it.next() {
+		if it.boxType != "infe" {
+			continue
+		}
+
+		infe := isoReader{buf: it.payload}
+		infeVersion := infe.readUint(1)
+		infe.readUint(3)
+		if infeVersion < 2 {
+			// older entries predate typed items and cannot hold images
+			continue
+		}
+
+		var id uint32
+		if infeVersion == 2 {
+			id = uint32(infe.readUint(2))
+		} else {
+			id = uint32(infe.readUint(4))
+		}
+		infe.readUint(2)
+		itemType := infe.readBytes(4)
+		if infe.err != nil {
+			return infe.err
+		}
+		item := c.item(id)
+		item.itemType = string(itemType)
+
+		// mime items name their content type after the item name
+		if item.itemType == "mime" {
+			fields := bytes.SplitN(it.payload[infe.off:], []byte{0}, 3)
+			if len(fields) >= 2 {
+				item.contentType = string(fields[1])
+			}
+		}
+	}
+	return it.err
+}
+
+func (c *heifContainer) parseItemLocations(payload []byte) error {
+	r := isoReader{buf: payload}
+	version := r.readUint(1)
+	r.readUint(3)
+	sizes := r.readUint(2)
+	offsetSize := int(sizes >> 12 & 0xF)
+	lengthSize := int(sizes >> 8 & 0xF)
+	baseOffsetSize := int(sizes >> 4 & 0xF)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xF)
+	}
+
+	var itemCount uint64
+	if version < 2 {
+		itemCount = r.readUint(2)
+	} else {
+		itemCount = r.readUint(4)
+	}
+
+	for i := uint64(0); i < itemCount && r.err == nil; i++ {
+		var id uint32
+		if version < 2 {
+			id = uint32(r.readUint(2))
+		} else {
+			id = uint32(r.readUint(4))
+		}
+
+		item := c.item(id)
+		if version == 1 || version == 2 {
+			item.constructionMethod = r.readUint(2) & 0xF
+		}
+		r.readUint(2)
+		baseOffset := r.readUint(baseOffsetSize)
+		extentCount := r.readUint(2)
+		item.extents = item.extents[:0]
+		for j := uint64(0); j < extentCount && r.err == nil; j++ {
+			r.readUint(indexSize)
+			offset := r.readUint(offsetSize)
+			length := r.readUint(lengthSize)
+			item.extents = append(item.extents, heifExtent{offset: baseOffset + offset, length: length})
+		}
+	}
+	return r.err
+}
+
+func (c *heifContainer) parseItemReferences(payload []byte) error {
+	r := isoReader{buf: payload}
+	version := r.readUint(1)
+	r.readUint(3)
+	if r.err != nil {
+		return r.err
+	}
+
+	idSize := 2
+	if version != 0 {
+		idSize = 4
+	}
+
+	it := isoBoxIter{buf: payload[r.off:]}
+	for it.next() {
+		ref := isoReader{buf: it.payload}
+		from := c.item(uint32(ref.readUint(idSize)))
+		count := ref.readUint(2)
+		to := make([]uint32, 0, count)
+		for i := uint64(0); i < count && ref.err == nil; i++ {
+			to = append(to, uint32(ref.readUint(idSize)))
+		}
+		if ref.err != nil {
+			return ref.err
+		}
+
+		switch it.boxType {
+		case "dimg":
+			from.dimg = to
+		case "auxl":
+			from.auxl = to
+		case "cdsc":
+			from.cdsc = to
+		}
+	}
+	return it.err
+}
+
+func parseItemProperties(payload []byte) ([]heifProperty, []byte, error) {
+	var properties []heifProperty
+	var associations []byte
+
+	it := isoBoxIter{buf: payload}
+	for it.next() {
+		switch it.boxType {
+		case "ipco":
+			props := isoBoxIter{buf: it.payload}
+			for props.next() {
+				properties = append(properties, heifProperty{boxType: props.boxType, payload: props.payload})
+			}
+			if props.err != nil {
+				return nil, nil, props.err
+			}
+		case "ipma":
+			associations = it.payload
+		}
+	}
+	return properties, associations, it.err
+}
+
+func (c *heifContainer) associateProperties(properties []heifProperty, associations []byte) error {
+	r := isoReader{buf: associations}
+	version := r.readUint(1)
+	flags := r.readUint(3)
+	entryCount := r.readUint(4)
+
+	for i := uint64(0); i < entryCount && r.err == nil; i++ {
+		var id uint32
+		if version < 1 {
+			id = uint32(r.readUint(2))
+		} else {
+			id = uint32(r.readUint(4))
+		}
+
+		item := c.item(id)
+		associationCount := r.readUint(1)
+		for j := uint64(0); j < associationCount && r.err == nil; j++ {
+			// the top bit flags the property as essential
+			var index int
+			if flags&1 != 0 {
+				index = int(r.readUint(2) & 0x7FFF)
+			} else {
+				index = int(r.readUint(1) & 0x7F)
+			}
+
+			// index 0 means no property, the rest are 1-based
+			if index == 0 {
+				continue
+			}
+			if index > len(properties) {
+				return errInvalidHEIF
+			}
+			item.properties = append(item.properties, properties[index-1])
+		}
+	}
+	return r.err
+}
+
+// itemData returns the concatenated extents of item
+func (c *heifContainer) itemData(item *heifItem) ([]byte, error) {
+	var src []byte
+	switch item.constructionMethod {
+	case 0:
+		src = c.buf
+	case 1:
+		src = c.idat
+	default:
+		return nil, errInvalidHEIF
+	}
+
+	var data []byte
+	for _, extent := range item.extents {
+		end := extent.offset + extent.length
+		if extent.length == 0 {
+			end = uint64(len(src))
+		}
+		if extent.offset > end || end > uint64(len(src)) {
+			return nil, errInvalidHEIF
+		}
+
+		if len(item.extents) == 1 {
+			return src[extent.offset:end], nil
+		}
+		data = append(data, src[extent.offset:end]...)
+	}
+
+	if len(data) == 0 {
+		return nil, errInvalidHEIF
+	}
+	return data, nil
+}
+
+type heifGrid struct {
+	rows    int
+	columns int
+	width   int
+	height  int
+}
+
+func (c *heifContainer) grid(item *heifItem) (heifGrid, error) {
+	data, err := c.itemData(item)
+	if err != nil {
+		return heifGrid{}, err
+	}
+
+	r := isoReader{buf: data}
+	r.readUint(1)
+	flags := r.readUint(1)
+	fieldSize := 2
+	if flags&1 != 0 {
+		fieldSize = 4
+	}
+
+	grid := heifGrid{
+		rows:    int(r.readUint(1)) + 1,
+		columns: int(r.readUint(1)) + 1,
+		width:   int(r.readUint(fieldSize)),
+		height:  int(r.readUint(fieldSize)),
+	}
+	if r.err != nil {
+		return heifGrid{}, r.err
+	}
+
+	if len(item.dimg) != grid.rows*grid.columns {
+		return heifGrid{}, errInvalidHEIF
+	}
+	return grid, nil
+}
+
+// itemSize returns the dimensions of an item before any transformative
+// properties are applied
+func (c *heifContainer) itemSize(item *heifItem) (int, int, error) {
+	width, height := 0, 0
+	if ispe := item.property("ispe"); len(ispe) >= 12 {
+		width = int(binary.BigEndian.Uint32(ispe[4:]))
+		height = int(binary.BigEndian.Uint32(ispe[8:]))
+	} else if item.itemType == "grid" {
+		grid, err := c.grid(item)
+		if err != nil {
+			return 0, 0, err
+		}
+		width, height = grid.width, grid.height
+	}
+
+	if width <= 0 || height <= 0 || width > heifMaxDimension || height > heifMaxDimension {
+		return 0, 0, errInvalidHEIF
+	}
+	return width, height, nil
+}
+
+// hevcBitstream converts an hvc1 item into an Annex B bitstream, prefixed
+// with the parameter sets from its decoder configuration
+func (c *heifContainer) hevcBitstream(item *heifItem) ([]byte, error) {
+	hvcc := item.property("hvcC")
+	if len(hvcc) < 23 {
+		return nil, errInvalidHEIF
+	}
+	lengthSize := int(hvcc[21]&3) + 1
+
+	data, err := c.itemData(item)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(hvcc)+len(data)+hevcInputPadding)
+
+	config := isoReader{buf: hvcc, off: 23}
+	numArrays := int(hvcc[22])
+	for i := 0; i < numArrays; i++ {
+		config.readUint(1)
+		numNalus := int(config.readUint(2))
+		for j := 0; j < numNalus; j++ {
+			nalu := config.readBytes(int(config.readUint(2)))
+			out = append(out, annexBStartCode...)
+			out = append(out, nalu...)
+		}
+	}
+	if config.err != nil {
+		return nil, config.err
+	}
+
+	r := isoReader{buf: data}
+	for r.remaining() > 0 {
+		nalu := r.readBytes(int(r.readUint(lengthSize)))
+		if r.err != nil {
+			return nil, r.err
+		}
+		out = append(out, annexBStartCode...)
+		out = append(out, nalu...)
+	}
+
+	n := len(out)
+	out = append(out, make([]byte, hevcInputPadding)...)
+	return out[:n], nil
+}
+
+// isDecodable reports whether item is an HEVC image or a grid of them
+func (c *heifContainer) isDecodable(item *heifItem) bool {
+	switch item.itemType {
+	case "hvc1":
+		return true
+	case "grid":
+		for _, id := range item.dimg {
+			tile := c.findItem(id)
+			if tile == nil || tile.itemType != "hvc1" {
+				return false
+			}
+		}
+		return len(item.dimg) > 0
+	}
+	return false
+}
+
+// alphaItem finds the auxiliary alpha plane of the primary item, if any
+func (c *heifContainer) alphaItem() *heifItem {
+	for _, item := range c.items {
+		isAuxOfPrimary := false
+		for _, id := range item.auxl {
+			isAuxOfPrimary = isAuxOfPrimary || id == c.primaryID
+		}
+		if !isAuxOfPrimary {
+			continue
+		}
+
+		auxC := item.property("auxC")
+		if len(auxC) < 4 {
+			continue
+		}
+		auxType := string(auxC[4:])
+		if idx := bytes.IndexByte(auxC[4:], 0); idx >= 0 {
+			auxType = string(auxC[4 : 4+idx])
+		}
+		for _, alphaType := range heifAlphaAuxTypes {
+			if auxType == alphaType {
+				return item
+			}
+		}
+	}
+	return nil
+}
+
+var heifOrientations = map[[4]int]ImageOrientation{
+	{1, 0, 0, 1}:   OrientationTopLeft,
+	{-1, 0, 0, 1}:  OrientationTopRight,
+	{-1, 0, 0, -1}: OrientationBottomRight,
+	{1, 0, 0, -1}:  OrientationBottomLeft,
+	{0, 1, 1, 0}:   OrientationLeftTop,
+	{0, -1, 1, 0}:  OrientationRightTop,
+	{0, -1, -1, 0}: OrientationRightBottom,
+	{0, 1, -1, 0}:  OrientationLeftBottom,
+}
+
+// heifOrientation folds the irot and imir properties of item, in the order
+// they are associated, into the equivalent EXIF orientation. Transforms are
+// tracked as 2x2 matrices over (x, y) with y pointing down.
+func heifOrientation(item *heifItem) ImageOrientation {
+	mul := func(a, b [4]int) [4]int {
+		return [4]int{
+			a[0]*b[0] + a[1]*b[2], a[0]*b[1] + a[1]*b[3],
+			a[2]*b[0] + a[3]*b[2], a[2]*b[1] + a[3]*b[3],
+		}
+	}
+
+	m := [4]int{1, 0, 0, 1}
+	for _, p := range item.properties {
+		if len(p.payload) < 1 {
+			continue
+		}
+		switch p.boxType {
+		case "irot":
+			// anti-clockwise in steps of 90 degrees
+			for i := 0; i < int(p.payload[0]&3); i++ {
+				m = mul([4]int{0, 1, -1, 0}, m)
+			}
+		case "imir":
+			if p.payload[0]&1 == 0 {
+				// mirror about the vertical axis
+				m = mul([4]int{-1, 0, 0, 1}, m)
+			} else {
+				m = mul([4]int{1, 0, 0, -1}, m)
+			}
+		}
+	}
+	return heifOrientations[m]
+}
+
+// heifICC returns the ICC profile from the colr property of item, if any
+func heifICC(item *heifItem) []byte {
+	for _, p := range item.properties {
+		if p.boxType != "colr" || len(p.payload) < 4 {
+			continue
+		}
+		colourType := string(p.payload[:4])
+		if colourType == "prof" || colourType == "rICC" {
+			return p.payload[4:]
+		}
+	}
+	return []byte{}
+}
+
+// exif returns the EXIF metadata describing item, starting with its TIFF header, if any
+func (c *heifContainer) exif(item *heifItem) []byte {
+	for _, candidate := range c.items {
+		if candidate.itemType != "Exif" || !containsItemID(candidate.cdsc, item.id) {
+			continue
+		}
+		data, err := c.itemData(candidate)
+		if err != nil || len(data) < 4 {
+			continue
+		}
+		// the data is prefixed with the offset of the TIFF header
+		offset := uint64(binary.BigEndian.Uint32(data)) + 4
+		if offset >= uint64(len(data)) {
+			continue
+		}
+		return data[offset:]
+	}
+	return nil
+}
+
+// xmp returns the XMP packet describing item, if any
+func (c *heifContainer) xmp(item *heifItem) []byte {
+	for _, candidate := range c.items {
+		if candidate.itemType != "mime" || candidate.contentType != "application/rdf+xml" || !containsItemID(candidate.cdsc, item.id) {
+			continue
+		}
+		data, err := c.itemData(candidate)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		return data
+	}
+	return nil
+}
+
+func containsItemID(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+type heifDecoder struct {
+	container   *heifContainer
+	primary     *heifItem
+	alpha       *heifItem
+	width       int
+	height      int
+	orientation ImageOrientation
+	buf         []byte
+	hasDecoded  bool
+}
+
+func newHEIFDecoder(buf []byte) (*heifDecoder, error) {
+	if hevcEnabled != "true" {
+		return nil, ErrHEVCNotEnabled
+	}
+
+	container, err := parseHEIF(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	primary := container.findItem(container.primaryID)
+	if primary == nil || !container.isDecodable(primary) {
+		return nil, ErrInvalidImage
+	}
+
+	width, height, err := container.itemSize(primary)
+	if err != nil {
+		return nil, err
+	}
+
+	alpha := container.alphaItem()
+	if alpha != nil && !container.isDecodable(alpha) {
+		alpha = nil
+	}
+
+	return &heifDecoder{
+		container:   container,
+		primary:     primary,
+		alpha:       alpha,
+		width:       width,
+		height:      height,
+		orientation: heifOrientation(primary),
+		buf:         buf,
+	}, nil
+}
+
+func (d *heifDecoder) Description() string {
+	return "HEIC"
+}
+
+func (d *heifDecoder) HasSubtitles() bool {
+	return false
+}
+
+func (d *heifDecoder) IsStreamable() bool {
+	return true
+}
+
+func (d *heifDecoder) BackgroundColor() uint32 {
+	return 0xFFFFFFFF
+}
+
+func (d *heifDecoder) LoopCount() int {
+	return 0
+}
+
+func (d *heifDecoder) ICC() []byte {
+	return heifICC(d.primary)
+}
+
+func (d *heifDecoder) EXIF() []byte {
+	if exif := d.container.exif(d.primary); exif != nil {
+		return exif
+	}
+	return []byte{}
+}
+
+func (d *heifDecoder) XMP() []byte {
+	if xmp := d.container.xmp(d.primary); xmp != nil {
+		return xmp
+	}
+	return []byte{}
+}
+
+func (d *heifDecoder) Duration() time.Duration {
+	return time.Duration(0)
+}
+
+func (d *heifDecoder) Header() (*ImageHeader, error) {
+	pixelType := PixelType(C.CV_8UC3)
+	if d.alpha != nil {
+		pixelType = PixelType(C.CV_8UC4)
+	}
+
+	return &ImageHeader{
+		width:         d.width,
+		height:        d.height,
+		pixelType:     pixelType,
+		orientation:   d.orientation,
+		numFrames:     1,
+		contentLength: len(d.buf),
+	}, nil
+}
+
+// decodeHEVCItem decodes an hvc1 item into a new BGRA mat owned by the caller
+func (d *heifDecoder) decodeHEVCItem(item *heifItem) (C.opencv_mat, error) {
+	width, height, err := d.container.itemSize(item)
+	if err != nil {
+		return nil, err
+	}
+
+	bitstream, err := d.container.hevcBitstream(item)
+	if err != nil {
+		return nil, err
+	}
+
+	src := createMatFromBytes(bitstream)
+	if src == nil {
+		return nil, ErrBufTooSmall
+	}
+	defer C.opencv_mat_release(src)
+
+	mat := C.opencv_mat_create(C.int(width), C.int(height), C.CV_8UC4)
+	if !C.avcodec_hevc_image_decode(src, mat) {
+		C.opencv_mat_release(mat)
+		return nil, ErrDecodingFailed
+	}
+	return mat, nil
+}
+
+// decodeItem decodes item into dst, which must be sized to the item's dimensions
+func (d *heifDecoder) decodeItem(item *heifItem, dst C.opencv_mat) error {
+	width, height, err := d.container.itemSize(item)
+	if err != nil {
+		return err
+	}
+
+	if item.itemType == "hvc1" {
+		mat, err := d.decodeHEVCItem(item)
+		if err != nil {
+			return err
+		}
+		defer C.opencv_mat_release(mat)
+		return handleOpenCVError(C.opencv_copy_to_region(mat, dst, 0, 0, C.int(width), C.int(height)))
+	}
+
+	grid, err := d.container.grid(item)
+	if err != nil {
+		return err
+	}
+
+	// tiles share a size and are laid out in row-major order, with the
+	// right and bottom edges cropped to the grid's output size. a grid
+	// whose tiles don't cover its output size would leave part of dst
+	// uninitialized, so reject it
+	tileWidth, tileHeight, err := d.container.itemSize(d.container.findItem(item.dimg[0]))
+	if err != nil {
+		return err
+	}
+	if grid.columns*tileWidth < width || grid.rows*tileHeight < height {
+		return errInvalidHEIF
+	}
+
+	for i, id := range item.dimg {
+		tile := d.container.findItem(id)
+		w, h, err := d.container.itemSize(tile)
+		if err != nil {
+			return err
+		}
+		if w != tileWidth || h != tileHeight {
+			return errInvalidHEIF
+		}
+
+		x := (i % grid.columns) * tileWidth
+		y := (i / grid.columns) * tileHeight
+		cropWidth := min(tileWidth, width-x)
+		cropHeight := min(tileHeight, height-y)
+		if cropWidth <= 0 || cropHeight <= 0 {
+			continue
+		}
+
+		mat, err := d.decodeHEVCItem(tile)
+		if err != nil {
+			return err
+		}
+		cropped := C.opencv_mat_crop(mat, 0, 0, C.int(cropWidth), C.int(cropHeight))
+		err = handleOpenCVError(C.opencv_copy_to_region(cropped, dst, C.int(x), C.int(y), C.int(cropWidth), C.int(cropHeight)))
+		C.opencv_mat_release(cropped)
+		C.opencv_mat_release(mat)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *heifDecoder) DecodeTo(f *Framebuffer) error {
+	if d.hasDecoded {
+		return io.EOF
+	}
+
+	h, err := d.Header()
+	if err != nil {
+		return err
+	}
+
+	err = f.resizeMat(h.Width(), h.Height(), h.PixelType())
+	if err != nil {
+		return err
+	}
+
+	if err = d.decodeItem(d.primary, f.mat); err != nil {
+		return err
+	}
+
+	if d.alpha != nil {
+		width, height, err := d.container.itemSize(d.alpha)
+		if err != nil {
+			return err
+		}
+
+		alpha := C.opencv_mat_create(C.int(width), C.int(height), C.CV_8UC4)
+		defer C.opencv_mat_release(alpha)
+		if err = d.decodeItem(d.alpha, alpha); err != nil {
+			return err
+		}
+		if err = handleOpenCVError(C.opencv_mat_set_alpha(f.mat, alpha)); err != nil {
+			return err
+		}
+	}
+
+	f.blend = NoBlend
+	f.dispose = DisposeToBackgroundColor
+	f.duration = time.Duration(0)
+	f.xOffset = 0
+	f.yOffset = 0
+	d.hasDecoded = true
+	return nil
+}
+
+func (d *heifDecoder) SkipFrame() error {
+	return ErrSkipNotSupported
+}
+
+func (d *heifDecoder) Close() {
+	d.container = nil
+	d.buf = nil
+}
@@ -0,0 +1,325 @@
+package lilliput
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func makeTestBox(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	box := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(box, uint32(8+len(body)))
+	copy(box[4:], boxType)
+	return append(box, body...)
+}
+
+func makeTestFullBox(boxType string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return makeTestBox(boxType, append([][]byte{header}, payload...)...)
+}
+
+func be16(v int) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func be32(v int) []byte {
+	return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+var testHEIFICC = []byte("not really an ICC profile")
+
+// a TIFF header followed by an empty IFD0
+var testHEIFEXIF = []byte("MM\x00*\x00\x00\x00\x08\x00\x00")
+
+var testHEIFXMP = []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"/>`)
+
+// makeTestHEIF builds a HEIC container with a 100x64 primary grid of two
+// 64x64 tiles, rotated and mirrored, an alpha plane, EXIF metadata and XMP. The HEVC payloads
+// are placeholders, so only the container structure can be inspected; the
+// fixtures in testdata hold real HEVC.
+func makeTestHEIF(t *testing.T) []byte {
+	// VPS in the decoder configuration, with 4 byte NAL lengths
+	hvcC := make([]byte, 22)
+	hvcC[21] = 0x03
+	hvcC = append(hvcC, 1, 0x20)
+	hvcC = append(hvcC, be16(1)...)
+	hvcC = append(hvcC, be16(2)...)
+	hvcC = append(hvcC, 0x40, 0x01)
+
+	grid := []byte{0, 0, 0, 1}
+	grid = append(grid, be16(100)...)
+	grid = append(grid, be16(64)...)
+	tile := append(be32(3), 0x26, 0x01, 0xAF)
+
+	// the TIFF header follows the offset to it, here past two padding bytes
+	exif := append(append(be32(2), 0, 0), testHEIFEXIF...)
+
+	// every item is stored in idat: grid, tile, tile, alpha, EXIF, XMP
+	idat := bytes.Join([][]byte{grid, tile, tile, tile, exif, testHEIFXMP}, nil)
+	extents := []struct{ id, offset, length int }{
+		{1, 0, len(grid)},
+		{2, len(grid), len(tile)},
+		{3, len(grid) + len(tile), len(tile)},
+		{4, len(grid) + 2*len(tile), len(tile)},
+		{5, len(grid) + 3*len(tile), len(exif)},
+		{6, len(grid) + 3*len(tile) + len(exif), len(testHEIFXMP)},
+	}
+	iloc := [][]byte{{0x44, 0x00}, be16(len(extents))}
+	for _, e := range extents {
+		iloc = append(iloc, be16(e.id), be16(1), be16(0), be16(1), be32(e.offset), be32(e.length))
+	}
+
+	infe := func(id int, itemType string) []byte {
+		return makeTestFullBox("infe", 2, 0, be16(id), be16(0), []byte(itemType), []byte{0})
+	}
+
+	ispe := func(width, height int) []byte {
+		return makeTestFullBox("ispe", 0, 0, be32(width), be32(height))
+	}
+
+	ipco := makeTestBox("ipco",
+		makeTestBox("hvcC", hvcC), // 1
+		ispe(64, 64),              // 2
+		ispe(100, 64),             // 3
+		makeTestBox("colr", []byte("prof"), testHEIFICC),                        // 4
+		makeTestBox("irot", []byte{1}),                                          // 5
+		makeTestBox("imir", []byte{0}),                                          // 6
+		makeTestFullBox("auxC", 0, 0, []byte("urn:mpeg:hevc:2015:auxid:1\x00")), // 7
+	)
+	ipma := makeTestFullBox("ipma", 0, 0, be32(4),
+		be16(1), []byte{4, 3, 0x84, 5, 6},
+		be16(2), []byte{2, 0x81, 2},
+		be16(3), []byte{2, 0x81, 2},
+		be16(4), []byte{3, 0x81, 3, 7},
+	)
+
+	meta := makeTestFullBox("meta", 0, 0,
+		makeTestFullBox("hdlr", 0, 0, be32(0), []byte("pict"), make([]byte, 13)),
+		makeTestFullBox("pitm", 0, 0, be16(1)),
+		makeTestFullBox("iinf", 0, 0, be16(6), infe(1, "grid"), infe(2, "hvc1"), infe(3, "hvc1"), infe(4, "hvc1"), infe(5, "Exif"),
+			makeTestFullBox("infe", 2, 0, be16(6), be16(0), []byte("mime"), []byte("\x00application/rdf+xml\x00"))),
+		makeTestFullBox("iloc", 1, 0, iloc...),
+		makeTestFullBox("iref", 0, 0,
+			makeTestBox("dimg", be16(1), be16(2), be16(2), be16(3)),
+			makeTestBox("auxl", be16(4), be16(1), be16(1)),
+			makeTestBox("cdsc", be16(5), be16(1), be16(1)),
+			makeTestBox("cdsc", be16(6), be16(1), be16(1)),
+		),
+		makeTestBox("iprp", ipco, ipma),
+		makeTestBox("idat", idat),
+	)
+
+	ftyp := makeTestBox("ftyp", []byte("mif1"), be32(0), []byte("mif1heic"))
+	return append(ftyp, meta...)
+}
+
+func TestIsHEIF(t *testing.T) {
+	if !isHEIF(makeTestHEIF(t)) {
+		t.Errorf("Expected mif1 file with a heic compatible brand to be HEIF")
+	}
+	if !isHEIF(makeTestBox("ftyp", []byte("heic"), be32(0))) {
+		t.Errorf("Expected heic major brand to be HEIF")
+	}
+	if isHEIF(makeTestBox("ftyp", []byte("avif"), be32(0), []byte("mif1avif"))) {
+		t.Errorf("Expected AVIF not to be HEIF")
+	}
+}
+
+func TestHEIFDecoder_RequiresHEVC(t *testing.T) {
+	defer func(enabled string) { hevcEnabled = enabled }(hevcEnabled)
+	hevcEnabled = ""
+
+	if _, err := NewDecoder(makeTestHEIF(t)); err != ErrHEVCNotEnabled {
+		t.Errorf("NewDecoder() error = %v, want ErrHEVCNotEnabled", err)
+	}
+}
+
+func TestHEIFDecoder(t *testing.T) {
+	defer func(enabled string) { hevcEnabled = enabled }(hevcEnabled)
+	hevcEnabled = "true"
+
+	decoder, err := NewDecoder(makeTestHEIF(t))
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	defer decoder.Close()
+
+	heif, ok := decoder.(*heifDecoder)
+	if !ok {
+		t.Fatalf("Expected a HEIF decoder, got %T", decoder)
+	}
+
+	header, err := decoder.Header()
+	if err != nil {
+		t.Fatalf("Header failed: %v", err)
+	}
+	if header.Width() != 100 || header.Height() != 64 {
+		t.Errorf("Header() size = %dx%d, want 100x64", header.Width(), header.Height())
+	}
+	if header.PixelType().Channels() != 4 {
+		t.Errorf("Header() channels = %d, want 4 for an image with alpha", header.PixelType().Channels())
+	}
+	// a quarter turn anti-clockwise followed by a horizontal mirror
+	if header.Orientation() != OrientationRightBottom {
+		t.Errorf("Header() orientation = %d, want %d", header.Orientation(), OrientationRightBottom)
+	}
+	if !bytes.Equal(decoder.ICC(), testHEIFICC) {
+		t.Errorf("ICC() = %q, want %q", decoder.ICC(), testHEIFICC)
+	}
+	if !bytes.Equal(decoder.(MetadataDecoder).EXIF(), testHEIFEXIF) {
+		t.Errorf("EXIF() = %q, want %q", decoder.(MetadataDecoder).EXIF(), testHEIFEXIF)
+	}
+	if !bytes.Equal(decoder.(MetadataDecoder).XMP(), testHEIFXMP) {
+		t.Errorf("XMP() = %q, want %q", decoder.(MetadataDecoder).XMP(), testHEIFXMP)
+	}
+	if heif.alpha == nil || heif.alpha.id != 4 {
+		t.Errorf("Expected item 4 to be the alpha plane")
+	}
+
+	grid, err := heif.container.grid(heif.primary)
+	if err != nil {
+		t.Fatalf("grid failed: %v", err)
+	}
+	if grid != (heifGrid{rows: 1, columns: 2, width: 100, height: 64}) {
+		t.Errorf("grid = %+v, want 1x2 tiles of a 100x64 image", grid)
+	}
+
+	bitstream, err := heif.container.hevcBitstream(heif.container.findItem(2))
+	if err != nil {
+		t.Fatalf("hevcBitstream failed: %v", err)
+	}
+	want := []byte{0, 0, 0, 1, 0x40, 0x01, 0, 0, 0, 1, 0x26, 0x01, 0xAF}
+	if !bytes.Equal(bitstream, want) {
+		t.Errorf("hevcBitstream() = %x, want %x", bitstream, want)
+	}
+}
+
+func TestHEIFOrientation(t *testing.T) {
+	tests := []struct {
+		properties []heifProperty
+		want       ImageOrientation
+	}{
+		{nil, OrientationTopLeft},
+		{[]heifProperty{{"irot", []byte{1}}}, OrientationLeftBottom},
+		{[]heifProperty{{"irot", []byte{2}}}, OrientationBottomRight},
+		{[]heifProperty{{"irot", []byte{3}}}, OrientationRightTop},
+		{[]heifProperty{{"imir", []byte{0}}}, OrientationTopRight},
+		{[]heifProperty{{"imir", []byte{1}}}, OrientationBottomLeft},
+		{[]heifProperty{{"irot", []byte{3}}, {"imir", []byte{0}}}, OrientationLeftTop},
+	}
+	for _, tt := range tests {
+		if got := heifOrientation(&heifItem{properties: tt.properties}); got != tt.want {
+			t.Errorf("heifOrientation(%v) = %d, want %d", tt.properties, got, tt.want)
+		}
+	}
+}
+
+func TestHEIFDecoder_UncoveredGrid(t *testing.T) {
+	defer func(enabled string) { hevcEnabled = enabled }(hevcEnabled)
+	hevcEnabled = "true"
+
+	// widen the grid past the two 64x64 tiles that make it up
+	ispe := append([]byte("ispe\x00\x00\x00\x00"), be32(100)...)
+	buf := bytes.Replace(makeTestHEIF(t), ispe, append([]byte("ispe\x00\x00\x00\x00"), be32(200)...), 1)
+
+	decoder, err := NewDecoder(buf)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	defer decoder.Close()
+
+	fb := NewFramebuffer(200, 64)
+	defer fb.Close()
+	if err := decoder.DecodeTo(fb); err != errInvalidHEIF {
+		t.Errorf("DecodeTo() error = %v, want errInvalidHEIF", err)
+	}
+}
+
+// decodeTestHEIF decodes a HEIF fixture from testdata, checking its size
+func decodeTestHEIF(t *testing.T, path string, width, height int) (*ImageHeader, *Framebuffer) {
+	defer func(enabled string) { hevcEnabled = enabled }(hevcEnabled)
+	hevcEnabled = "true"
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+
+	decoder, err := NewDecoder(buf)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	defer decoder.Close()
+
+	header, err := decoder.Header()
+	if err != nil {
+		t.Fatalf("Header failed: %v", err)
+	}
+	if header.Width() != width || header.Height() != height {
+		t.Fatalf("Header() size = %dx%d, want %dx%d", header.Width(), header.Height(), width, height)
+	}
+
+	fb := NewFramebuffer(width, height)
+	if err := decoder.DecodeTo(fb); err != nil {
+		fb.Close()
+		t.Fatalf("DecodeTo failed: %v", err)
+	}
+	if fb.Width() != width || fb.Height() != height {
+		fb.Close()
+		t.Fatalf("DecodeTo() size = %dx%d, want %dx%d", fb.Width(), fb.Height(), width, height)
+	}
+	return header, fb
+}
+
+// checkTestPixel compares the pixel at x, y against want, allowing for the
+// loss of the HEVC encode
+func checkTestPixel(t *testing.T, fb *Framebuffer, x, y int, want []byte) {
+	channels := fb.PixelType().Channels()
+	offset := (y*fb.Width() + x) * channels
+	got := fb.buf[offset : offset+channels]
+	for i := range want {
+		if diff := int(got[i]) - int(want[i]); diff < -16 || diff > 16 {
+			t.Errorf("pixel (%d, %d) = %v, want %v", x, y, got, want)
+			return
+		}
+	}
+}
+
+func TestHEIFDecoder_Quadrants(t *testing.T) {
+	header, fb := decodeTestHEIF(t, "testdata/quadrants.heic", 64, 64)
+	defer fb.Close()
+
+	if header.PixelType().Channels() != 3 {
+		t.Errorf("Header() channels = %d, want 3 for an image without alpha", header.PixelType().Channels())
+	}
+	if header.Orientation() != OrientationTopLeft {
+		t.Errorf("Header() orientation = %d, want %d", header.Orientation(), OrientationTopLeft)
+	}
+
+	// red, green, blue and white quadrants, in BGR
+	checkTestPixel(t, fb, 16, 16, []byte{0, 0, 255})
+	checkTestPixel(t, fb, 48, 16, []byte{0, 255, 0})
+	checkTestPixel(t, fb, 16, 48, []byte{255, 0, 0})
+	checkTestPixel(t, fb, 48, 48, []byte{255, 255, 255})
+}
+
+func TestHEIFDecoder_GridWithAlpha(t *testing.T) {
+	// a 100x64 grid of a red and a blue 64x64 tile, the blue one cropped,
+	// with an alpha plane that is opaque only in its top half
+	header, fb := decodeTestHEIF(t, "testdata/grid-alpha.heic", 100, 64)
+	defer fb.Close()
+
+	if header.PixelType().Channels() != 4 {
+		t.Errorf("Header() channels = %d, want 4 for an image with alpha", header.PixelType().Channels())
+	}
+	if header.Orientation() != OrientationLeftBottom {
+		t.Errorf("Header() orientation = %d, want %d", header.Orientation(), OrientationLeftBottom)
+	}
+
+	checkTestPixel(t, fb, 16, 16, []byte{0, 0, 255, 255})
+	checkTestPixel(t, fb, 80, 16, []byte{255, 0, 0, 255})
+	checkTestPixel(t, fb, 16, 48, []byte{0, 0, 255, 0})
+	checkTestPixel(t, fb, 80, 48, []byte{255, 0, 0, 0})
+}
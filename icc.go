@@ -0,0 +1,315 @@
+package lilliput
+
+// #include "opencv.hpp"
+import "C"
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"math"
+)
+
+const (
+	iccHeaderSize   = 128
+	iccTagEntrySize = 12
+
+	// a JPEG APP2 segment carries a chunk of the profile after its length
+	// field, the ICC_PROFILE signature and the chunk's sequence number and count
+	iccJPEGChunkHeaderLen = 2 + 12 + 2
+	iccJPEGMaxChunkLen    = 0xFFFF - iccJPEGChunkHeaderLen
+	iccJPEGMaxChunks      = 255
+)
+
+var iccJPEGSignature = []byte("ICC_PROFILE\x00")
+
+// srgbD50 holds the sRGB primaries adapted to the D50 white point of the
+// ICC profile connection space, one column per primary
+var srgbD50 = [9]float64{
+	0.4360747, 0.3850649, 0.1430804,
+	0.2225045, 0.7168786, 0.0606169,
+	0.0139322, 0.0971045, 0.7141733,
+}
+
+// A colorTransform converts pixels described by an RGB matrix/TRC ICC
+// profile to sRGB.
+type colorTransform struct {
+	// decode maps the 8 bit red, green and blue values to linear light
+	decode [3 * 256]C.float
+
+	// matrix maps linear RGB to linear sRGB, row major
+	matrix [9]C.float
+}
+
+// newColorTransform returns the transform from the color space described by
+// icc to sRGB. It returns nil when icc is not an RGB matrix/TRC profile, or
+// when it already describes sRGB.
+func newColorTransform(icc []byte) *colorTransform {
+	primaries, curves, ok := parseICCProfile(icc)
+	if !ok {
+		return nil
+	}
+
+	toSRGB, ok := invert3x3(srgbD50)
+	if !ok {
+		return nil
+	}
+	matrix := multiply3x3(toSRGB, primaries)
+
+	if isSRGB(matrix, curves) {
+		return nil
+	}
+
+	t := &colorTransform{}
+	for c := 0; c < 3; c++ {
+		for i := 0; i < 256; i++ {
+			t.decode[c*256+i] = C.float(curves[c][i])
+		}
+	}
+	for i, v := range matrix {
+		t.matrix[i] = C.float(v)
+	}
+	return t
+}
+
+// isSRGB reports whether the transform given by matrix and curves leaves
+// every 8 bit sRGB value as it is
+func isSRGB(matrix [9]float64, curves [3][256]float64) bool {
+	for i, v := range matrix {
+		identity := 0.0
+		if i%4 == 0 {
+			identity = 1
+		}
+		if math.Abs(v-identity) > 0.002 {
+			return false
+		}
+	}
+	for c := range curves {
+		for i, v := range curves[c] {
+			if math.Abs(linearToSRGB(v)*255-float64(i)) > 0.5 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// parseICCProfile reads the primaries, one column per primary, and the tone
+// curves of an RGB matrix/TRC profile. The curves are sampled at every 8 bit value.
+func parseICCProfile(icc []byte) (primaries [9]float64, curves [3][256]float64, ok bool) {
+	if len(icc) < iccHeaderSize+4 {
+		return primaries, curves, false
+	}
+	if string(icc[16:20]) != "RGB " || string(icc[20:24]) != "XYZ " {
+		return primaries, curves, false
+	}
+
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(icc[iccHeaderSize:]))
+	for i := 0; i < count; i++ {
+		entry := iccHeaderSize + 4 + i*iccTagEntrySize
+		if entry+iccTagEntrySize > len(icc) {
+			return primaries, curves, false
+		}
+		offset := int(binary.BigEndian.Uint32(icc[entry+4:]))
+		size := int(binary.BigEndian.Uint32(icc[entry+8:]))
+		if offset < 0 || size < 0 || offset > len(icc) || size > len(icc)-offset {
+			return primaries, curves, false
+		}
+		tags[string(icc[entry:entry+4])] = icc[offset : offset+size]
+	}
+
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz, ok := parseICCXYZ(tags[sig])
+		if !ok {
+			return primaries, curves, false
+		}
+		primaries[i] = xyz[0]
+		primaries[3+i] = xyz[1]
+		primaries[6+i] = xyz[2]
+	}
+
+	for i, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, ok := parseICCCurve(tags[sig])
+		if !ok {
+			return primaries, curves, false
+		}
+		for v := 0; v < 256; v++ {
+			curves[i][v] = math.Min(math.Max(curve(float64(v)/255), 0), 1)
+		}
+	}
+
+	return primaries, curves, true
+}
+
+// iccJPEGSegments splits icc into APP2 ICC_PROFILE segments. It returns nil
+// if there is no profile, or if it is too large to be embedded in a JPEG.
+func iccJPEGSegments(icc []byte) []byte {
+	if len(icc) == 0 {
+		return nil
+	}
+
+	count := (len(icc) + iccJPEGMaxChunkLen - 1) / iccJPEGMaxChunkLen
+	if count > iccJPEGMaxChunks {
+		return nil
+	}
+
+	segments := make([]byte, 0, len(icc)+count*(2+iccJPEGChunkHeaderLen))
+	for i := 0; i < count; i++ {
+		chunk := icc[i*iccJPEGMaxChunkLen:]
+		if len(chunk) > iccJPEGMaxChunkLen {
+			chunk = chunk[:iccJPEGMaxChunkLen]
+		}
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(iccJPEGChunkHeaderLen+len(chunk)))
+		segments = append(segments, 0xFF, jpegAPP2SegmentType)
+		segments = append(segments, length[:]...)
+		segments = append(segments, iccJPEGSignature...)
+		segments = append(segments, byte(i+1), byte(count))
+		segments = append(segments, chunk...)
+	}
+	return segments
+}
+
+// iccPNGChunk returns an iCCP chunk holding icc, or nil if there is no profile
+func iccPNGChunk(icc []byte) []byte {
+	if len(icc) == 0 {
+		return nil
+	}
+
+	var data bytes.Buffer
+	// the profile name, followed by the zlib compression method
+	data.WriteString("ICC profile\x00\x00")
+	w := zlib.NewWriter(&data)
+	w.Write(icc)
+	w.Close()
+	return appendPNGChunk(nil, pngIccpChunkType, data.Bytes())
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func parseICCXYZ(tag []byte) ([3]float64, bool) {
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return [3]float64{}, false
+	}
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, true
+}
+
+// parseICCCurve returns the function of a curv or para tag
+func parseICCCurve(tag []byte) (func(float64) float64, bool) {
+	if len(tag) < 12 {
+		return nil, false
+	}
+
+	switch string(tag[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case count == 0:
+			return func(x float64) float64 { return x }, true
+		case count == 1:
+			if len(tag) < 14 {
+				return nil, false
+			}
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, true
+		case count > (len(tag)-12)/2:
+			return nil, false
+		}
+		table := make([]float64, count)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(count-1)
+			i := int(pos)
+			if i >= count-1 {
+				return table[count-1]
+			}
+			frac := pos - float64(i)
+			return table[i]*(1-frac) + table[i+1]*frac
+		}, true
+	case "para":
+		funcType := int(binary.BigEndian.Uint16(tag[8:]))
+		paramCounts := []int{1, 3, 4, 5, 7}
+		if funcType >= len(paramCounts) || len(tag) < 12+4*paramCounts[funcType] {
+			return nil, false
+		}
+		var p [7]float64
+		for i := 0; i < paramCounts[funcType]; i++ {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		curve := func(x float64) float64 { return math.Pow(math.Max(a*x+b, 0), g) }
+		switch funcType {
+		case 0:
+			return func(x float64) float64 { return math.Pow(x, g) }, true
+		case 1:
+			return curve, true
+		case 2:
+			return func(x float64) float64 { return curve(x) + c }, true
+		case 3:
+			return func(x float64) float64 {
+				if x < d {
+					return c * x
+				}
+				return curve(x)
+			}, true
+		default:
+			return func(x float64) float64 {
+				if x < d {
+					return c*x + f
+				}
+				return curve(x) + e
+			}, true
+		}
+	}
+	return nil, false
+}
+
+func multiply3x3(a, b [9]float64) [9]float64 {
+	var m [9]float64
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			for k := 0; k < 3; k++ {
+				m[row*3+col] += a[row*3+k] * b[k*3+col]
+			}
+		}
+	}
+	return m
+}
+
+func invert3x3(m [9]float64) ([9]float64, bool) {
+	det := m[0]*(m[4]*m[8]-m[5]*m[7]) - m[1]*(m[3]*m[8]-m[5]*m[6]) + m[2]*(m[3]*m[7]-m[4]*m[6])
+	if det == 0 {
+		return [9]float64{}, false
+	}
+	return [9]float64{
+		(m[4]*m[8] - m[5]*m[7]) / det,
+		(m[2]*m[7] - m[1]*m[8]) / det,
+		(m[1]*m[5] - m[2]*m[4]) / det,
+		(m[5]*m[6] - m[3]*m[8]) / det,
+		(m[0]*m[8] - m[2]*m[6]) / det,
+		(m[2]*m[3] - m[0]*m[5]) / det,
+		(m[3]*m[7] - m[4]*m[6]) / det,
+		(m[1]*m[6] - m[0]*m[7]) / det,
+		(m[0]*m[4] - m[1]*m[3]) / det,
+	}, true
+}
+
+// transformToSRGB converts the pixels of f to sRGB with t. Alpha is kept.
+func (f *Framebuffer) transformToSRGB(t *colorTransform) {
+	if f.mat == nil {
+		return
+	}
+	C.opencv_mat_transform_to_srgb(f.mat, &t.decode[0], &t.matrix[0])
+}
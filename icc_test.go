@@ -0,0 +1,123 @@
+package lilliput
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestNewColorTransform(t *testing.T) {
+	srgb, err := os.ReadFile("icc_profiles/srgb_profile.icc")
+	if err != nil {
+		t.Fatalf("Failed to read profile: %v", err)
+	}
+	if newColorTransform(srgb) != nil {
+		t.Errorf("Expected no transform for an sRGB profile")
+	}
+
+	rec2020, err := os.ReadFile("icc_profiles/rec2020_profile.icc")
+	if err != nil {
+		t.Fatalf("Failed to read profile: %v", err)
+	}
+	transform := newColorTransform(rec2020)
+	if transform == nil {
+		t.Fatalf("Expected a transform for a Rec. 2020 profile")
+	}
+	// the well known conversion of linear Rec. 2020 to Rec. 709, which shares its primaries with sRGB
+	want := []float64{1.6605, -0.5876, -0.0728, -0.1246, 1.1329, -0.0083, -0.0182, -0.1006, 1.1187}
+	for i, v := range want {
+		if math.Abs(float64(transform.matrix[i])-v) > 0.005 {
+			t.Errorf("matrix[%d] = %v, want %v", i, transform.matrix[i], v)
+		}
+	}
+
+	for _, icc := range [][]byte{nil, []byte("not a profile"), rec2020[:200]} {
+		if newColorTransform(icc) != nil {
+			t.Errorf("Expected no transform for an invalid profile")
+		}
+	}
+}
+
+func TestParseICCCurve(t *testing.T) {
+	tests := []struct {
+		name string
+		tag  []byte
+		x    float64
+		want float64
+	}{
+		{name: "identity", tag: []byte("curv\x00\x00\x00\x00\x00\x00\x00\x00"), x: 0.25, want: 0.25},
+		{name: "gamma", tag: []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x02\x00"), x: 0.5, want: 0.25},
+		{name: "table", tag: []byte("curv\x00\x00\x00\x00\x00\x00\x00\x03\x00\x00\x40\x00\xff\xff"), x: 0.25, want: 0.125},
+		{name: "parametric gamma", tag: []byte("para\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x00"), x: 0.5, want: 0.25},
+		{name: "parametric linear segment", tag: []byte("para\x00\x00\x00\x00\x00\x03\x00\x00\x00\x02\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x80\x00\x00\x00\x40\x00"), x: 0.1, want: 0.05},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			curve, ok := parseICCCurve(tc.tag)
+			if !ok {
+				t.Fatalf("parseICCCurve failed")
+			}
+			if got := curve(tc.x); math.Abs(got-tc.want) > 0.001 {
+				t.Errorf("curve(%v) = %v, want %v", tc.x, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTransformToSRGB(t *testing.T) {
+	rec2020, err := os.ReadFile("icc_profiles/rec2020_profile.icc")
+	if err != nil {
+		t.Fatalf("Failed to read profile: %v", err)
+	}
+	transform := newColorTransform(rec2020)
+	if transform == nil {
+		t.Fatalf("Expected a transform for a Rec. 2020 profile")
+	}
+
+	// BGRA pixels: gray, a half transparent muted red
+	f := NewFramebuffer(2, 1)
+	defer f.Close()
+	if err := f.Create4Channel(2, 1); err != nil {
+		t.Fatalf("Create4Channel failed: %v", err)
+	}
+	copy(f.buf, []byte{128, 128, 128, 255, 100, 100, 200, 128})
+
+	f.transformToSRGB(transform)
+
+	// both profiles share the D65 white point, so grays stay neutral, though
+	// their tone curves differ
+	if f.buf[0] != f.buf[1] || f.buf[1] != f.buf[2] || f.buf[3] != 255 {
+		t.Errorf("Expected gray to stay neutral, got %v", f.buf[:4])
+	}
+	// the wider gamut red becomes more saturated in sRGB
+	if f.buf[6] <= 200 || f.buf[5] >= 100 || f.buf[7] != 128 {
+		t.Errorf("Expected a more saturated red with its alpha kept, got %v", f.buf[4:8])
+	}
+}
+
+func TestICCJPEGSegments(t *testing.T) {
+	icc := make([]byte, iccJPEGMaxChunkLen+10)
+	segments := iccJPEGSegments(icc)
+	if want := len(icc) + 2*(2+iccJPEGChunkHeaderLen); len(segments) != want {
+		t.Fatalf("Expected %d bytes of segments, got %d", want, len(segments))
+	}
+
+	second := 2 + iccJPEGChunkHeaderLen + iccJPEGMaxChunkLen
+	for i, pos := range []int{0, second} {
+		if segments[pos] != 0xFF || segments[pos+1] != jpegAPP2SegmentType {
+			t.Errorf("segment %d does not start with an APP2 marker", i)
+		}
+		if !bytes.Equal(segments[pos+4:pos+16], iccJPEGSignature) {
+			t.Errorf("segment %d is missing the ICC_PROFILE signature", i)
+		}
+		if segments[pos+16] != byte(i+1) || segments[pos+17] != 2 {
+			t.Errorf("segment %d is numbered %d of %d", i, segments[pos+16], segments[pos+17])
+		}
+	}
+
+	if iccJPEGSegments(make([]byte, iccJPEGMaxChunks*iccJPEGMaxChunkLen+1)) != nil {
+		t.Errorf("Expected a profile too large for a JPEG to be left out")
+	}
+}
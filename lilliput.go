@@ -5,6 +5,8 @@ package lilliput
 import (
 	"bytes"
 	"errors"
+	"io"
+	"io/ioutil"
 	"strings"
 	"time"
 )
@@ -16,6 +18,7 @@ var (
 	ErrFrameBufNoPixels = errors.New("Framebuffer contains no pixels")
 	ErrSkipNotSupported = errors.New("skip operation not supported by this decoder")
 	ErrEncodeTimeout    = errors.New("encode timed out")
+	ErrInvalidCrop      = errors.New("crop rectangle does not overlap the image")
 
 	gif87Magic   = []byte("GIF87a")
 	gif89Magic   = []byte("GIF89a")
@@ -69,6 +72,18 @@ type Decoder interface {
 	LoopCount() int
 }
 
+// A MetadataDecoder reads the EXIF and XMP metadata of an image. Every Decoder
+// returned by NewDecoder implements it, so the metadata can be read with a type
+// assertion, e.g. d.(lilliput.MetadataDecoder).EXIF().
+type MetadataDecoder interface {
+	// EXIF returns the EXIF metadata, starting with its TIFF header, if any.
+	// It can be read with ParseEXIF.
+	EXIF() []byte
+
+	// XMP returns the XMP packet, if any
+	XMP() []byte
+}
+
 // An Encoder compresses raw pixel data into a well-known image type.
 type Encoder interface {
 	// Encode encodes the pixel data in f into the dst provided to NewEncoder. Encode quality
@@ -118,6 +133,17 @@ func NewDecoder(buf []byte) (Decoder, error) {
 		return newWebpDecoder(buf)
 	}
 
+	if detectAPNG(buf) {
+		// malformed animations fall back to decoding just the default image
+		if apngDecoder, err := newAPNGDecoder(buf); err == nil {
+			return apngDecoder, nil
+		}
+	}
+
+	if isHEIF(buf) {
+		return newHEIFDecoder(buf)
+	}
+
 	maybeDecoder, err := newOpenCVDecoder(buf)
 	if err == nil {
 		return maybeDecoder, nil
@@ -126,26 +152,79 @@ func NewDecoder(buf []byte) (Decoder, error) {
 	return newAVCodecDecoder(buf)
 }
 
+// NewDecoderFromReader returns a Decoder which reads the content of r from its
+// start. Video and audio are streamed from r as they are decoded, so r must
+// stay usable until the Decoder is closed. Images, including GIFs, WebPs and
+// those decoded by OpenCV, are not decoded incrementally, so they are read
+// fully into memory and decoded as with NewDecoder.
+func NewDecoderFromReader(r io.ReadSeeker) (Decoder, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	probe := make([]byte, probeBytesLimit)
+	n, err := io.ReadFull(r, probe)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return nil, ErrInvalidImage
+		}
+		return nil, err
+	}
+	probe = probe[:n]
+
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	isImage := isGIF(probe) || isWebp(probe) || isHEIF(probe) || isOpenCVImage(probe)
+	if !isImage {
+		return newAVCodecDecoderFromReader(r, probe)
+	}
+
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return NewDecoder(buf)
+}
+
 // NewEncoder returns an Encode which can be used to encode Framebuffer
 // into compressed image data. ext should be a string like ".jpeg" or
 // ".png". decodedBy is optional and can be the Decoder used to make
 // the Framebuffer. dst is where an encoded image will be written.
 func NewEncoder(ext string, decodedBy Decoder, dst []byte) (Encoder, error) {
+	return newEncoder(ext, decodedBy, decodedMetadata(decodedBy), dst, false)
+}
+
+// NewGrowableEncoder returns an Encoder like NewEncoder, except that output
+// which does not fit in dst is returned in a newly allocated buffer instead
+// of failing with ErrBufTooSmall.
+func NewGrowableEncoder(ext string, decodedBy Decoder, dst []byte) (Encoder, error) {
+	return newEncoder(ext, decodedBy, decodedMetadata(decodedBy), dst, true)
+}
+
+// newEncoder returns an Encoder for ext. md is the metadata describing the
+// pixels to be encoded, which formats able to carry it embed.
+func newEncoder(ext string, decodedBy Decoder, md encodeMetadata, dst []byte, growable bool) (Encoder, error) {
 	if strings.ToLower(ext) == ".gif" {
-		return newGifEncoder(decodedBy, dst)
+		return newGifEncoder(decodedBy, md, dst, growable)
 	}
 
 	if strings.ToLower(ext) == ".webp" {
-		return newWebpEncoder(decodedBy, dst)
+		return newWebpEncoderWithMetadata(decodedBy, md, dst, growable)
 	}
 
 	if strings.ToLower(ext) == ".mp4" || strings.ToLower(ext) == ".webm" {
 		return nil, errors.New("Encoder cannot encode into video types")
 	}
 
+	if strings.ToLower(ext) == ".png" && isAnimatedDecoder(decodedBy) {
+		return newAPNGEncoder(decodedBy, md, dst, growable)
+	}
+
 	if strings.ToLower(ext) == ".thumbhash" {
 		return newThumbhashEncoder(decodedBy, dst)
 	}
 
-	return newOpenCVEncoder(ext, decodedBy, dst)
+	return newOpenCVEncoderWithMetadata(ext, decodedBy, md, dst, growable)
 }
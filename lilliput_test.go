@@ -4,6 +4,7 @@ package lilliput
 
 import (
 	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -114,6 +115,9 @@ func TestNewDecoder(t *testing.T) {
 			if tt.wantAnimated && !header.IsAnimated() {
 				t.Errorf("Expected image to be animated")
 			}
+			if _, ok := dec.(MetadataDecoder); !ok {
+				t.Errorf("Expected %T to be a MetadataDecoder", dec)
+			}
 		})
 	}
 }
@@ -140,3 +144,61 @@ func BenchmarkNewDecoder(b *testing.B) {
 		}
 	}
 }
+
+func TestNewDecoderFromReader(t *testing.T) {
+	tests := []struct {
+		name            string
+		sourceFilePath  string
+		wantDescription string
+		wantWidth       int
+		wantHeight      int
+	}{
+		{"Streamed MP4", "testdata/big_buck_bunny_480p_10s_web.mp4", "MP4", 853, 480},
+		{"Streamed WAV", "testdata/tos-intro-3s.wav", "WAV", 0, 0},
+		{"Buffered JPEG", "testdata/ferry_sunset.jpg", "JPEG", 800, 297},
+		{"Buffered WebP", "testdata/tears_of_steel_icc.webp", "WEBP", 1920, 800},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Open(tt.sourceFilePath)
+			if err != nil {
+				t.Fatalf("Failed to open source file: %v", err)
+			}
+			defer f.Close()
+
+			dec, err := NewDecoderFromReader(f)
+			if err != nil {
+				t.Fatalf("NewDecoderFromReader() error = %v", err)
+			}
+			defer dec.Close()
+
+			if dec.Description() != tt.wantDescription {
+				t.Errorf("Expected description to be %v, got %v", tt.wantDescription, dec.Description())
+			}
+			header, err := dec.Header()
+			if err != nil {
+				t.Fatalf("Failed to get header: %v", err)
+			}
+			if header.Width() != tt.wantWidth || header.Height() != tt.wantHeight {
+				t.Errorf("Expected size %vx%v, got %vx%v", tt.wantWidth, tt.wantHeight, header.Width(), header.Height())
+			}
+
+			info, err := f.Stat()
+			if err != nil {
+				t.Fatalf("Failed to stat source file: %v", err)
+			}
+			if header.ContentLength() > int(info.Size()) {
+				t.Errorf("Expected content length to be at most %v, got %v", info.Size(), header.ContentLength())
+			}
+
+			if tt.wantWidth == 0 {
+				return
+			}
+			framebuffer := NewFramebuffer(tt.wantWidth, tt.wantHeight)
+			defer framebuffer.Close()
+			if err = dec.DecodeTo(framebuffer); err != nil {
+				t.Errorf("DecodeTo() error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package lilliput
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// MetadataPolicy controls which metadata of the source image is kept in
+// the output of ImageOps. The ICC profile is color information rather than
+// metadata, and is controlled by ImageOptions.StripICCProfile instead.
+type MetadataPolicy int
+
+const (
+	// MetadataDefault leaves EXIF metadata and XMP packets out of the output,
+	// but keeps the comments, XMP and other application data of GIFs, as
+	// lilliput always has.
+	MetadataDefault MetadataPolicy = iota
+
+	// MetadataStrip leaves EXIF metadata, XMP packets and GIF comments and
+	// application data out of the output.
+	MetadataStrip
+
+	// MetadataKeep keeps EXIF metadata, XMP packets and GIF comments.
+	MetadataKeep
+
+	// MetadataKeepSafe keeps metadata except the location the image was
+	// captured at and the serial numbers and owner of the camera. XMP
+	// packets holding any of these are left out entirely.
+	MetadataKeepSafe
+)
+
+// stripsEXIFAndXMP reports whether p leaves EXIF metadata and XMP packets out
+func (p MetadataPolicy) stripsEXIFAndXMP() bool {
+	return p == MetadataDefault || p == MetadataStrip
+}
+
+// IHDR is always the first chunk of a PNG and always has 13 bytes of data
+const pngIhdrEnd = 8 + pngChunkAllFieldsLen + 13
+
+// encodeMetadata is the metadata which an Encoder embeds in its output
+type encodeMetadata struct {
+	icc  []byte
+	exif []byte
+	xmp  []byte
+
+	// keepGIFExtensions copies comment and application extensions from the
+	// source GIF, and keepGIFXMP its XMP application extension
+	keepGIFExtensions bool
+	keepGIFXMP        bool
+}
+
+// decodedMetadata returns the metadata embedded by Encoders created with
+// NewEncoder: the ICC profile of the image decoded by d, and GIF extensions
+// including XMP
+func decodedMetadata(d Decoder) encodeMetadata {
+	return encodeMetadata{
+		icc:               decodedICC(d),
+		keepGIFExtensions: true,
+		keepGIFXMP:        true,
+	}
+}
+
+// decodedICC returns the ICC profile of the image decoded by d, if any
+func decodedICC(d Decoder) []byte {
+	if d == nil {
+		return nil
+	}
+	return d.ICC()
+}
+
+// decodedEXIF returns the EXIF metadata of the image decoded by d, if d is a
+// MetadataDecoder
+func decodedEXIF(d Decoder) []byte {
+	if md, ok := d.(MetadataDecoder); ok {
+		return md.EXIF()
+	}
+	return nil
+}
+
+// decodedXMP returns the XMP packet of the image decoded by d, if d is a
+// MetadataDecoder
+func decodedXMP(d Decoder) []byte {
+	if md, ok := d.(MetadataDecoder); ok {
+		return md.XMP()
+	}
+	return nil
+}
+
+// embedMetadata inserts md into the JPEG or PNG image in out, ahead of its
+// image data. The image is grown within the capacity of out, or reallocated
+// if growable; otherwise metadata which does not fit fails with
+// ErrBufTooSmall. Other formats are left unchanged.
+func embedMetadata(out []byte, ext string, md encodeMetadata, growable bool) ([]byte, error) {
+	var pos int
+	var embedded []byte
+	switch ext {
+	case ".jpg", ".jpeg":
+		if len(out) < 4 || out[0] != 0xFF || out[1] != 0xD8 {
+			return out, nil
+		}
+		// keep the JFIF segment first, as it is required to be
+		pos = 2
+		if out[2] == 0xFF && out[3] == jpegAPP0SegmentType && len(out) >= 6 {
+			pos = 4 + int(binary.BigEndian.Uint16(out[4:]))
+		}
+		embedded = append(exifJPEGSegment(md.exif), xmpJPEGSegment(md.xmp)...)
+		embedded = append(embedded, iccJPEGSegments(md.icc)...)
+	case ".png":
+		if len(out) < pngIhdrEnd || !bytes.Equal(out[12:16], pngIhdrChunkType) {
+			return out, nil
+		}
+		pos = pngIhdrEnd
+		embedded = pngMetadataChunks(md)
+	}
+	if len(embedded) == 0 || pos > len(out) {
+		return out, nil
+	}
+
+	if len(out)+len(embedded) > cap(out) {
+		if !growable {
+			return nil, ErrBufTooSmall
+		}
+		grown := make([]byte, len(out), len(out)+len(embedded))
+		copy(grown, out)
+		out = grown
+	}
+	out = out[:len(out)+len(embedded)]
+	copy(out[pos+len(embedded):], out[pos:])
+	copy(out[pos:], embedded)
+	return out, nil
+}
+
+// pngMetadataChunks returns the chunks holding md, which belong ahead of the image data of a PNG
+func pngMetadataChunks(md encodeMetadata) []byte {
+	chunks := append(iccPNGChunk(md.icc), exifPNGChunk(md.exif)...)
+	return append(chunks, xmpPNGChunk(md.xmp)...)
+}
+
+// jpegAPP1Payload returns the payload of the first APP1 segment of a JPEG
+// starting with signature, without the signature
+func jpegAPP1Payload(jpeg []byte, signature []byte) []byte {
+	if len(jpeg) < 4 || jpeg[0] != 0xFF || jpeg[1] != 0xD8 {
+		return nil
+	}
+
+	for pos := 2; pos+4 <= len(jpeg) && jpeg[pos] == 0xFF; {
+		segmentType := jpeg[pos+1]
+		if segmentType == jpegSOSSegmentType || segmentType == jpegEOISegmentType {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(jpeg[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(jpeg) {
+			break
+		}
+		payload := jpeg[pos+4 : end]
+		if segmentType == jpegAPP1SegmentType && bytes.HasPrefix(payload, signature) {
+			return payload[len(signature):]
+		}
+		pos = end
+	}
+	return nil
+}
+
+// webpChunkData returns the data of the first chunk of a WebP with the given fourCC
+func webpChunkData(webp []byte, fourCC string) []byte {
+	if len(webp) < 12 || string(webp[:4]) != "RIFF" || string(webp[8:12]) != "WEBP" {
+		return nil
+	}
+
+	for pos := 12; pos+8 <= len(webp); {
+		size := int(binary.LittleEndian.Uint32(webp[pos+4:]))
+		end := pos + 8 + size
+		if size < 0 || end > len(webp) {
+			break
+		}
+		if string(webp[pos:pos+4]) == fourCC {
+			return webp[pos+8 : end]
+		}
+		// chunks are padded to an even size
+		pos = end + size&1
+	}
+	return nil
+}
+
+// filterEXIF returns a copy of the EXIF data raw holding only what policy
+// keeps, with its orientation reset as the output is normalized. It returns
+// nil if policy strips metadata or raw cannot be parsed. Tags are removed in
+// place so that the offsets of everything else are unchanged.
+func filterEXIF(raw []byte, policy MetadataPolicy) []byte {
+	if policy.stripsEXIFAndXMP() || len(raw) == 0 {
+		return nil
+	}
+
+	e, err := ParseEXIF(append([]byte{}, raw...))
+	if err != nil {
+		return nil
+	}
+
+	if tag, ok := e.Tag(EXIFIFD0, EXIFTagOrientation); ok && tag.Count == 1 {
+		switch tag.Type {
+		case exifTypeShort:
+			e.order.PutUint16(tag.Value, uint16(OrientationTopLeft))
+		case exifTypeLong:
+			e.order.PutUint32(tag.Value, uint32(OrientationTopLeft))
+		}
+	}
+
+	if policy == MetadataKeepSafe {
+		e.removeTags(EXIFIFDGPS, func(uint16) bool { return true })
+		e.removeTags(EXIFIFD0, func(id uint16) bool {
+			return id == EXIFTagGPSIFDPointer || id == EXIFTagCameraSerialNumber
+		})
+		e.removeTags(EXIFIFDExif, func(id uint16) bool {
+			switch id {
+			case EXIFTagMakerNote, EXIFTagCameraOwnerName, EXIFTagBodySerialNumber, EXIFTagLensSerialNumber:
+				return true
+			}
+			return false
+		})
+	}
+
+	return e.raw
+}
+
+// removeTags removes the tags of the directory ifd for which remove returns
+// true, zeroing their values. The remaining entries are moved up in place.
+func (e *EXIF) removeTags(ifd EXIFIFD, remove func(id uint16) bool) {
+	if e.ifds[ifd] == nil {
+		return
+	}
+
+	raw, order := e.raw, e.order
+	offset := int(e.offsets[ifd])
+	count := int(order.Uint16(raw[offset:]))
+	entries := raw[offset+2 : offset+2+count*exifIFDEntryLen]
+
+	kept := 0
+	for i := 0; i < count; i++ {
+		entry := entries[i*exifIFDEntryLen : (i+1)*exifIFDEntryLen]
+		if !remove(order.Uint16(entry)) {
+			copy(entries[kept*exifIFDEntryLen:], entry)
+			kept++
+			continue
+		}
+
+		size := exifTypeSizes[order.Uint16(entry[2:])]
+		length := uint64(order.Uint32(entry[4:])) * uint64(size)
+		if length > 4 {
+			valueOffset := uint64(order.Uint32(entry[8:]))
+			if valueOffset+length <= uint64(len(raw)) {
+				zeroBytes(raw[valueOffset : valueOffset+length])
+			}
+		}
+	}
+	if kept == count {
+		return
+	}
+
+	// the offset of the next directory follows the entries
+	end := offset + 2 + count*exifIFDEntryLen
+	freed := entries[kept*exifIFDEntryLen:]
+	if end+4 <= len(raw) {
+		next := order.Uint32(raw[end:])
+		zeroBytes(raw[end : end+4])
+		zeroBytes(freed)
+		order.PutUint32(freed, next)
+	} else {
+		zeroBytes(freed)
+	}
+	order.PutUint16(raw[offset:], uint16(kept))
+
+	// the entries have moved, so the parsed tags no longer match the data
+	e.parseIFD(ifd, uint32(offset))
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
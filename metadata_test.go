@@ -0,0 +1,120 @@
+package lilliput
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFilterEXIF(t *testing.T) {
+	raw := makeTestEXIF(
+		testEXIFASCII(EXIFTagMake, "Apple"),
+		testEXIFShort(EXIFTagOrientation, 6),
+		testEXIFEntry{id: EXIFTagExifIFDPointer, children: []testEXIFEntry{
+			testEXIFASCII(EXIFTagDateTimeOriginal, "2019:06:27 20:44:45"),
+			testEXIFASCII(EXIFTagBodySerialNumber, "C39XK1ABCDEF"),
+			testEXIFASCII(EXIFTagLensSerialNumber, "LENS4242"),
+		}},
+		testEXIFEntry{id: EXIFTagGPSIFDPointer, children: []testEXIFEntry{
+			testEXIFASCII(EXIFTagGPSLatitudeRef, "N"),
+			testEXIFRationals(EXIFTagGPSLatitude, 37, 1, 46, 1, 3000, 100),
+			testEXIFASCII(EXIFTagGPSLongitudeRef, "W"),
+			testEXIFRationals(EXIFTagGPSLongitude, 122, 1, 25, 1, 1200, 100),
+		}},
+	)
+	source := append([]byte{}, raw...)
+
+	if filterEXIF(raw, MetadataStrip) != nil {
+		t.Errorf("Expected MetadataStrip to remove the EXIF data")
+	}
+	if filterEXIF(raw, MetadataDefault) != nil {
+		t.Errorf("Expected MetadataDefault to remove the EXIF data")
+	}
+
+	kept, err := ParseEXIF(filterEXIF(raw, MetadataKeep))
+	if err != nil {
+		t.Fatalf("ParseEXIF of kept data failed: %v", err)
+	}
+	if kept.Orientation() != OrientationTopLeft {
+		t.Errorf("Orientation() = %d, want it reset to %d", kept.Orientation(), OrientationTopLeft)
+	}
+	if _, _, ok := kept.GPS(); !ok {
+		t.Errorf("Expected MetadataKeep to keep the location")
+	}
+	if _, ok := kept.Tag(EXIFIFDExif, EXIFTagBodySerialNumber); !ok {
+		t.Errorf("Expected MetadataKeep to keep the serial number")
+	}
+
+	filtered := filterEXIF(raw, MetadataKeepSafe)
+	safe, err := ParseEXIF(filtered)
+	if err != nil {
+		t.Fatalf("ParseEXIF of safe data failed: %v", err)
+	}
+	if _, _, ok := safe.GPS(); ok || len(safe.Tags(EXIFIFDGPS)) != 0 {
+		t.Errorf("Expected MetadataKeepSafe to remove the location")
+	}
+	if _, ok := safe.Tag(EXIFIFD0, EXIFTagGPSIFDPointer); ok {
+		t.Errorf("Expected MetadataKeepSafe to remove the GPS directory")
+	}
+	for _, serial := range []string{"C39XK1ABCDEF", "LENS4242"} {
+		if bytes.Contains(filtered, []byte(serial)) {
+			t.Errorf("Expected MetadataKeepSafe to erase serial number %q", serial)
+		}
+	}
+	if safe.Make() != "Apple" || safe.Orientation() != OrientationTopLeft {
+		t.Errorf("camera = %q, orientation %d, want Apple and %d", safe.Make(), safe.Orientation(), OrientationTopLeft)
+	}
+	if _, ok := safe.CaptureTime(); !ok {
+		t.Errorf("Expected MetadataKeepSafe to keep the capture time")
+	}
+
+	if !bytes.Equal(raw, source) {
+		t.Errorf("Expected filterEXIF to leave its input unchanged")
+	}
+	if filterEXIF([]byte("not EXIF data"), MetadataKeep) != nil {
+		t.Errorf("Expected invalid EXIF data to be removed")
+	}
+}
+
+func TestEmbedMetadata(t *testing.T) {
+	exif := makeTestEXIF(testEXIFASCII(EXIFTagMake, "Apple"))
+	md := encodeMetadata{exif: exif}
+
+	jpeg := []byte{0xFF, 0xD8, 0xFF, 0xD9}
+	out, err := embedMetadata(jpeg, ".jpeg", md, true)
+	if err != nil {
+		t.Fatalf("embedMetadata failed: %v", err)
+	}
+	if got := jpegEXIF(out); !bytes.Equal(got, exif) {
+		t.Errorf("jpegEXIF() = %q, want %q", got, exif)
+	}
+
+	png := append([]byte{}, pngMagic...)
+	png = appendPNGChunk(png, pngIhdrChunkType, make([]byte, 13))
+	png = appendPNGChunk(png, pngIendChunkType, nil)
+	out, err = embedMetadata(png, ".png", md, true)
+	if err != nil {
+		t.Fatalf("embedMetadata failed: %v", err)
+	}
+	if got := pngEXIF(out); !bytes.Equal(got, exif) {
+		t.Errorf("pngEXIF() = %q, want %q", got, exif)
+	}
+
+	if _, err := embedMetadata(png[:len(png):len(png)], ".png", md, false); err != ErrBufTooSmall {
+		t.Errorf("embedMetadata error = %v, want ErrBufTooSmall", err)
+	}
+}
+
+// decoderWithoutMetadata is a Decoder implemented outside of lilliput, which
+// predates MetadataDecoder
+type decoderWithoutMetadata struct {
+	Decoder
+}
+
+func TestDecodedMetadata(t *testing.T) {
+	if exif, xmp := decodedEXIF(decoderWithoutMetadata{}), decodedXMP(decoderWithoutMetadata{}); exif != nil || xmp != nil {
+		t.Errorf("Expected no metadata from a Decoder which is not a MetadataDecoder, got %q and %q", exif, xmp)
+	}
+	if exif, xmp := decodedEXIF(nil), decodedXMP(nil); exif != nil || xmp != nil {
+		t.Errorf("Expected no metadata without a Decoder, got %q and %q", exif, xmp)
+	}
+}
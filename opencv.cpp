@@ -167,18 +167,214 @@ bool opencv_encoder_write(opencv_encoder e, const opencv_mat src, const int* opt
     return e_ptr->write(*mat, params);
 };
 
+// resizes BGRA pixels with their color premultiplied by alpha, so that the color of
+// transparent pixels does not bleed into their neighbours as a dark fringe. 16 bits
+// per channel keep the color of nearly transparent pixels intact.
+static void opencv_mat_resize_premultiplied(const cv::Mat& src, cv::Mat& dst, cv::Size size, int interpolation)
+{
+    cv::Mat premultiplied(src.rows, src.cols, CV_16UC4);
+    for (int y = 0; y < src.rows; y++) {
+        const uint8_t* in = src.ptr<uint8_t>(y);
+        uint16_t* out = premultiplied.ptr<uint16_t>(y);
+        for (int x = 0; x < src.cols * 4; x += 4) {
+            uint16_t alpha = in[x + 3];
+            out[x] = in[x] * alpha;
+            out[x + 1] = in[x + 1] * alpha;
+            out[x + 2] = in[x + 2] * alpha;
+            // scaled like the premultiplied color channels
+            out[x + 3] = alpha * 255;
+        }
+    }
+
+    cv::Mat resized;
+    cv::resize(premultiplied, resized, size, 0, 0, interpolation);
+
+    dst.create(size, CV_8UC4);
+    for (int y = 0; y < size.height; y++) {
+        const uint16_t* in = resized.ptr<uint16_t>(y);
+        uint8_t* out = dst.ptr<uint8_t>(y);
+        for (int x = 0; x < size.width * 4; x += 4) {
+            uint32_t alpha = in[x + 3];
+            if (alpha == 0) {
+                out[x] = out[x + 1] = out[x + 2] = out[x + 3] = 0;
+                continue;
+            }
+            for (int c = 0; c < 3; c++) {
+                out[x + c] = std::min<uint32_t>(255, (in[x + c] * 255 + alpha / 2) / alpha);
+            }
+            out[x + 3] = (alpha + 127) / 255;
+        }
+    }
+}
+
+// returns whether any pixel of BGRA src is not fully opaque
+static bool opencv_mat_has_transparency(const cv::Mat& src)
+{
+    for (int y = 0; y < src.rows; y++) {
+        const uint8_t* in = src.ptr<uint8_t>(y);
+        for (int x = 3; x < src.cols * 4; x += 4) {
+            if (in[x] != 255) {
+                return true;
+            }
+        }
+    }
+    return false;
+}
+
 void opencv_mat_resize(const opencv_mat src,
                        opencv_mat dst,
                        int width,
                        int height,
                        int interpolation)
 {
-    cv::resize(*static_cast<const cv::Mat*>(src),
-               *static_cast<cv::Mat*>(dst),
-               cv::Size(width, height),
-               0,
-               0,
-               interpolation);
+    auto cvSrc = static_cast<const cv::Mat*>(src);
+    auto cvDst = static_cast<cv::Mat*>(dst);
+
+    // nearest neighbour never mixes pixels, and opaque pixels have no color to
+    // bleed, so neither has a use for premultiplied alpha
+    if (cvSrc->type() == CV_8UC4 && interpolation != CV_INTER_NN &&
+        opencv_mat_has_transparency(*cvSrc)) {
+        opencv_mat_resize_premultiplied(*cvSrc, *cvDst, cv::Size(width, height), interpolation);
+        return;
+    }
+
+    cv::resize(*cvSrc, *cvDst, cv::Size(width, height), 0, 0, interpolation);
+}
+
+static float srgb_to_linear(float v)
+{
+    return v <= 0.04045f ? v / 12.92f : powf((v + 0.055f) / 1.055f, 2.4f);
+}
+
+static float linear_to_srgb(float v)
+{
+    return v <= 0.0031308f ? v * 12.92f : 1.055f * powf(v, 1.0f / 2.4f) - 0.055f;
+}
+
+// linear values are encoded back to sRGB through a table fine enough that
+// every 8 bit value survives the round trip
+#define LINEAR_TO_SRGB_TABLE_SIZE 16384
+
+static const std::vector<uint8_t>& linear_to_srgb_table()
+{
+    static const std::vector<uint8_t> table = [] {
+        std::vector<uint8_t> table(LINEAR_TO_SRGB_TABLE_SIZE);
+        for (int i = 0; i < LINEAR_TO_SRGB_TABLE_SIZE; i++) {
+            float v = linear_to_srgb(i / (float)(LINEAR_TO_SRGB_TABLE_SIZE - 1));
+            table[i] = cv::saturate_cast<uint8_t>(v * 255.0f);
+        }
+        return table;
+    }();
+    return table;
+}
+
+void opencv_mat_resize_linear_light(const opencv_mat src,
+                                    opencv_mat dst,
+                                    int width,
+                                    int height,
+                                    int interpolation)
+{
+    auto cvSrc = static_cast<const cv::Mat*>(src);
+    auto cvDst = static_cast<cv::Mat*>(dst);
+    if (cvSrc->depth() != CV_8U) {
+        cv::resize(*cvSrc, *cvDst, cv::Size(width, height), 0, 0, interpolation);
+        return;
+    }
+
+    int channels = cvSrc->channels();
+    // the alpha channel of BGRA pixels is already linear
+    int color_channels = channels == 4 ? 3 : channels;
+
+    cv::Mat decode(1, 256, CV_32FC(channels));
+    float* decode_entries = decode.ptr<float>(0);
+    for (int i = 0; i < 256; i++) {
+        for (int c = 0; c < channels; c++) {
+            float v = i / 255.0f;
+            decode_entries[i * channels + c] = c < color_channels ? srgb_to_linear(v) : v;
+        }
+    }
+
+    const std::vector<uint8_t>& encode = linear_to_srgb_table();
+
+    cv::Mat linear;
+    cv::LUT(*cvSrc, decode, linear);
+
+    // premultiply alpha so that transparent pixels do not bleed into their neighbours
+    bool premultiply = channels == 4 && interpolation != CV_INTER_NN;
+    if (premultiply) {
+        for (int y = 0; y < linear.rows; y++) {
+            float* pixel = linear.ptr<float>(y);
+            for (int x = 0; x < linear.cols * 4; x += 4) {
+                pixel[x] *= pixel[x + 3];
+                pixel[x + 1] *= pixel[x + 3];
+                pixel[x + 2] *= pixel[x + 3];
+            }
+        }
+    }
+
+    cv::Mat resized;
+    cv::resize(linear, resized, cv::Size(width, height), 0, 0, interpolation);
+
+    if (premultiply) {
+        for (int y = 0; y < resized.rows; y++) {
+            float* pixel = resized.ptr<float>(y);
+            for (int x = 0; x < resized.cols * 4; x += 4) {
+                float alpha = pixel[x + 3];
+                if (alpha > 0.0f) {
+                    pixel[x] /= alpha;
+                    pixel[x + 1] /= alpha;
+                    pixel[x + 2] /= alpha;
+                }
+            }
+        }
+    }
+
+    cvDst->create(height, width, cvSrc->type());
+    for (int y = 0; y < height; y++) {
+        const float* in = resized.ptr<float>(y);
+        uint8_t* out = cvDst->ptr<uint8_t>(y);
+        for (int x = 0; x < width * channels; x++) {
+            float v = std::min(std::max(in[x], 0.0f), 1.0f);
+            if (x % channels < color_channels) {
+                out[x] = encode[(int)(v * (LINEAR_TO_SRGB_TABLE_SIZE - 1) + 0.5f)];
+            } else {
+                out[x] = cv::saturate_cast<uint8_t>(v * 255.0f);
+            }
+        }
+    }
+}
+
+void opencv_mat_transform_to_srgb(opencv_mat mat, const float* decode, const float* matrix)
+{
+    auto cvMat = static_cast<cv::Mat*>(mat);
+    if (cvMat->type() != CV_8UC3 && cvMat->type() != CV_8UC4) {
+        return;
+    }
+
+    const std::vector<uint8_t>& encode = linear_to_srgb_table();
+    const float* decode_red = decode;
+    const float* decode_green = decode + 256;
+    const float* decode_blue = decode + 512;
+
+    int channels = cvMat->channels();
+    for (int y = 0; y < cvMat->rows; y++) {
+        uint8_t* pixel = cvMat->ptr<uint8_t>(y);
+        for (int x = 0; x < cvMat->cols * channels; x += channels) {
+            float red = decode_red[pixel[x + 2]];
+            float green = decode_green[pixel[x + 1]];
+            float blue = decode_blue[pixel[x]];
+            uint8_t out[3];
+            for (int c = 0; c < 3; c++) {
+                float v = matrix[c * 3] * red + matrix[c * 3 + 1] * green + matrix[c * 3 + 2] * blue;
+                v = std::min(std::max(v, 0.0f), 1.0f);
+                out[c] = encode[(int)(v * (LINEAR_TO_SRGB_TABLE_SIZE - 1) + 0.5f)];
+            }
+            // alpha, if any, is left alone
+            pixel[x] = out[2];
+            pixel[x + 1] = out[1];
+            pixel[x + 2] = out[0];
+        }
+    }
 }
 
 opencv_mat opencv_mat_crop(const opencv_mat src, int x, int y, int width, int height)
@@ -558,3 +754,38 @@ int opencv_copy_to_region(opencv_mat src, opencv_mat dst, int xOffset, int yOffs
         return OPENCV_ERROR_UNKNOWN;
     }
 }
+
+/**
+ * @brief Replace the alpha channel of a 4-channel matrix with the first channel of another matrix.
+ *
+ * @param dst Pointer to the 4-channel OpenCV matrix to be modified.
+ * @param alpha Pointer to the OpenCV matrix holding the alpha plane. It is resized if necessary.
+ * @return int Error code.
+ */
+int opencv_mat_set_alpha(opencv_mat dst, const opencv_mat alpha)
+{
+    try {
+        auto dstMat = static_cast<cv::Mat*>(dst);
+        auto alphaMat = static_cast<const cv::Mat*>(alpha);
+
+        if (!dstMat || !alphaMat || dstMat->empty() || alphaMat->empty()) {
+            return OPENCV_ERROR_NULL_MATRIX;
+        }
+
+        if (dstMat->channels() != 4) {
+            return OPENCV_ERROR_INVALID_CHANNEL_COUNT;
+        }
+
+        cv::Mat src = *alphaMat;
+        if (src.size() != dstMat->size()) {
+            cv::resize(*alphaMat, src, dstMat->size(), 0, 0, cv::INTER_LINEAR);
+        }
+
+        int fromTo[] = {0, 3};
+        cv::mixChannels(&src, 1, dstMat, 1, fromTo, 1);
+        return OPENCV_SUCCESS;
+    } catch (const cv::Exception& e) {
+        std::cerr << "OpenCV exception in opencv_mat_set_alpha: " << e.what() << std::endl;
+        return OPENCV_ERROR_UNKNOWN;
+    }
+}
@@ -8,7 +8,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"image"
+	"image/color"
 	"io"
+	"strings"
 	"time"
 	"unsafe"
 )
@@ -19,6 +21,7 @@ type DisposeMethod int
 const (
 	NoDispose DisposeMethod = iota
 	DisposeToBackgroundColor
+	DisposeToPrevious
 )
 
 // BlendMethod describes how the previous frame should be blended with the next frame.
@@ -52,8 +55,11 @@ const (
 	pngChunkTypeFieldLen = 4
 	pngChunkAllFieldsLen = 12
 
-	jpegEOISegmentType byte = 0xD9
-	jpegSOSSegmentType byte = 0xDA
+	jpegEOISegmentType  byte = 0xD9
+	jpegSOSSegmentType  byte = 0xDA
+	jpegAPP0SegmentType byte = 0xE0
+	jpegAPP1SegmentType byte = 0xE1
+	jpegAPP2SegmentType byte = 0xE2
 )
 
 var (
@@ -61,6 +67,11 @@ var (
 	pngFctlChunkType = []byte{byte('f'), byte('c'), byte('T'), byte('L')}
 	pngFdatChunkType = []byte{byte('f'), byte('d'), byte('A'), byte('T')}
 	pngIendChunkType = []byte{byte('I'), byte('E'), byte('N'), byte('D')}
+	pngIhdrChunkType = []byte{byte('I'), byte('H'), byte('D'), byte('R')}
+	pngIdatChunkType = []byte{byte('I'), byte('D'), byte('A'), byte('T')}
+	pngIccpChunkType = []byte{byte('i'), byte('C'), byte('C'), byte('P')}
+	pngExifChunkType = []byte{byte('e'), byte('X'), byte('I'), byte('f')}
+	pngItxtChunkType = []byte{byte('i'), byte('T'), byte('X'), byte('t')}
 
 	// Helpful: https://en.wikipedia.org/wiki/JPEG#Syntax_and_structure
 	jpegUnsizedSegmentTypes = map[byte]bool{
@@ -80,6 +91,27 @@ var (
 // PixelType describes the base pixel type of the image.
 type PixelType int
 
+// ResampleFilter selects the interpolation used to resize pixel data.
+type ResampleFilter int
+
+const (
+	// ResampleAuto uses ResampleArea to shrink and ResampleCubic to enlarge.
+	ResampleAuto ResampleFilter = iota
+	ResampleNearest
+	ResampleLinear
+	ResampleCubic
+	ResampleArea
+	ResampleLanczos4
+)
+
+// resampling is how pixels are resampled by a resize: filter picks the
+// interpolation, and linearLight resizes in linear light instead of averaging
+// sRGB encoded values.
+type resampling struct {
+	filter      ResampleFilter
+	linearLight bool
+}
+
 // ImageHeader contains basic decoded image metadata.
 type ImageHeader struct {
 	width         int
@@ -88,6 +120,7 @@ type ImageHeader struct {
 	orientation   ImageOrientation
 	numFrames     int
 	contentLength int
+	animated      bool // frames follow one another, though how many is unknown
 }
 
 // Framebuffer contains an array of raw, decoded pixel data.
@@ -113,9 +146,12 @@ type openCVDecoder struct {
 }
 
 type openCVEncoder struct {
-	encoder C.opencv_encoder
-	dst     C.opencv_mat
-	dstBuf  []byte
+	encoder  C.opencv_encoder
+	dst      C.opencv_mat
+	dstBuf   []byte
+	ext      string
+	metadata encodeMetadata
+	growable bool
 }
 
 // Depth returns the number of bits in the PixelType.
@@ -149,7 +185,7 @@ func (h *ImageHeader) Orientation() ImageOrientation {
 }
 
 func (h *ImageHeader) IsAnimated() bool {
-	return h.numFrames > 1
+	return h.numFrames > 1 || h.animated
 }
 
 func (h *ImageHeader) HasAlpha() bool {
@@ -237,11 +273,65 @@ func (f *Framebuffer) OrientationTransform(orientation ImageOrientation) {
 	f.height = int(C.opencv_mat_get_height(f.mat))
 }
 
+// cropView returns a Framebuffer sharing the pixel data of rect within f. It
+// must be closed after use and before f is modified.
+func (f *Framebuffer) cropView(rect image.Rectangle) *Framebuffer {
+	return &Framebuffer{
+		mat:       C.opencv_mat_crop(f.mat, C.int(rect.Min.X), C.int(rect.Min.Y), C.int(rect.Dx()), C.int(rect.Dy())),
+		width:     rect.Dx(),
+		height:    rect.Dy(),
+		pixelType: f.pixelType,
+	}
+}
+
+// interpolation returns the OpenCV interpolation flag for resizing from
+// srcWidth x srcHeight to width x height.
+func (r ResampleFilter) interpolation(srcWidth, srcHeight, width, height int) C.int {
+	switch r {
+	case ResampleNearest:
+		return C.CV_INTER_NN
+	case ResampleLinear:
+		return C.CV_INTER_LINEAR
+	case ResampleCubic:
+		return C.CV_INTER_CUBIC
+	case ResampleArea:
+		return C.CV_INTER_AREA
+	case ResampleLanczos4:
+		return C.CV_INTER_LANCZOS4
+	}
+
+	if width > srcWidth || height > srcHeight {
+		return C.CV_INTER_CUBIC
+	}
+	return C.CV_INTER_AREA
+}
+
+// resizeMatWithFilter resizes src, which is srcWidth x srcHeight, into dst.
+func resizeMatWithFilter(src, dst C.opencv_mat, srcWidth, srcHeight, width, height int, r resampling) {
+	interpolation := r.filter.interpolation(srcWidth, srcHeight, width, height)
+	if r.linearLight {
+		C.opencv_mat_resize_linear_light(src, dst, C.int(width), C.int(height), interpolation)
+		return
+	}
+	C.opencv_mat_resize(src, dst, C.int(width), C.int(height), interpolation)
+}
+
 // ResizeTo performs a resizing transform on the Framebuffer and puts the result
 // in the provided destination Framebuffer. This function does not preserve aspect
 // ratio if the given dimensions differ in ratio from the source. Returns an error
-// if the destination is not large enough to hold the given dimensions.
+// if the destination is not large enough to hold the given dimensions. Pixels with
+// alpha are resampled premultiplied, so transparent pixels do not darken the edges
+// of opaque ones.
 func (f *Framebuffer) ResizeTo(width, height int, dst *Framebuffer) error {
+	return f.ResizeToWithFilter(width, height, ResampleAuto, dst)
+}
+
+// ResizeToWithFilter performs the same transform as ResizeTo using the given filter.
+func (f *Framebuffer) ResizeToWithFilter(width, height int, filter ResampleFilter, dst *Framebuffer) error {
+	return f.resizeTo(width, height, resampling{filter: filter}, dst)
+}
+
+func (f *Framebuffer) resizeTo(width, height int, r resampling, dst *Framebuffer) error {
 	if width < 1 {
 		width = 1
 	}
@@ -254,7 +344,7 @@ func (f *Framebuffer) ResizeTo(width, height int, dst *Framebuffer) error {
 	if err != nil {
 		return err
 	}
-	C.opencv_mat_resize(f.mat, dst.mat, C.int(width), C.int(height), C.CV_INTER_AREA)
+	resizeMatWithFilter(f.mat, dst.mat, f.width, f.height, width, height, r)
 	return nil
 }
 
@@ -274,6 +364,17 @@ func (f *Framebuffer) ClearToTransparent(rect image.Rectangle) error {
 // keep from stretching the image content. Returns an error if the destination is
 // not large enough to hold the given dimensions.
 func (f *Framebuffer) Fit(width, height int, dst *Framebuffer) error {
+	return f.FitWithFocalPoint(width, height, GravityCenter.FocalPoint(), ResampleAuto, dst)
+}
+
+// FitWithFocalPoint performs the same transform as Fit using the given filter, but
+// crops around focalPoint instead of the center. The focal point is kept as close to
+// the center of the result as the edges of the image allow.
+func (f *Framebuffer) FitWithFocalPoint(width, height int, focalPoint FocalPoint, filter ResampleFilter, dst *Framebuffer) error {
+	return f.fitWithFocalPoint(width, height, focalPoint, resampling{filter: filter}, dst)
+}
+
+func (f *Framebuffer) fitWithFocalPoint(width, height int, focalPoint FocalPoint, r resampling, dst *Framebuffer) error {
 	if f.mat == nil {
 		return ErrFrameBufNoPixels
 	}
@@ -301,16 +402,8 @@ func (f *Framebuffer) Fit(width, height int, dst *Framebuffer) error {
 		heightPostCrop = 1
 	}
 
-	var left, top int
-	left = int(float64(f.width-widthPostCrop) * 0.5)
-	if left < 0 {
-		left = 0
-	}
-
-	top = int(float64(f.height-heightPostCrop) * 0.5)
-	if top < 0 {
-		top = 0
-	}
+	left := cropOffset(f.width, widthPostCrop, focalPoint.X)
+	top := cropOffset(f.height, heightPostCrop, focalPoint.Y)
 
 	newMat := C.opencv_mat_crop(f.mat, C.int(left), C.int(top), C.int(widthPostCrop), C.int(heightPostCrop))
 	defer C.opencv_mat_release(newMat)
@@ -319,10 +412,97 @@ func (f *Framebuffer) Fit(width, height int, dst *Framebuffer) error {
 	if err != nil {
 		return err
 	}
-	C.opencv_mat_resize(newMat, dst.mat, C.int(width), C.int(height), C.CV_INTER_AREA)
+	resizeMatWithFilter(newMat, dst.mat, widthPostCrop, heightPostCrop, width, height, r)
 	return nil
 }
 
+// Contain performs a resizing transform which preserves aspect ratio, scaling the
+// Framebuffer to fit within the given dimensions and centering it in the provided
+// destination Framebuffer, which is exactly that size. The remainder of the destination
+// is filled with padColor. A Framebuffer without alpha gains an alpha channel when
+// padColor is not opaque. Returns an error if the destination is not large enough
+// to hold the given dimensions.
+func (f *Framebuffer) Contain(width, height int, padColor color.NRGBA, filter ResampleFilter, dst *Framebuffer) error {
+	return f.contain(width, height, padColor, resampling{filter: filter}, dst)
+}
+
+func (f *Framebuffer) contain(width, height int, padColor color.NRGBA, r resampling, dst *Framebuffer) error {
+	if f.mat == nil {
+		return ErrFrameBufNoPixels
+	}
+
+	if width < 1 {
+		width = 1
+	}
+
+	if height < 1 {
+		height = 1
+	}
+
+	pixelType := f.pixelType
+	if pixelType.Channels() < 4 && padColor.A < 255 {
+		pixelType = PixelType(C.CV_8UC4)
+	}
+
+	err := dst.resizeMat(width, height, pixelType)
+	if err != nil {
+		return err
+	}
+	C.opencv_mat_set_color(dst.mat, C.int(padColor.R), C.int(padColor.G), C.int(padColor.B), C.int(padColor.A))
+
+	scaledWidth, scaledHeight := containedSize(f.width, f.height, width, height)
+	left := (width - scaledWidth) / 2
+	top := (height - scaledHeight) / 2
+	if pixelType == f.pixelType {
+		region := dst.cropView(image.Rect(left, top, left+scaledWidth, top+scaledHeight))
+		defer region.Close()
+		resizeMatWithFilter(f.mat, region.mat, f.width, f.height, scaledWidth, scaledHeight, r)
+		return nil
+	}
+
+	// scale in the source's own type, then convert it to opaque BGRA as it
+	// is copied into place
+	scaled := C.opencv_mat_create(C.int(scaledWidth), C.int(scaledHeight), C.int(f.pixelType))
+	if scaled == nil {
+		return ErrBufTooSmall
+	}
+	defer C.opencv_mat_release(scaled)
+	resizeMatWithFilter(f.mat, scaled, f.width, f.height, scaledWidth, scaledHeight, r)
+	return handleOpenCVError(C.opencv_copy_to_region(scaled, dst.mat, C.int(left), C.int(top), C.int(scaledWidth), C.int(scaledHeight)))
+}
+
+// containedSize returns the largest size with the aspect ratio of width and height
+// which fits within maxWidth and maxHeight.
+func containedSize(width, height, maxWidth, maxHeight int) (int, int) {
+	if width*maxHeight > height*maxWidth {
+		// input is wider than the box, so width is the limit
+		scaledHeight := int(float64(height)*float64(maxWidth)/float64(width) + 0.5)
+		if scaledHeight < 1 {
+			scaledHeight = 1
+		}
+		return maxWidth, scaledHeight
+	}
+
+	scaledWidth := int(float64(width)*float64(maxHeight)/float64(height) + 0.5)
+	if scaledWidth < 1 {
+		scaledWidth = 1
+	}
+	return scaledWidth, maxHeight
+}
+
+// cropOffset returns the start of a span of length cropped within length which
+// is centered on the normalized position focus, clamped to stay within length.
+func cropOffset(length, cropped int, focus float64) int {
+	offset := int(focus*float64(length) - float64(cropped)*0.5)
+	if offset > length-cropped {
+		offset = length - cropped
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return offset
+}
+
 // Width returns the width of the contained pixel data in number of pixels. This may
 // differ from the capacity of the framebuffer.
 func (f *Framebuffer) Width() int {
@@ -412,6 +592,22 @@ func newOpenCVDecoder(buf []byte) (*openCVDecoder, error) {
 	}, nil
 }
 
+// isOpenCVImage reports whether OpenCV recognizes the signature at the start of buf
+func isOpenCVImage(buf []byte) bool {
+	mat := C.opencv_mat_create_from_data(C.int(len(buf)), 1, C.CV_8U, unsafe.Pointer(&buf[0]), C.size_t(len(buf)))
+	if mat == nil {
+		return false
+	}
+	defer C.opencv_mat_release(mat)
+
+	decoder := C.opencv_decoder_create(mat)
+	if decoder == nil {
+		return false
+	}
+	C.opencv_decoder_release(decoder)
+	return true
+}
+
 // chunk format https://www.w3.org/TR/PNG-Structure.html
 // TLDR: 4 bytes length, 4 bytes type, variable data, 4 bytes CRC
 // length is only the "data" field; does not include itself, the type or the CRC
@@ -459,6 +655,26 @@ func (it *pngChunkIter) chunkType() []byte {
 	return it.png[it.iterOffset+4 : it.iterOffset+8]
 }
 
+// chunkData returns the data field of the current chunk, truncated if the
+// chunk claims to extend past the end of the png
+func (it *pngChunkIter) chunkData() []byte {
+	start := it.iterOffset + pngChunkSizeFieldLen + pngChunkTypeFieldLen
+	end := it.nextChunkOffset() - 4
+	if end > len(it.png) || end < start {
+		end = len(it.png)
+	}
+	return it.png[start:end]
+}
+
+// chunk returns the entire current chunk, including its size, type and CRC fields
+func (it *pngChunkIter) chunk() []byte {
+	end := it.nextChunkOffset()
+	if end > len(it.png) || end < it.iterOffset {
+		end = len(it.png)
+	}
+	return it.png[it.iterOffset:end]
+}
+
 func detectContentLengthPNG(png []byte) int {
 	chunkIter, err := makePngChunkIter(png)
 	if err != nil {
@@ -646,6 +862,34 @@ func (d *openCVDecoder) ICC() []byte {
 	return []byte{}
 }
 
+func (d *openCVDecoder) EXIF() []byte {
+	var exif []byte
+	switch d.Description() {
+	case "JPEG":
+		exif = jpegEXIF(d.buf)
+	case "PNG":
+		exif = pngEXIF(d.buf)
+	}
+	if exif == nil {
+		return []byte{}
+	}
+	return exif
+}
+
+func (d *openCVDecoder) XMP() []byte {
+	var xmp []byte
+	switch d.Description() {
+	case "JPEG":
+		xmp = jpegXMP(d.buf)
+	case "PNG":
+		xmp = pngXMP(d.buf)
+	}
+	if xmp == nil {
+		return []byte{}
+	}
+	return xmp
+}
+
 func (d *openCVDecoder) iccJPEG() []byte {
 	iccDst := make([]byte, 8192)
 	iccLength := C.opencv_decoder_get_jpeg_icc(unsafe.Pointer(&d.buf[0]), C.size_t(len(d.buf)), unsafe.Pointer(&iccDst[0]), C.size_t(cap(iccDst)))
@@ -691,7 +935,13 @@ func (d *openCVDecoder) SkipFrame() error {
 	return ErrSkipNotSupported
 }
 
-func newOpenCVEncoder(ext string, decodedBy Decoder, dstBuf []byte) (*openCVEncoder, error) {
+func newOpenCVEncoder(ext string, decodedBy Decoder, dstBuf []byte, growable bool) (*openCVEncoder, error) {
+	return newOpenCVEncoderWithMetadata(ext, decodedBy, decodedMetadata(decodedBy), dstBuf, growable)
+}
+
+// newOpenCVEncoderWithMetadata returns an openCVEncoder which embeds md in
+// JPEG and PNG output rather than the profile of the image decoded by decodedBy
+func newOpenCVEncoderWithMetadata(ext string, decodedBy Decoder, md encodeMetadata, dstBuf []byte, growable bool) (*openCVEncoder, error) {
 	dstBuf = dstBuf[:1]
 	dst := C.opencv_mat_create_empty_from_data(C.int(cap(dstBuf)), unsafe.Pointer(&dstBuf[0]))
 
@@ -707,9 +957,12 @@ func newOpenCVEncoder(ext string, decodedBy Decoder, dstBuf []byte) (*openCVEnco
 	}
 
 	return &openCVEncoder{
-		encoder: enc,
-		dst:     dst,
-		dstBuf:  dstBuf,
+		encoder:  enc,
+		dst:      dst,
+		dstBuf:   dstBuf,
+		ext:      strings.ToLower(ext),
+		metadata: md,
+		growable: growable,
 	}, nil
 }
 
@@ -730,16 +983,19 @@ func (e *openCVEncoder) Encode(f *Framebuffer, opt map[int]int) ([]byte, error)
 		return nil, ErrInvalidImage
 	}
 
+	length := int(C.opencv_mat_get_height(e.dst))
+
 	ptrCheck := C.opencv_mat_get_data(e.dst)
 	if ptrCheck != unsafe.Pointer(&e.dstBuf[0]) {
-		// mat pointer got reallocated - the passed buf was too small to hold the image
-		// XXX we should free? the mat here, probably want to recreate
-		return nil, ErrBufTooSmall
+		// mat pointer got reallocated - the passed buf was too small to hold the image.
+		// the mat owns the new buffer, which is freed with it in Close
+		if !e.growable {
+			return nil, ErrBufTooSmall
+		}
+		return embedMetadata(C.GoBytes(ptrCheck, C.int(length)), e.ext, e.metadata, e.growable)
 	}
 
-	length := int(C.opencv_mat_get_height(e.dst))
-
-	return e.dstBuf[:length], nil
+	return embedMetadata(e.dstBuf[:length], e.ext, e.metadata, e.growable)
 }
 
 func (e *openCVEncoder) Close() {
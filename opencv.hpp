@@ -47,6 +47,7 @@ int opencv_copy_to_region_with_alpha(opencv_mat src, opencv_mat dst, int xOffset
 int opencv_copy_to_region(opencv_mat src, opencv_mat dst, int xOffset, int yOffset, int width, int height);
 void opencv_mat_set_color(opencv_mat, int red, int green, int blue, int alpha);
 void opencv_mat_reset(opencv_mat mat);
+int opencv_mat_set_alpha(opencv_mat dst, const opencv_mat alpha);
 int opencv_mat_clear_to_transparent(opencv_mat mat, int xOffset, int yOffset, int width, int height);
 
 opencv_mat opencv_mat_create(int width, int height, int type);
@@ -63,6 +64,12 @@ void opencv_mat_resize(const opencv_mat src,
                        int width,
                        int height,
                        int interpolation);
+void opencv_mat_resize_linear_light(const opencv_mat src,
+                                    opencv_mat dst,
+                                    int width,
+                                    int height,
+                                    int interpolation);
+void opencv_mat_transform_to_srgb(opencv_mat mat, const float* decode, const float* matrix);
 opencv_mat opencv_mat_crop(const opencv_mat src, int x, int y, int width, int height);
 void opencv_mat_orientation_transform(CVImageOrientation orientation, opencv_mat mat);
 int opencv_mat_get_width(const opencv_mat mat);
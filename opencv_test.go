@@ -2,6 +2,7 @@ package lilliput
 
 import (
 	"bytes"
+	"image/color"
 	"io/ioutil"
 	"testing"
 )
@@ -269,7 +270,7 @@ func TestICC(t *testing.T) {
 
 			// try encoding a WebP image, including ICC profile data when available
 			dstBuf := make([]byte, destinationBufferSize)
-			encoder, err := newWebpEncoder(decoder, dstBuf)
+			encoder, err := newWebpEncoder(decoder, dstBuf, false)
 			if err != nil {
 				t.Fatalf("Failed to create a new webp encoder: %v", err)
 			}
@@ -291,3 +292,243 @@ func TestICC(t *testing.T) {
 		})
 	}
 }
+
+func TestCropOffset(t *testing.T) {
+	tests := []struct {
+		length, cropped int
+		focus           float64
+		want            int
+	}{
+		{100, 50, 0.5, 25},
+		{100, 50, 0, 0},
+		{100, 50, 1, 50},
+		{100, 50, 0.3, 5},
+		{100, 50, 0.1, 0},
+		{100, 100, 0.9, 0},
+	}
+	for _, tt := range tests {
+		if got := cropOffset(tt.length, tt.cropped, tt.focus); got != tt.want {
+			t.Errorf("cropOffset(%d, %d, %v) = %d, want %d", tt.length, tt.cropped, tt.focus, got, tt.want)
+		}
+	}
+}
+
+func TestFitWithFocalPoint(t *testing.T) {
+	// the left half of a 100x50 frame is white, the right half black
+	src := NewFramebuffer(100, 50)
+	defer src.Close()
+	if err := src.Create4Channel(100, 50); err != nil {
+		t.Fatalf("Create4Channel failed: %v", err)
+	}
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 50; x++ {
+			copy(src.buf[(y*100+x)*4:], []byte{255, 255, 255, 255})
+		}
+	}
+
+	tests := []struct {
+		gravity Gravity
+		want    byte
+	}{
+		{GravityWest, 255},
+		{GravityNorthWest, 255},
+		{GravityEast, 0},
+		{GravitySouthEast, 0},
+	}
+	for _, tt := range tests {
+		dst := NewFramebuffer(50, 50)
+		if err := src.FitWithFocalPoint(50, 50, tt.gravity.FocalPoint(), ResampleAuto, dst); err != nil {
+			t.Fatalf("FitWithFocalPoint failed: %v", err)
+		}
+		if dst.buf[0] != tt.want || dst.buf[len(dst.buf)-4] != tt.want {
+			t.Errorf("gravity %d kept pixels %d and %d, want %d", tt.gravity, dst.buf[0], dst.buf[len(dst.buf)-4], tt.want)
+		}
+		dst.Close()
+	}
+}
+
+func TestContainedSize(t *testing.T) {
+	tests := []struct {
+		width, height, maxWidth, maxHeight int
+		wantWidth, wantHeight              int
+	}{
+		{800, 297, 200, 200, 200, 74},
+		{297, 800, 200, 200, 74, 200},
+		{100, 100, 300, 200, 200, 200},
+		{28, 18, 512, 512, 512, 329},
+		{1000, 1, 10, 10, 10, 1},
+	}
+	for _, tt := range tests {
+		width, height := containedSize(tt.width, tt.height, tt.maxWidth, tt.maxHeight)
+		if width != tt.wantWidth || height != tt.wantHeight {
+			t.Errorf("containedSize(%d, %d, %d, %d) = %dx%d, want %dx%d", tt.width, tt.height, tt.maxWidth, tt.maxHeight, width, height, tt.wantWidth, tt.wantHeight)
+		}
+	}
+}
+
+func TestContain(t *testing.T) {
+	src := NewFramebuffer(100, 50)
+	defer src.Close()
+	if err := src.Create4Channel(100, 50); err != nil {
+		t.Fatalf("Create4Channel failed: %v", err)
+	}
+	for i := range src.buf[:100*50*4] {
+		src.buf[i] = 255
+	}
+
+	dst := NewFramebuffer(50, 50)
+	defer dst.Close()
+	if err := src.Contain(50, 50, color.NRGBA{R: 255, A: 255}, ResampleAuto, dst); err != nil {
+		t.Fatalf("Contain failed: %v", err)
+	}
+	if dst.Width() != 50 || dst.Height() != 50 {
+		t.Fatalf("Contain size = %dx%d, want 50x50", dst.Width(), dst.Height())
+	}
+
+	// the image is scaled to 50x25 between 12 rows of padding above and 13 below
+	pixel := func(x, y int) []byte {
+		return dst.buf[(y*50+x)*4 : (y*50+x)*4+4]
+	}
+	padding := []byte{0, 0, 255, 255}
+	if !bytes.Equal(pixel(0, 0), padding) || !bytes.Equal(pixel(49, 49), padding) {
+		t.Errorf("Expected red BGRA padding, got %v and %v", pixel(0, 0), pixel(49, 49))
+	}
+	if !bytes.Equal(pixel(25, 25), []byte{255, 255, 255, 255}) {
+		t.Errorf("Expected the image in the middle, got %v", pixel(25, 25))
+	}
+}
+
+func TestContain_TransparentPaddingAddsAlpha(t *testing.T) {
+	src := NewFramebuffer(100, 50)
+	defer src.Close()
+	if err := src.Create3Channel(100, 50); err != nil {
+		t.Fatalf("Create3Channel failed: %v", err)
+	}
+	for i := range src.buf[:100*50*3] {
+		src.buf[i] = 255
+	}
+
+	dst := NewFramebuffer(50, 50)
+	defer dst.Close()
+	if err := src.Contain(50, 50, color.NRGBA{}, ResampleAuto, dst); err != nil {
+		t.Fatalf("Contain failed: %v", err)
+	}
+	if dst.PixelType().Channels() != 4 {
+		t.Fatalf("Contain channels = %d, want 4 for transparent padding", dst.PixelType().Channels())
+	}
+
+	pixel := func(x, y int) []byte {
+		return dst.buf[(y*50+x)*4 : (y*50+x)*4+4]
+	}
+	if !bytes.Equal(pixel(0, 0), []byte{0, 0, 0, 0}) || !bytes.Equal(pixel(49, 49), []byte{0, 0, 0, 0}) {
+		t.Errorf("Expected transparent padding, got %v and %v", pixel(0, 0), pixel(49, 49))
+	}
+	if !bytes.Equal(pixel(25, 25), []byte{255, 255, 255, 255}) {
+		t.Errorf("Expected the opaque image in the middle, got %v", pixel(25, 25))
+	}
+}
+
+func TestResampleFilter_Auto(t *testing.T) {
+	if ResampleAuto.interpolation(100, 100, 50, 50) != ResampleArea.interpolation(0, 0, 0, 0) {
+		t.Errorf("Expected ResampleAuto to shrink with ResampleArea")
+	}
+	if ResampleAuto.interpolation(100, 100, 200, 50) != ResampleCubic.interpolation(0, 0, 0, 0) {
+		t.Errorf("Expected ResampleAuto to enlarge with ResampleCubic")
+	}
+}
+
+func TestResizeToWithFilter(t *testing.T) {
+	// a 2x2 checkerboard of black and white
+	src := NewFramebuffer(2, 2)
+	defer src.Close()
+	if err := src.Create3Channel(2, 2); err != nil {
+		t.Fatalf("Create3Channel failed: %v", err)
+	}
+	copy(src.buf, []byte{255, 255, 255, 0, 0, 0, 0, 0, 0, 255, 255, 255})
+
+	dst := NewFramebuffer(8, 8)
+	defer dst.Close()
+
+	isCrisp := func() bool {
+		for _, v := range dst.buf[:8*8*3] {
+			if v != 0 && v != 255 {
+				return false
+			}
+		}
+		return true
+	}
+
+	if err := src.ResizeToWithFilter(8, 8, ResampleNearest, dst); err != nil {
+		t.Fatalf("ResizeToWithFilter failed: %v", err)
+	}
+	if !isCrisp() {
+		t.Errorf("Expected nearest neighbour upscaling to keep only black and white")
+	}
+
+	if err := src.ResizeToWithFilter(8, 8, ResampleLinear, dst); err != nil {
+		t.Fatalf("ResizeToWithFilter failed: %v", err)
+	}
+	if isCrisp() {
+		t.Errorf("Expected linear upscaling to blend black and white")
+	}
+}
+
+func TestResizeTo_LinearLight(t *testing.T) {
+	// a white and a black pixel
+	src := NewFramebuffer(2, 1)
+	defer src.Close()
+	if err := src.Create4Channel(2, 1); err != nil {
+		t.Fatalf("Create4Channel failed: %v", err)
+	}
+	copy(src.buf, []byte{255, 255, 255, 255, 0, 0, 0, 255})
+
+	dst := NewFramebuffer(1, 1)
+	defer dst.Close()
+
+	if err := src.ResizeToWithFilter(1, 1, ResampleArea, dst); err != nil {
+		t.Fatalf("ResizeToWithFilter failed: %v", err)
+	}
+	if dst.buf[0] < 127 || dst.buf[0] > 128 {
+		t.Errorf("Expected sRGB averaging to give 127 or 128, got %d", dst.buf[0])
+	}
+
+	if err := src.resizeTo(1, 1, resampling{filter: ResampleArea, linearLight: true}, dst); err != nil {
+		t.Fatalf("resizeTo failed: %v", err)
+	}
+	// half of the light of white is encoded as 188 in sRGB
+	if dst.buf[0] != 188 || dst.buf[3] != 255 {
+		t.Errorf("Expected linear light averaging to give 188 with opaque alpha, got %v", dst.buf[:4])
+	}
+
+	// flat colors are unchanged by the round trip through linear light
+	copy(src.buf, []byte{10, 100, 200, 255, 10, 100, 200, 255})
+	if err := src.resizeTo(1, 1, resampling{filter: ResampleArea, linearLight: true}, dst); err != nil {
+		t.Fatalf("resizeTo failed: %v", err)
+	}
+	if !bytes.Equal(dst.buf[:4], []byte{10, 100, 200, 255}) {
+		t.Errorf("Expected a flat color to survive linear light resizing, got %v", dst.buf[:4])
+	}
+}
+
+func TestResizeTo_PremultipliedAlpha(t *testing.T) {
+	// an opaque white pixel beside a transparent black one
+	src := NewFramebuffer(2, 1)
+	defer src.Close()
+	if err := src.Create4Channel(2, 1); err != nil {
+		t.Fatalf("Create4Channel failed: %v", err)
+	}
+	copy(src.buf, []byte{255, 255, 255, 255, 0, 0, 0, 0})
+
+	dst := NewFramebuffer(1, 1)
+	defer dst.Close()
+
+	for _, resample := range []resampling{{filter: ResampleArea}, {filter: ResampleLinear}, {filter: ResampleArea, linearLight: true}} {
+		if err := src.resizeTo(1, 1, resample, dst); err != nil {
+			t.Fatalf("resizeTo failed: %v", err)
+		}
+		// the transparent pixel only lowers the alpha, instead of also darkening the color
+		if !bytes.Equal(dst.buf[:3], []byte{255, 255, 255}) || dst.buf[3] < 127 || dst.buf[3] > 128 {
+			t.Errorf("%+v gave %v, want half transparent white", resample, dst.buf[:4])
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package lilliput
 
 import (
+	"context"
 	"fmt"
 	"image"
+	"image/color"
 	"io"
+	"math"
+	"strings"
 	"time"
 )
 
@@ -13,8 +17,58 @@ const (
 	ImageOpsNoResize ImageOpsSizeMethod = iota
 	ImageOpsFit
 	ImageOpsResize
+	ImageOpsContain
+	ImageOpsFitWithin
 )
 
+// Gravity selects the part of an image which is kept when ImageOpsFit crops it.
+type Gravity int
+
+const (
+	GravityCenter Gravity = iota
+	GravityNorth
+	GravityNorthEast
+	GravityEast
+	GravitySouthEast
+	GravitySouth
+	GravitySouthWest
+	GravityWest
+	GravityNorthWest
+)
+
+// A FocalPoint is a position within an image, with X and Y normalized to 0..1
+// of its width and height.
+type FocalPoint struct {
+	X, Y float64
+}
+
+// FocalPoint returns the focal point which keeps the part of an image given by g.
+func (g Gravity) FocalPoint() FocalPoint {
+	switch g {
+	case GravityNorth:
+		return FocalPoint{0.5, 0}
+	case GravityNorthEast:
+		return FocalPoint{1, 0}
+	case GravityEast:
+		return FocalPoint{1, 0.5}
+	case GravitySouthEast:
+		return FocalPoint{1, 1}
+	case GravitySouth:
+		return FocalPoint{0.5, 1}
+	case GravitySouthWest:
+		return FocalPoint{0, 1}
+	case GravityWest:
+		return FocalPoint{0, 0.5}
+	case GravityNorthWest:
+		return FocalPoint{0, 0}
+	default:
+		return FocalPoint{0.5, 0.5}
+	}
+}
+
+// defaultWriterBufSize is the initial size of the output buffer used by TransformToWriter
+const defaultWriterBufSize = 1024 * 1024
+
 // ImageOptions controls how ImageOps resizes and encodes the
 // pixel data decoded from a Decoder
 type ImageOptions struct {
@@ -30,9 +84,49 @@ type ImageOptions struct {
 
 	// ResizeMethod controls how the image will be transformed to
 	// its output size. Notably, ImageOpsFit will do a cropping
-	// resize, while ImageOpsResize will stretch the image.
+	// resize, ImageOpsResize will stretch the image and ImageOpsContain
+	// will scale the image within the output size and pad the rest.
+	// ImageOpsFitWithin scales the image to fit within the output size,
+	// which is then computed from the image; a zero Width or Height
+	// leaves that dimension unbounded.
 	ResizeMethod ImageOpsSizeMethod
 
+	// Upscale allows ImageOpsFitWithin to enlarge images smaller than the
+	// output size. By default such images keep their size.
+	Upscale bool
+
+	// ResampleFilter selects the interpolation used to resize the image. The
+	// default chooses one depending on whether the image shrinks or grows.
+	ResampleFilter ResampleFilter
+
+	// LinearLight resizes the image in linear light rather than averaging its
+	// sRGB encoded values. This is slower but keeps fine bright details and
+	// high contrast textures from dimming and blurring when shrinking.
+	LinearLight bool
+
+	// PadColor is the color of the padding added by ImageOpsContain. When nil
+	// the padding is transparent for formats which can hold alpha, i.e. PNG,
+	// WebP and GIF, and opaque black otherwise. Padding which is not opaque
+	// gives images without alpha an alpha channel.
+	PadColor *color.NRGBA
+
+	// ConvertToSRGB transforms the decoded pixels from the color space of the
+	// embedded ICC profile to sRGB, so that wide gamut images display correctly
+	// in viewers which ignore profiles. Only RGB matrix/TRC profiles, which
+	// cover Display P3, Adobe RGB and the video color spaces, are converted;
+	// other images are left as they are. Converted output carries no profile.
+	ConvertToSRGB bool
+
+	// StripICCProfile leaves the ICC profile of the source out of the output.
+	// By default it is embedded in JPEG, PNG and WebP output.
+	StripICCProfile bool
+
+	// Metadata controls which EXIF metadata, XMP packets and GIF comments of
+	// the source are kept in the output. By default EXIF and XMP are stripped,
+	// while GIF extensions are copied as before. The orientation kept in EXIF
+	// is reset, as the output is always normalized.
+	Metadata MetadataPolicy
+
 	// NormalizeOrientation will flip and rotate the image as necessary
 	// in order to undo EXIF-based orientation
 	NormalizeOrientation bool
@@ -46,11 +140,35 @@ type ImageOptions struct {
 	// MaxEncodeDuration controls the maximum duration of animated image that will be resized
 	MaxEncodeDuration time.Duration
 
-	// This is a best effort timeout when encoding multiple frames
+	// This is a best effort timeout when encoding multiple frames. Use
+	// TransformContext to also interrupt the decoding and encoding of a frame.
 	EncodeTimeout time.Duration
 
 	// DisableAnimatedOutput controls the encoder behavior when given a multi-frame input
 	DisableAnimatedOutput bool
+
+	// VideoFrameSamples, if positive, makes a video start from the most
+	// representative of that many frames sampled across it, as chosen by
+	// VideoSeeker.SeekToRepresentativeFrame, rather than from its first frame.
+	VideoFrameSamples int
+
+	// Crop selects the region of the image to transform, in the coordinates of
+	// the image after its orientation has been normalized, or of the canvas for
+	// animations. It is clipped to the image and applied before resizing. The
+	// zero Rectangle selects the whole image.
+	Crop image.Rectangle
+
+	// Gravity selects the part of the image which ImageOpsFit keeps when the
+	// aspect ratio changes. The default keeps the center.
+	Gravity Gravity
+
+	// FocalPoint, if set, overrides Gravity. ImageOpsFit keeps it as close to
+	// the center of the output as possible. It is relative to Crop when set.
+	FocalPoint *FocalPoint
+
+	// GrowDestination allows output which does not fit in dst. Such output
+	// is returned in a newly allocated buffer instead of failing with ErrBufTooSmall.
+	GrowDestination bool
 }
 
 // ImageOps is a reusable object that can resize and encode images.
@@ -58,6 +176,10 @@ type ImageOps struct {
 	frames                  []*Framebuffer
 	frameIndex              int
 	animatedCompositeBuffer *Framebuffer
+	previousCompositeBuffer *Framebuffer
+	writerBuf               []byte
+	outputWidth             int
+	outputHeight            int
 }
 
 // NewImageOps creates a new ImageOps object that will operate
@@ -93,16 +215,34 @@ func (o *ImageOps) Clear() {
 	if o.animatedCompositeBuffer != nil {
 		o.animatedCompositeBuffer.Clear()
 	}
+	if o.previousCompositeBuffer != nil {
+		o.previousCompositeBuffer.Clear()
+	}
+}
+
+// OutputSize returns the dimensions of the image produced by the last Transform.
+func (o *ImageOps) OutputSize() (width, height int) {
+	return o.outputWidth, o.outputHeight
 }
 
 // Close releases resources associated with ImageOps
 func (o *ImageOps) Close() {
 	o.frames[0].Close()
 	o.frames[1].Close()
+	o.closeAnimatedFrameBuffers()
+	o.writerBuf = nil
+}
+
+// closeAnimatedFrameBuffers releases the buffers used to composite animated frames.
+func (o *ImageOps) closeAnimatedFrameBuffers() {
 	if o.animatedCompositeBuffer != nil {
 		o.animatedCompositeBuffer.Close()
 		o.animatedCompositeBuffer = nil
 	}
+	if o.previousCompositeBuffer != nil {
+		o.previousCompositeBuffer.Close()
+		o.previousCompositeBuffer = nil
+	}
 }
 
 // setupAnimatedFrameBuffers sets up the animated frame buffer.
@@ -133,24 +273,66 @@ func (o *ImageOps) decode(d Decoder) error {
 	return d.DecodeTo(active)
 }
 
-// fit fits the active frame to the specified output canvas size.
+// cropRect returns the region of the active frame, or of the animation canvas,
+// selected by opt.Crop. The zero Rectangle is returned when there is no crop.
+func (o *ImageOps) cropRect(opt *ImageOptions, inputHeader *ImageHeader) (image.Rectangle, error) {
+	if opt.Crop.Empty() {
+		return image.Rectangle{}, nil
+	}
+
+	bounds := image.Rect(0, 0, inputHeader.Width(), inputHeader.Height())
+	if !inputHeader.IsAnimated() {
+		// the active frame has already been rotated to its normalized orientation
+		bounds = image.Rect(0, 0, o.active().Width(), o.active().Height())
+	}
+
+	crop := opt.Crop.Intersect(bounds)
+	if crop.Empty() {
+		return image.Rectangle{}, ErrInvalidCrop
+	}
+	return crop, nil
+}
+
+// cropped returns the region crop of f, or f itself when crop is empty.
+// The returned function releases the region.
+func cropped(f *Framebuffer, crop image.Rectangle) (*Framebuffer, func()) {
+	if crop.Empty() {
+		return f, func() {}
+	}
+	view := f.cropView(crop)
+	return view, view.Close
+}
+
+// fit fits the active frame, or the region crop of it, to the specified output canvas size.
 // It returns true if the frame was resized and false if it was not.
 // It returns an error if the frame could not be resized.
-func (o *ImageOps) fit(d Decoder, inputCanvasWidth, inputCanvasHeight, outputCanvasWidth, outputCanvasHeight int, isAnimated, hasAlpha bool) (bool, error) {
-	newWidth, newHeight := calculateExpectedSize(inputCanvasWidth, inputCanvasHeight, outputCanvasWidth, outputCanvasHeight)
+func (o *ImageOps) fit(d Decoder, inputCanvasWidth, inputCanvasHeight int, crop image.Rectangle, focalPoint FocalPoint, outputCanvasWidth, outputCanvasHeight int, resample resampling, isAnimated, hasAlpha bool) (bool, error) {
+	srcWidth, srcHeight := inputCanvasWidth, inputCanvasHeight
+	if !crop.Empty() {
+		srcWidth, srcHeight = crop.Dx(), crop.Dy()
+	}
+	newWidth, newHeight := calculateExpectedSize(srcWidth, srcHeight, outputCanvasWidth, outputCanvasHeight)
 
 	if isAnimated {
 		if err := o.setupAnimatedFrameBuffers(d, inputCanvasWidth, inputCanvasHeight, hasAlpha); err != nil {
 			return false, err
 		}
 
+		// keep a copy of the canvas if the active frame will need to be undrawn afterwards
+		if err := o.savePreviousComposite(); err != nil {
+			return false, err
+		}
+
 		// blend transparent pixels of the active frame with corresponding pixels of the previous canvas, creating a composite
 		if err := o.applyBlendMethod(d); err != nil {
 			return false, err
 		}
 
 		// resize the composite to the output canvas size
-		if err := o.animatedCompositeBuffer.Fit(newWidth, newHeight, o.secondary()); err != nil {
+		src, release := cropped(o.animatedCompositeBuffer, crop)
+		err := src.fitWithFocalPoint(newWidth, newHeight, focalPoint, resample, o.secondary())
+		release()
+		if err != nil {
 			return false, err
 		}
 
@@ -164,15 +346,17 @@ func (o *ImageOps) fit(d Decoder, inputCanvasWidth, inputCanvasHeight, outputCan
 	}
 
 	// If the image is not animated, we can fit it directly.
-	if err := o.active().Fit(newWidth, newHeight, o.secondary()); err != nil {
+	src, release := cropped(o.active(), crop)
+	defer release()
+	if err := src.fitWithFocalPoint(newWidth, newHeight, focalPoint, resample, o.secondary()); err != nil {
 		return false, err
 	}
 	o.copyFramePropertiesAndSwap()
 	return true, nil
 }
 
-// resize resizes the active frame to the specified output canvas size.
-func (o *ImageOps) resize(d Decoder, inputCanvasWidth, inputCanvasHeight, outputCanvasWidth, outputCanvasHeight, frameCount int, isAnimated, hasAlpha bool) (bool, error) {
+// resize resizes the active frame, or the region crop of it, to the specified output canvas size.
+func (o *ImageOps) resize(d Decoder, inputCanvasWidth, inputCanvasHeight int, crop image.Rectangle, outputCanvasWidth, outputCanvasHeight, frameCount int, resample resampling, isAnimated, hasAlpha bool) (bool, error) {
 	// If the image is animated, we need to resize the frame to the input canvas size
 	// and then copy the previous frame's data to the working buffer.
 	if isAnimated {
@@ -180,11 +364,18 @@ func (o *ImageOps) resize(d Decoder, inputCanvasWidth, inputCanvasHeight, output
 			return false, err
 		}
 
+		if err := o.savePreviousComposite(); err != nil {
+			return false, err
+		}
+
 		if err := o.applyBlendMethod(d); err != nil {
 			return false, err
 		}
 
-		if err := o.animatedCompositeBuffer.ResizeTo(outputCanvasWidth, outputCanvasHeight, o.secondary()); err != nil {
+		src, release := cropped(o.animatedCompositeBuffer, crop)
+		err := src.resizeTo(outputCanvasWidth, outputCanvasHeight, resample, o.secondary())
+		release()
+		if err != nil {
 			return false, err
 		}
 
@@ -196,7 +387,9 @@ func (o *ImageOps) resize(d Decoder, inputCanvasWidth, inputCanvasHeight, output
 		return true, nil
 	}
 
-	if err := o.active().ResizeTo(outputCanvasWidth, outputCanvasHeight, o.secondary()); err != nil {
+	src, release := cropped(o.active(), crop)
+	defer release()
+	if err := src.resizeTo(outputCanvasWidth, outputCanvasHeight, resample, o.secondary()); err != nil {
 		return false, err
 	}
 	o.copyFramePropertiesAndSwap()
@@ -204,6 +397,84 @@ func (o *ImageOps) resize(d Decoder, inputCanvasWidth, inputCanvasHeight, output
 	return true, nil
 }
 
+// contain scales the active frame, or the region crop of it, within the specified output
+// canvas size and pads the remainder with padColor.
+func (o *ImageOps) contain(d Decoder, inputCanvasWidth, inputCanvasHeight int, crop image.Rectangle, outputCanvasWidth, outputCanvasHeight int, padColor color.NRGBA, resample resampling, isAnimated, hasAlpha bool) (bool, error) {
+	if isAnimated {
+		if err := o.setupAnimatedFrameBuffers(d, inputCanvasWidth, inputCanvasHeight, hasAlpha); err != nil {
+			return false, err
+		}
+
+		if err := o.savePreviousComposite(); err != nil {
+			return false, err
+		}
+
+		if err := o.applyBlendMethod(d); err != nil {
+			return false, err
+		}
+
+		src, release := cropped(o.animatedCompositeBuffer, crop)
+		err := src.contain(outputCanvasWidth, outputCanvasHeight, padColor, resample, o.secondary())
+		release()
+		if err != nil {
+			return false, err
+		}
+
+		if err := o.applyDisposeMethod(d); err != nil {
+			return false, err
+		}
+
+		o.copyFramePropertiesAndSwap()
+		return true, nil
+	}
+
+	src, release := cropped(o.active(), crop)
+	defer release()
+	if err := src.contain(outputCanvasWidth, outputCanvasHeight, padColor, resample, o.secondary()); err != nil {
+		return false, err
+	}
+	o.copyFramePropertiesAndSwap()
+
+	return true, nil
+}
+
+// defaultPadColor returns the padding color for output of fileType when
+// ImageOptions.PadColor is nil: transparent if the format can hold alpha, and
+// opaque black if not.
+func defaultPadColor(fileType string) color.NRGBA {
+	switch strings.ToLower(fileType) {
+	case ".png", ".webp", ".gif":
+		return color.NRGBA{}
+	}
+	return color.NRGBA{A: 255}
+}
+
+// fitWithinSize returns the size of an image scaled to fit within maxWidth and maxHeight,
+// preserving its aspect ratio. A maximum of 0 leaves that dimension unbounded. Images
+// which already fit keep their size unless upscale is set.
+func fitWithinSize(width, height, maxWidth, maxHeight int, upscale bool) (int, int) {
+	scale := math.Inf(1)
+	if maxWidth > 0 {
+		scale = math.Min(scale, float64(maxWidth)/float64(width))
+	}
+	if maxHeight > 0 {
+		scale = math.Min(scale, float64(maxHeight)/float64(height))
+	}
+	if math.IsInf(scale, 1) || (scale > 1 && !upscale) {
+		return width, height
+	}
+
+	newWidth := int(float64(width)*scale + 0.5)
+	if newWidth < 1 {
+		newWidth = 1
+	}
+	newHeight := int(float64(height)*scale + 0.5)
+	if newHeight < 1 {
+		newHeight = 1
+	}
+	return newWidth, newHeight
+}
+
 func calculateExpectedSize(origWidth, origHeight, reqWidth, reqHeight int) (int, int) {
 	if reqWidth == reqHeight && reqWidth > min(origWidth, origHeight) {
 		// Square resize request larger than smaller original dimension
@@ -260,19 +531,80 @@ func (o *ImageOps) skipToEnd(d Decoder) error {
 //
 // It is important that .Decode() not have been called already on d.
 func (o *ImageOps) Transform(d Decoder, opt *ImageOptions, dst []byte) ([]byte, error) {
-	defer func() {
-		if o.animatedCompositeBuffer != nil {
-			o.animatedCompositeBuffer.Close()
-			o.animatedCompositeBuffer = nil
+	return o.TransformContext(context.Background(), d, opt, dst)
+}
+
+// TransformContext performs the same transform as Transform, abandoning it once ctx is done.
+// Cancellation is checked between frames, and GIF, WebP and video codecs also poll for it
+// while decoding or encoding a frame. ctx.Err() is returned if the transform was abandoned.
+func (o *ImageOps) TransformContext(ctx context.Context, d Decoder, opt *ImageOptions, dst []byte) ([]byte, error) {
+	if ctx.Done() == nil {
+		return o.transform(ctx, d, opt, dst, nil)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	flag := newCancelFlag()
+	defer flag.release()
+
+	// the flag is set from another goroutine, which must exit before the flag is released
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			flag.cancel()
+		case <-stop:
 		}
 	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
 
-	inputHeader, enc, err := o.initializeTransform(d, opt, dst)
+	content, err := o.transform(ctx, d, opt, dst, flag)
+	if err != nil && ctx.Err() != nil {
+		// the codecs fail in their own ways when cancelled
+		return nil, ctx.Err()
+	}
+	return content, err
+}
+
+func (o *ImageOps) transform(ctx context.Context, d Decoder, opt *ImageOptions, dst []byte, flag *cancelFlag) ([]byte, error) {
+	defer o.closeAnimatedFrameBuffers()
+
+	o.outputWidth, o.outputHeight = 0, 0
+
+	var colors *colorTransform
+	if opt.ConvertToSRGB {
+		colors = newColorTransform(d.ICC())
+	}
+
+	inputHeader, enc, err := o.initializeTransform(d, opt, colors != nil, dst)
 	if err != nil {
 		return nil, err
 	}
 	defer enc.Close()
 
+	if flag != nil {
+		if c, ok := d.(cancellable); ok {
+			c.setCancelFlag(flag.ptr)
+			defer c.setCancelFlag(nil)
+		}
+		if c, ok := enc.(cancellable); ok {
+			c.setCancelFlag(flag.ptr)
+		}
+	}
+
+	if s, ok := d.(VideoSeeker); ok && opt.VideoFrameSamples > 0 {
+		// videos which cannot be sampled start from their first frame
+		if err = s.SeekToRepresentativeFrame(opt.VideoFrameSamples); err != nil && err != ErrSeekNotSupported {
+			return nil, err
+		}
+	}
+
 	frameCount := 0
 	duration := time.Duration(0)
 	encodeTimeoutTime := time.Now().Add(opt.EncodeTimeout)
@@ -289,6 +621,10 @@ func (o *ImageOps) Transform(d Decoder, opt *ImageOptions, dst []byte) ([]byte,
 			emptyFrame = true
 		}
 
+		if colors != nil && !emptyFrame {
+			o.active().transformToSRGB(colors)
+		}
+
 		duration += o.active().Duration()
 
 		if opt.MaxEncodeDuration != 0 && duration > opt.MaxEncodeDuration {
@@ -310,6 +646,10 @@ func (o *ImageOps) Transform(d Decoder, opt *ImageOptions, dst []byte) ([]byte,
 			}
 		}
 
+		if frameCount == 0 && !emptyFrame {
+			o.outputWidth, o.outputHeight = o.active().Width(), o.active().Height()
+		}
+
 		// encode the frame to the output buffer
 		var content []byte
 		if emptyFrame {
@@ -346,6 +686,10 @@ func (o *ImageOps) Transform(d Decoder, opt *ImageOptions, dst []byte) ([]byte,
 			return nil, ErrEncodeTimeout
 		}
 
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		// for mulitple frames/gifs we need the decoded frame to be active again
 		if swapped {
 			o.swap()
@@ -353,38 +697,107 @@ func (o *ImageOps) Transform(d Decoder, opt *ImageOptions, dst []byte) ([]byte,
 	}
 }
 
+// TransformToWriter performs the same transform as Transform but writes the
+// resulting image to w. Output buffers grow as needed and are kept for reuse
+// by later calls.
+func (o *ImageOps) TransformToWriter(d Decoder, opt *ImageOptions, w io.Writer) error {
+	if o.writerBuf == nil {
+		o.writerBuf = make([]byte, 0, defaultWriterBufSize)
+	}
+
+	growOpt := *opt
+	growOpt.GrowDestination = true
+	content, err := o.Transform(d, &growOpt, o.writerBuf)
+	if err != nil {
+		return err
+	}
+
+	if cap(content) > cap(o.writerBuf) {
+		o.writerBuf = content[:0]
+	}
+
+	_, err = w.Write(content)
+	return err
+}
+
 // transformCurrentFrame transforms the current frame using the decoder specified by d.
 // It returns true if the frame was resized and false if it was not.
 // It returns an error if the frame could not be resized.
 func (o *ImageOps) transformCurrentFrame(d Decoder, opt *ImageOptions, inputHeader *ImageHeader, frameCount int) (bool, error) {
-	if opt.ResizeMethod == ImageOpsNoResize && !inputHeader.IsAnimated() {
+	crop, err := o.cropRect(opt, inputHeader)
+	if err != nil {
+		return false, err
+	}
+
+	if opt.ResizeMethod == ImageOpsNoResize && !inputHeader.IsAnimated() && crop.Empty() {
 		return false, nil
 	}
 
 	outputWidth, outputHeight := opt.Width, opt.Height
 	if opt.ResizeMethod == ImageOpsNoResize {
 		outputWidth, outputHeight = inputHeader.Width(), inputHeader.Height()
+		if !crop.Empty() {
+			outputWidth, outputHeight = crop.Dx(), crop.Dy()
+		}
+	}
+
+	if opt.ResizeMethod == ImageOpsFitWithin {
+		// the active frame has already been rotated to its normalized orientation
+		srcWidth, srcHeight := o.active().Width(), o.active().Height()
+		if inputHeader.IsAnimated() {
+			srcWidth, srcHeight = inputHeader.Width(), inputHeader.Height()
+		}
+		if !crop.Empty() {
+			srcWidth, srcHeight = crop.Dx(), crop.Dy()
+		}
+		outputWidth, outputHeight = fitWithinSize(srcWidth, srcHeight, opt.Width, opt.Height, opt.Upscale)
+	}
+
+	resample := resampling{filter: opt.ResampleFilter, linearLight: opt.LinearLight}
+
+	focalPoint := opt.Gravity.FocalPoint()
+	if opt.FocalPoint != nil {
+		focalPoint = *opt.FocalPoint
 	}
 
 	switch opt.ResizeMethod {
 	case ImageOpsFit, ImageOpsNoResize:
-		return o.fit(d, inputHeader.Width(), inputHeader.Height(), outputWidth, outputHeight, inputHeader.IsAnimated(), inputHeader.HasAlpha())
-	case ImageOpsResize:
-		return o.resize(d, inputHeader.Width(), inputHeader.Height(), outputWidth, outputHeight, frameCount, inputHeader.IsAnimated(), inputHeader.HasAlpha())
+		return o.fit(d, inputHeader.Width(), inputHeader.Height(), crop, focalPoint, outputWidth, outputHeight, resample, inputHeader.IsAnimated(), inputHeader.HasAlpha())
+	case ImageOpsResize, ImageOpsFitWithin:
+		return o.resize(d, inputHeader.Width(), inputHeader.Height(), crop, outputWidth, outputHeight, frameCount, resample, inputHeader.IsAnimated(), inputHeader.HasAlpha())
+	case ImageOpsContain:
+		padColor := defaultPadColor(opt.FileType)
+		if opt.PadColor != nil {
+			padColor = *opt.PadColor
+		}
+		return o.contain(d, inputHeader.Width(), inputHeader.Height(), crop, outputWidth, outputHeight, padColor, resample, inputHeader.IsAnimated(), inputHeader.HasAlpha())
 	default:
 		return false, fmt.Errorf("unknown resize method: %v", opt.ResizeMethod)
 	}
 }
 
-// initializeTransform initializes the transform process.
+// initializeTransform initializes the transform process. The ICC profile of d
+// is embedded in the output unless stripped, or if convertedToSRGB, when it no
+// longer describes the pixels. The metadata of d is filtered by opt.Metadata.
 // It returns the image header, encoder, and error.
-func (o *ImageOps) initializeTransform(d Decoder, opt *ImageOptions, dst []byte) (*ImageHeader, Encoder, error) {
+func (o *ImageOps) initializeTransform(d Decoder, opt *ImageOptions, convertedToSRGB bool, dst []byte) (*ImageHeader, Encoder, error) {
 	inputHeader, err := d.Header()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	enc, err := NewEncoder(opt.FileType, d, dst)
+	md := encodeMetadata{
+		icc:               d.ICC(),
+		exif:              filterEXIF(decodedEXIF(d), opt.Metadata),
+		xmp:               filterXMP(decodedXMP(d), opt.Metadata),
+		keepGIFExtensions: opt.Metadata != MetadataStrip,
+	}
+	md.keepGIFXMP = opt.Metadata == MetadataDefault || opt.Metadata == MetadataKeep || len(md.xmp) > 0
+	if convertedToSRGB || opt.StripICCProfile {
+		md.icc = nil
+	}
+
+	enc, err := newEncoder(opt.FileType, d, md, dst, opt.GrowDestination)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -398,12 +811,34 @@ func (o *ImageOps) applyDisposeMethod(d Decoder) error {
 	case DisposeToBackgroundColor:
 		rect := image.Rect(active.xOffset, active.yOffset, active.xOffset+active.Width(), active.yOffset+active.Height())
 		return o.animatedCompositeBuffer.ClearToTransparent(rect)
+	case DisposeToPrevious:
+		rect := image.Rect(0, 0, o.previousCompositeBuffer.Width(), o.previousCompositeBuffer.Height())
+		return o.animatedCompositeBuffer.CopyToOffsetNoBlend(o.previousCompositeBuffer, rect)
 	case NoDispose:
 		// Do nothing
 	}
 	return nil
 }
 
+// savePreviousComposite copies the composite canvas aside when the active frame
+// must be disposed by restoring the canvas to its state before the frame was drawn.
+func (o *ImageOps) savePreviousComposite() error {
+	if o.active().dispose != DisposeToPrevious {
+		return nil
+	}
+
+	width, height := o.animatedCompositeBuffer.Width(), o.animatedCompositeBuffer.Height()
+	if o.previousCompositeBuffer == nil {
+		o.previousCompositeBuffer = NewFramebuffer(width, height)
+	}
+	if err := o.previousCompositeBuffer.resizeMat(width, height, o.animatedCompositeBuffer.PixelType()); err != nil {
+		return err
+	}
+
+	rect := image.Rect(0, 0, width, height)
+	return o.previousCompositeBuffer.CopyToOffsetNoBlend(o.animatedCompositeBuffer, rect)
+}
+
 func (o *ImageOps) applyBlendMethod(d Decoder) error {
 	active := o.active()
 	rect := image.Rect(
@@ -428,5 +863,10 @@ func (o *ImageOps) copyFramePropertiesAndSwap() {
 	o.secondary().duration = o.active().duration
 	o.secondary().dispose = o.active().dispose
 	o.secondary().blend = o.active().blend
+	if o.secondary().dispose == DisposeToPrevious {
+		// the composite has already been restored, and encoders only
+		// support disposing to the background
+		o.secondary().dispose = DisposeToBackgroundColor
+	}
 	o.swap()
 }
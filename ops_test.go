@@ -0,0 +1,705 @@
+package lilliput
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTransform_GrowDestination(t *testing.T) {
+	tests := []struct {
+		name           string
+		sourceFilePath string
+		fileType       string
+	}{
+		{"JPEG", "testdata/ferry_sunset.jpg", ".jpeg"},
+		{"PNG", "testdata/ferry_sunset.png", ".png"},
+		{"WebP", "testdata/ferry_sunset.jpg", ".webp"},
+		{"Animated GIF", "testdata/party-discord.gif", ".gif"},
+		{"Animated WebP", "testdata/party-discord.webp", ".webp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testData, err := os.ReadFile(tt.sourceFilePath)
+			if err != nil {
+				t.Fatalf("Failed to read test file: %v", err)
+			}
+
+			ops := NewImageOps(2048)
+			defer ops.Close()
+
+			options := &ImageOptions{
+				FileType:      tt.fileType,
+				ResizeMethod:  ImageOpsNoResize,
+				EncodeTimeout: time.Second * 10,
+			}
+
+			decoder, err := NewDecoder(testData)
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+			if _, err = ops.Transform(decoder, options, make([]byte, 16)); err == nil {
+				t.Errorf("Expected a 16 byte destination to be too small")
+			}
+			decoder.Close()
+
+			decoder, err = NewDecoder(testData)
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+			defer decoder.Close()
+
+			options.GrowDestination = true
+			out, err := ops.Transform(decoder, options, make([]byte, 16))
+			if err != nil {
+				t.Fatalf("Transform with GrowDestination failed: %v", err)
+			}
+			if len(out) <= 16 {
+				t.Fatalf("Expected output larger than the destination, got %d bytes", len(out))
+			}
+
+			outDecoder, err := NewDecoder(out)
+			if err != nil {
+				t.Fatalf("Failed to decode grown output: %v", err)
+			}
+			outDecoder.Close()
+		})
+	}
+}
+
+func TestTransformToWriter(t *testing.T) {
+	testData, err := os.ReadFile("testdata/party-discord.gif")
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+
+	ops := NewImageOps(2048)
+	defer ops.Close()
+
+	// the second pass reuses the buffer grown by the first
+	for i := 0; i < 2; i++ {
+		decoder, err := NewDecoder(testData)
+		if err != nil {
+			t.Fatalf("NewDecoder failed: %v", err)
+		}
+
+		var buf bytes.Buffer
+		err = ops.TransformToWriter(decoder, &ImageOptions{
+			FileType:      ".webp",
+			Width:         64,
+			Height:        64,
+			ResizeMethod:  ImageOpsFit,
+			EncodeTimeout: time.Second * 10,
+		}, &buf)
+		decoder.Close()
+		if err != nil {
+			t.Fatalf("TransformToWriter failed: %v", err)
+		}
+
+		if !isWebp(buf.Bytes()) {
+			t.Errorf("Expected WebP output to be written")
+		}
+	}
+}
+
+func TestTransformContext(t *testing.T) {
+	testData, err := os.ReadFile("testdata/party-discord.gif")
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+
+	ops := NewImageOps(2048)
+	defer ops.Close()
+
+	options := &ImageOptions{
+		FileType:     ".webp",
+		Width:        64,
+		Height:       64,
+		ResizeMethod: ImageOpsFit,
+	}
+
+	decoder, err := NewDecoder(testData)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err = ops.TransformContext(ctx, decoder, options, make([]byte, 10*1024*1024)); err != nil {
+		t.Errorf("TransformContext failed: %v", err)
+	}
+	decoder.Close()
+
+	decoder, err = NewDecoder(testData)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	defer decoder.Close()
+	cancel()
+	if _, err = ops.TransformContext(ctx, decoder, options, make([]byte, 10*1024*1024)); err != context.Canceled {
+		t.Errorf("TransformContext error = %v, want context.Canceled", err)
+	}
+}
+
+func TestCancelFlag_StopsDecode(t *testing.T) {
+	tests := []struct {
+		name           string
+		sourceFilePath string
+	}{
+		{"GIF", "testdata/party-discord.gif"},
+		{"WebP", "testdata/ferry_sunset.webp"},
+		{"MP4", "testdata/big_buck_bunny_480p_10s_std.mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testData, err := os.ReadFile(tt.sourceFilePath)
+			if err != nil {
+				t.Fatalf("Failed to read test file: %v", err)
+			}
+
+			decoder, err := NewDecoder(testData)
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+			defer decoder.Close()
+
+			flag := newCancelFlag()
+			defer flag.release()
+			flag.cancel()
+
+			c, ok := decoder.(cancellable)
+			if !ok {
+				t.Fatalf("Expected %T to poll a cancel flag", decoder)
+			}
+			c.setCancelFlag(flag.ptr)
+			defer c.setCancelFlag(nil)
+
+			fb := NewFramebuffer(2048, 2048)
+			defer fb.Close()
+			if err = decoder.DecodeTo(fb); err == nil {
+				t.Errorf("Expected DecodeTo to fail once cancelled")
+			}
+		})
+	}
+}
+
+func TestTransform_Crop(t *testing.T) {
+	tests := []struct {
+		name           string
+		sourceFilePath string
+		fileType       string
+		resizeMethod   ImageOpsSizeMethod
+		width, height  int
+		crop           image.Rectangle
+		wantWidth      int
+		wantHeight     int
+		wantErr        error
+	}{
+		{"JPEG no resize", "testdata/ferry_sunset.jpg", ".png", ImageOpsNoResize, 0, 0, image.Rect(100, 50, 300, 250), 200, 200, nil},
+		{"JPEG fit", "testdata/ferry_sunset.jpg", ".jpeg", ImageOpsFit, 100, 100, image.Rect(100, 50, 300, 250), 100, 100, nil},
+		{"JPEG clipped", "testdata/ferry_sunset.jpg", ".png", ImageOpsNoResize, 0, 0, image.Rect(700, 200, 900, 400), 100, 97, nil},
+		{"JPEG outside", "testdata/ferry_sunset.jpg", ".png", ImageOpsNoResize, 0, 0, image.Rect(900, 0, 1000, 100), 0, 0, ErrInvalidCrop},
+		{"Animated GIF", "testdata/party-discord.gif", ".gif", ImageOpsNoResize, 0, 0, image.Rect(4, 2, 20, 16), 16, 14, nil},
+		{"Animated WebP resize", "testdata/party-discord.webp", ".webp", ImageOpsResize, 32, 32, image.Rect(4, 2, 20, 16), 32, 32, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testData, err := os.ReadFile(tt.sourceFilePath)
+			if err != nil {
+				t.Fatalf("Failed to read test file: %v", err)
+			}
+
+			decoder, err := NewDecoder(testData)
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+			defer decoder.Close()
+
+			ops := NewImageOps(2048)
+			defer ops.Close()
+
+			options := &ImageOptions{
+				FileType:     tt.fileType,
+				Width:        tt.width,
+				Height:       tt.height,
+				ResizeMethod: tt.resizeMethod,
+				Crop:         tt.crop,
+			}
+			out, err := ops.Transform(decoder, options, make([]byte, 10*1024*1024))
+			if err != tt.wantErr {
+				t.Fatalf("Transform error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			outDecoder, err := NewDecoder(out)
+			if err != nil {
+				t.Fatalf("Failed to decode output: %v", err)
+			}
+			defer outDecoder.Close()
+			header, err := outDecoder.Header()
+			if err != nil {
+				t.Fatalf("Header failed: %v", err)
+			}
+			if header.Width() != tt.wantWidth || header.Height() != tt.wantHeight {
+				t.Errorf("output size = %dx%d, want %dx%d", header.Width(), header.Height(), tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestTransform_Contain(t *testing.T) {
+	tests := []struct {
+		name           string
+		sourceFilePath string
+		fileType       string
+	}{
+		{"JPEG", "testdata/ferry_sunset.jpg", ".jpeg"},
+		{"PNG", "testdata/ferry_sunset.png", ".png"},
+		{"Animated GIF", "testdata/party-discord.gif", ".gif"},
+		{"Animated WebP", "testdata/party-discord.webp", ".webp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testData, err := os.ReadFile(tt.sourceFilePath)
+			if err != nil {
+				t.Fatalf("Failed to read test file: %v", err)
+			}
+
+			decoder, err := NewDecoder(testData)
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+			defer decoder.Close()
+
+			ops := NewImageOps(2048)
+			defer ops.Close()
+
+			options := &ImageOptions{
+				FileType:     tt.fileType,
+				Width:        200,
+				Height:       200,
+				ResizeMethod: ImageOpsContain,
+				PadColor:     &color.NRGBA{R: 255, G: 255, B: 255, A: 255},
+			}
+			out, err := ops.Transform(decoder, options, make([]byte, 10*1024*1024))
+			if err != nil {
+				t.Fatalf("Transform failed: %v", err)
+			}
+
+			outDecoder, err := NewDecoder(out)
+			if err != nil {
+				t.Fatalf("Failed to decode output: %v", err)
+			}
+			defer outDecoder.Close()
+			header, err := outDecoder.Header()
+			if err != nil {
+				t.Fatalf("Header failed: %v", err)
+			}
+			if header.Width() != 200 || header.Height() != 200 {
+				t.Errorf("output size = %dx%d, want 200x200", header.Width(), header.Height())
+			}
+		})
+	}
+}
+
+func TestDefaultPadColor(t *testing.T) {
+	tests := []struct {
+		fileType string
+		want     color.NRGBA
+	}{
+		{".png", color.NRGBA{}},
+		{".WEBP", color.NRGBA{}},
+		{".gif", color.NRGBA{}},
+		{".jpeg", color.NRGBA{A: 255}},
+		{".jpg", color.NRGBA{A: 255}},
+	}
+	for _, tt := range tests {
+		if got := defaultPadColor(tt.fileType); got != tt.want {
+			t.Errorf("defaultPadColor(%q) = %v, want %v", tt.fileType, got, tt.want)
+		}
+	}
+}
+
+func TestFitWithinSize(t *testing.T) {
+	tests := []struct {
+		width, height, maxWidth, maxHeight int
+		upscale                            bool
+		wantWidth, wantHeight              int
+	}{
+		{800, 297, 400, 400, false, 400, 149},
+		{297, 800, 400, 400, false, 149, 400},
+		{800, 297, 1024, 1024, false, 800, 297},
+		{800, 297, 1024, 1024, true, 1024, 380},
+		{800, 297, 200, 0, false, 200, 74},
+		{800, 297, 0, 0, true, 800, 297},
+		{4000, 1, 100, 100, false, 100, 1},
+	}
+	for _, tt := range tests {
+		width, height := fitWithinSize(tt.width, tt.height, tt.maxWidth, tt.maxHeight, tt.upscale)
+		if width != tt.wantWidth || height != tt.wantHeight {
+			t.Errorf("fitWithinSize(%d, %d, %d, %d, %v) = %dx%d, want %dx%d", tt.width, tt.height, tt.maxWidth, tt.maxHeight, tt.upscale, width, height, tt.wantWidth, tt.wantHeight)
+		}
+	}
+}
+
+func TestTransform_FitWithin(t *testing.T) {
+	tests := []struct {
+		name           string
+		sourceFilePath string
+		fileType       string
+		width, height  int
+		upscale        bool
+		wantWidth      int
+		wantHeight     int
+	}{
+		{"JPEG", "testdata/ferry_sunset.jpg", ".jpeg", 400, 400, false, 400, 149},
+		{"JPEG no upscale", "testdata/ferry_sunset.jpg", ".jpeg", 1024, 1024, false, 800, 297},
+		{"Animated GIF upscale", "testdata/party-discord.gif", ".gif", 56, 0, true, 56, 36},
+		{"Animated WebP", "testdata/party-discord.webp", ".webp", 56, 0, false, 27, 17},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testData, err := os.ReadFile(tt.sourceFilePath)
+			if err != nil {
+				t.Fatalf("Failed to read test file: %v", err)
+			}
+
+			decoder, err := NewDecoder(testData)
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+			defer decoder.Close()
+
+			ops := NewImageOps(2048)
+			defer ops.Close()
+
+			options := &ImageOptions{
+				FileType:     tt.fileType,
+				Width:        tt.width,
+				Height:       tt.height,
+				ResizeMethod: ImageOpsFitWithin,
+				Upscale:      tt.upscale,
+			}
+			out, err := ops.Transform(decoder, options, make([]byte, 10*1024*1024))
+			if err != nil {
+				t.Fatalf("Transform failed: %v", err)
+			}
+
+			if width, height := ops.OutputSize(); width != tt.wantWidth || height != tt.wantHeight {
+				t.Errorf("OutputSize() = %dx%d, want %dx%d", width, height, tt.wantWidth, tt.wantHeight)
+			}
+
+			outDecoder, err := NewDecoder(out)
+			if err != nil {
+				t.Fatalf("Failed to decode output: %v", err)
+			}
+			defer outDecoder.Close()
+			header, err := outDecoder.Header()
+			if err != nil {
+				t.Fatalf("Header failed: %v", err)
+			}
+			if header.Width() != tt.wantWidth || header.Height() != tt.wantHeight {
+				t.Errorf("output size = %dx%d, want %dx%d", header.Width(), header.Height(), tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestTransform_LinearLight(t *testing.T) {
+	for _, sourceFilePath := range []string{"testdata/ferry_sunset.jpg", "testdata/party-discord.gif"} {
+		testData, err := os.ReadFile(sourceFilePath)
+		if err != nil {
+			t.Fatalf("Failed to read test file: %v", err)
+		}
+
+		decoder, err := NewDecoder(testData)
+		if err != nil {
+			t.Fatalf("NewDecoder failed: %v", err)
+		}
+
+		ops := NewImageOps(2048)
+		options := &ImageOptions{
+			FileType:     ".webp",
+			Width:        16,
+			Height:       16,
+			ResizeMethod: ImageOpsFit,
+			LinearLight:  true,
+		}
+		if _, err = ops.Transform(decoder, options, make([]byte, 10*1024*1024)); err != nil {
+			t.Errorf("Transform of %s failed: %v", sourceFilePath, err)
+		}
+		if width, height := ops.OutputSize(); width != 16 || height != 16 {
+			t.Errorf("Transform of %s produced %dx%d, want 16x16", sourceFilePath, width, height)
+		}
+		ops.Close()
+		decoder.Close()
+	}
+}
+
+func TestTransform_ConvertToSRGB(t *testing.T) {
+	// ferry_sunset.jpg is tagged with a Display P3 profile
+	testData, err := os.ReadFile("testdata/ferry_sunset.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+
+	for _, convert := range []bool{false, true} {
+		decoder, err := NewDecoder(testData)
+		if err != nil {
+			t.Fatalf("NewDecoder failed: %v", err)
+		}
+
+		ops := NewImageOps(2048)
+		options := &ImageOptions{
+			FileType:      ".webp",
+			Width:         64,
+			Height:        64,
+			ResizeMethod:  ImageOpsFit,
+			ConvertToSRGB: convert,
+		}
+		output, err := ops.Transform(decoder, options, make([]byte, 10*1024*1024))
+		if err != nil {
+			t.Fatalf("Transform failed: %v", err)
+		}
+		ops.Close()
+		decoder.Close()
+
+		outputDecoder, err := NewDecoder(output)
+		if err != nil {
+			t.Fatalf("NewDecoder of the output failed: %v", err)
+		}
+		// the source profile no longer describes converted pixels
+		if hasICC := len(outputDecoder.ICC()) > 0; hasICC == convert {
+			t.Errorf("ConvertToSRGB %v: output has ICC profile %v", convert, hasICC)
+		}
+		outputDecoder.Close()
+	}
+}
+
+func TestTransform_ICCProfile(t *testing.T) {
+	testData, err := os.ReadFile("testdata/ferry_sunset.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+
+	for _, fileType := range []string{".jpeg", ".png", ".webp"} {
+		for _, strip := range []bool{false, true} {
+			decoder, err := NewDecoder(testData)
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+			sourceICC := decoder.ICC()
+
+			ops := NewImageOps(2048)
+			options := &ImageOptions{
+				FileType:        fileType,
+				Width:           64,
+				Height:          64,
+				ResizeMethod:    ImageOpsFit,
+				StripICCProfile: strip,
+			}
+			output, err := ops.Transform(decoder, options, make([]byte, 10*1024*1024))
+			if err != nil {
+				t.Fatalf("Transform to %s failed: %v", fileType, err)
+			}
+			ops.Close()
+			decoder.Close()
+
+			outputDecoder, err := NewDecoder(output)
+			if err != nil {
+				t.Fatalf("NewDecoder of the %s output failed: %v", fileType, err)
+			}
+			outputICC := outputDecoder.ICC()
+			if strip && len(outputICC) > 0 {
+				t.Errorf("Expected %s output without an ICC profile", fileType)
+			}
+			if !strip && !bytes.Equal(outputICC, sourceICC) {
+				t.Errorf("Expected %s output to carry the %d byte source profile, got %d bytes", fileType, len(sourceICC), len(outputICC))
+			}
+			outputDecoder.Close()
+		}
+	}
+}
+
+func TestTransform_Metadata(t *testing.T) {
+	testData, err := os.ReadFile("testdata/ferry_sunset.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+
+	// give the source a location, a serial number, a rotation and XMP
+	exif := makeTestEXIF(
+		testEXIFASCII(EXIFTagMake, "Apple"),
+		testEXIFShort(EXIFTagOrientation, 6),
+		testEXIFEntry{id: EXIFTagExifIFDPointer, children: []testEXIFEntry{
+			testEXIFASCII(EXIFTagBodySerialNumber, "C39XK1ABCDEF"),
+		}},
+		testEXIFEntry{id: EXIFTagGPSIFDPointer, children: []testEXIFEntry{
+			testEXIFASCII(EXIFTagGPSLatitudeRef, "N"),
+			testEXIFRationals(EXIFTagGPSLatitude, 37, 1, 46, 1, 3000, 100),
+			testEXIFASCII(EXIFTagGPSLongitudeRef, "W"),
+			testEXIFRationals(EXIFTagGPSLongitude, 122, 1, 25, 1, 1200, 100),
+		}},
+	)
+	testData, err = embedMetadata(testData, ".jpeg", encodeMetadata{exif: exif, xmp: testXMP}, true)
+	if err != nil {
+		t.Fatalf("Failed to add metadata to the test file: %v", err)
+	}
+
+	for _, fileType := range []string{".jpeg", ".png", ".webp"} {
+		for _, policy := range []MetadataPolicy{MetadataDefault, MetadataStrip, MetadataKeep, MetadataKeepSafe} {
+			decoder, err := NewDecoder(testData)
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+
+			ops := NewImageOps(2048)
+			options := &ImageOptions{
+				FileType:     fileType,
+				Width:        64,
+				Height:       64,
+				ResizeMethod: ImageOpsFit,
+				Metadata:     policy,
+			}
+			output, err := ops.Transform(decoder, options, make([]byte, 10*1024*1024))
+			if err != nil {
+				t.Fatalf("Transform to %s failed: %v", fileType, err)
+			}
+			ops.Close()
+			decoder.Close()
+
+			outputDecoder, err := NewDecoder(output)
+			if err != nil {
+				t.Fatalf("NewDecoder of the %s output failed: %v", fileType, err)
+			}
+			outputEXIF := outputDecoder.(MetadataDecoder).EXIF()
+			outputXMP := outputDecoder.(MetadataDecoder).XMP()
+			outputDecoder.Close()
+
+			if policy == MetadataDefault || policy == MetadataStrip {
+				if len(outputEXIF) > 0 || len(outputXMP) > 0 {
+					t.Errorf("Expected %s output without EXIF data or XMP", fileType)
+				}
+				continue
+			}
+			if !bytes.Equal(outputXMP, testXMP) {
+				t.Errorf("%s output XMP = %q, want %q", fileType, outputXMP, testXMP)
+			}
+
+			parsed, err := ParseEXIF(outputEXIF)
+			if err != nil {
+				t.Fatalf("ParseEXIF of the %s output failed: %v", fileType, err)
+			}
+			if parsed.Make() != "Apple" {
+				t.Errorf("%s output has make %q, want Apple", fileType, parsed.Make())
+			}
+			if parsed.Orientation() != OrientationTopLeft {
+				t.Errorf("%s output has orientation %d, want %d", fileType, parsed.Orientation(), OrientationTopLeft)
+			}
+			_, _, hasGPS := parsed.GPS()
+			_, hasSerial := parsed.Tag(EXIFIFDExif, EXIFTagBodySerialNumber)
+			if keep := policy == MetadataKeep; hasGPS != keep || hasSerial != keep {
+				t.Errorf("%s output with policy %d has location %v and serial number %v, want %v", fileType, policy, hasGPS, hasSerial, keep)
+			}
+		}
+	}
+}
+
+func TestTransform_AnimatedVideo(t *testing.T) {
+	testData, err := os.ReadFile("testdata/big_buck_bunny_480p_10s_std.mp4")
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+
+	decoder, err := NewDecoder(testData)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	defer decoder.Close()
+	decoder.(VideoAnimator).DecodeFrames(10)
+
+	ops := NewImageOps(1024)
+	defer ops.Close()
+	options := &ImageOptions{
+		FileType:          ".webp",
+		Width:             160,
+		Height:            90,
+		ResizeMethod:      ImageOpsFit,
+		MaxEncodeDuration: 2 * time.Second,
+	}
+	output, err := ops.Transform(decoder, options, make([]byte, 10*1024*1024))
+	if err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+
+	outputDecoder, err := NewDecoder(output)
+	if err != nil {
+		t.Fatalf("NewDecoder of the output failed: %v", err)
+	}
+	defer outputDecoder.Close()
+	header, err := outputDecoder.Header()
+	if err != nil {
+		t.Fatalf("Header failed: %v", err)
+	}
+	if !header.IsAnimated() || header.Width() != 160 || header.Height() != 90 {
+		t.Fatalf("Expected an animated 160x90 WebP, got %dx%d with %d frames", header.Width(), header.Height(), header.numFrames)
+	}
+
+	// the frames kept at 10fps cover the first two seconds
+	fb := NewFramebuffer(1024, 1024)
+	defer fb.Close()
+	var total time.Duration
+	frames := 0
+	for outputDecoder.DecodeTo(fb) == nil {
+		total += fb.Duration()
+		frames++
+	}
+	if frames < 15 || frames > 20 || total < 1500*time.Millisecond || total > 2*time.Second {
+		t.Errorf("Expected about 20 frames lasting 2s, got %d lasting %v", frames, total)
+	}
+}
+
+func TestTransform_VideoFrameSamples(t *testing.T) {
+	testData, err := os.ReadFile("testdata/big_buck_bunny_480p_10s_std.mp4")
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+
+	tones := make(map[int]int)
+	for _, samples := range []int{0, 5} {
+		decoder, err := NewDecoder(testData)
+		if err != nil {
+			t.Fatalf("NewDecoder failed: %v", err)
+		}
+		ops := NewImageOps(1024)
+		options := &ImageOptions{
+			FileType:          ".png",
+			Width:             160,
+			Height:            90,
+			ResizeMethod:      ImageOpsFit,
+			VideoFrameSamples: samples,
+		}
+		output, err := ops.Transform(decoder, options, make([]byte, 10*1024*1024))
+		if err != nil {
+			t.Fatalf("Transform with %d samples failed: %v", samples, err)
+		}
+		ops.Close()
+		decoder.Close()
+
+		img, err := png.Decode(bytes.NewReader(output))
+		if err != nil {
+			t.Fatalf("png.Decode failed: %v", err)
+		}
+		tones[samples] = countTestTones(img)
+	}
+
+	if tones[5] <= tones[0] {
+		t.Errorf("Expected the sampled frame to have more tones than the first frame, got %d and %d", tones[5], tones[0])
+	}
+}
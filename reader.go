@@ -0,0 +1,86 @@
+package lilliput
+
+// #include <stdint.h>
+import "C"
+
+import (
+	"io"
+	"sync"
+	"unsafe"
+)
+
+// maxEmptyReads is how many reads may return neither data nor an error before
+// the reader is treated as failing, as bufio does
+const maxEmptyReads = 100
+
+// C cannot hold Go pointers, so readers streamed by avcodec are looked up
+// through the handle it was given instead
+var (
+	readersMu  sync.Mutex
+	readers    = map[uintptr]io.ReadSeeker{}
+	nextReader uintptr
+)
+
+func registerReader(r io.ReadSeeker) uintptr {
+	readersMu.Lock()
+	defer readersMu.Unlock()
+	nextReader++
+	readers[nextReader] = r
+	return nextReader
+}
+
+func unregisterReader(handle uintptr) {
+	readersMu.Lock()
+	defer readersMu.Unlock()
+	delete(readers, handle)
+}
+
+func lookupReader(handle uintptr) io.ReadSeeker {
+	readersMu.Lock()
+	defer readersMu.Unlock()
+	return readers[handle]
+}
+
+// avcodecReaderRead fills buf from the reader, returning 0 at the end of the
+// content and -1 on error
+//
+//export avcodecReaderRead
+func avcodecReaderRead(handle C.uintptr_t, buf *C.uint8_t, bufSize C.int) C.int {
+	r := lookupReader(uintptr(handle))
+	if r == nil || bufSize <= 0 {
+		return -1
+	}
+
+	dst := (*[1 << 30]byte)(unsafe.Pointer(buf))[:bufSize:bufSize]
+	n, err := r.Read(dst)
+	for i := 1; n == 0 && err == nil; i++ {
+		if i == maxEmptyReads {
+			return -1
+		}
+		n, err = r.Read(dst)
+	}
+	if n > 0 {
+		return C.int(n)
+	}
+	if err == io.EOF {
+		return 0
+	}
+	return -1
+}
+
+// avcodecReaderSeek seeks the reader, returning the new offset or -1 on error
+//
+//export avcodecReaderSeek
+func avcodecReaderSeek(handle C.uintptr_t, offset C.int64_t, whence C.int) C.int64_t {
+	r := lookupReader(uintptr(handle))
+	if r == nil {
+		return -1
+	}
+
+	// SEEK_SET, SEEK_CUR and SEEK_END share their values with io.Seek*
+	pos, err := r.Seek(int64(offset), int(whence))
+	if err != nil {
+		return -1
+	}
+	return C.int64_t(pos)
+}
@@ -23,12 +23,18 @@ struct webp_decoder_struct {
     WebPMuxAnimBlend prev_frame_blend;
     uint8_t* decode_buffer;
     size_t decode_buffer_size;
+    // set from Go to abandon a frame part way through
+    const int* cancel_flag;
 };
 
 struct webp_encoder_struct {
     // input fields
     const uint8_t* icc;
     size_t icc_len;
+    const uint8_t* exif;
+    size_t exif_len;
+    const uint8_t* xmp;
+    size_t xmp_len;
     uint32_t bgcolor;
     uint32_t loop_count;
 
@@ -42,8 +48,22 @@ struct webp_encoder_struct {
     int first_frame_y_offset;
     uint8_t* dst;
     size_t dst_len;
+    bool growable;
+    // assembled output that did not fit in dst, kept when growable
+    WebPData overflow;
+    // set from Go to abandon a frame part way through
+    const int* cancel_flag;
 };
 
+// bitstreams are fed to the incremental decoder in chunks of this size
+// so that cancellation is noticed between them
+#define WEBP_DECODE_CHUNK_SIZE (64 * 1024)
+
+static bool webp_is_cancelled(const int* cancel_flag)
+{
+    return cancel_flag && __atomic_load_n(cancel_flag, __ATOMIC_RELAXED);
+}
+
 /**
  * Creates a WebP decoder from the given OpenCV matrix.
  * @param buf The input OpenCV matrix containing the WebP image data.
@@ -118,6 +138,16 @@ webp_decoder webp_decoder_create(const opencv_mat buf)
     return d;
 }
 
+/**
+ * Sets a flag which, once set to non-zero, abandons the frame being decoded.
+ * @param d The webp_decoder_struct pointer.
+ * @param cancel_flag The flag to poll, or nullptr to stop polling.
+ */
+void webp_decoder_set_cancel_flag(webp_decoder d, const int* cancel_flag)
+{
+    d->cancel_flag = cancel_flag;
+}
+
 /**
  * Gets the width of the WebP image.
  * @param d The webp_decoder_struct pointer.
@@ -267,6 +297,36 @@ void webp_decoder_advance_frame(webp_decoder d)
     d->current_frame_index++;
 }
 
+/**
+ * Decodes a frame bitstream into the decode buffer, polling the cancel flag between chunks.
+ * @param d The webp_decoder_struct pointer.
+ * @param bitstream The frame bitstream.
+ * @param mode The colorspace to decode into.
+ * @param row_size The stride of the decoded rows.
+ * @return The decode buffer, or nullptr if decoding failed or was cancelled.
+ */
+static uint8_t* webp_decoder_decode_cancellable(const webp_decoder d, const WebPData* bitstream, WEBP_CSP_MODE mode, int row_size)
+{
+    WebPIDecoder* idec = WebPINewRGB(mode, d->decode_buffer, d->decode_buffer_size, row_size);
+    if (!idec) {
+        return nullptr;
+    }
+
+    VP8StatusCode status = VP8_STATUS_SUSPENDED;
+    size_t offset = 0;
+    while (status == VP8_STATUS_SUSPENDED && offset < bitstream->size) {
+        if (webp_is_cancelled(d->cancel_flag)) {
+            break;
+        }
+        size_t chunk_size = std::min((size_t)WEBP_DECODE_CHUNK_SIZE, bitstream->size - offset);
+        status = WebPIAppend(idec, bitstream->bytes + offset, chunk_size);
+        offset += chunk_size;
+    }
+
+    WebPIDelete(idec);
+    return status == VP8_STATUS_OK ? d->decode_buffer : nullptr;
+}
+
 /**
  * Decodes the current frame of the WebP image and stores the decoded image in the provided OpenCV matrix.
  * @param d The webp_decoder_struct pointer.
@@ -310,12 +370,20 @@ bool webp_decoder_decode(const webp_decoder d, opencv_mat mat)
     uint8_t* res = nullptr;
     switch (webp_decoder_get_pixel_type(d)) {
         case CV_8UC4:
-            res = WebPDecodeBGRAInto(frame.bitstream.bytes, frame.bitstream.size,
-                                     d->decode_buffer, d->decode_buffer_size, row_size);
+            if (d->cancel_flag) {
+                res = webp_decoder_decode_cancellable(d, &frame.bitstream, MODE_BGRA, row_size);
+            } else {
+                res = WebPDecodeBGRAInto(frame.bitstream.bytes, frame.bitstream.size,
+                                         d->decode_buffer, d->decode_buffer_size, row_size);
+            }
             break;
         case CV_8UC3:
-            res = WebPDecodeBGRInto(frame.bitstream.bytes, frame.bitstream.size,
-                                d->decode_buffer, d->decode_buffer_size, row_size);
+            if (d->cancel_flag) {
+                res = webp_decoder_decode_cancellable(d, &frame.bitstream, MODE_BGR, row_size);
+            } else {
+                res = WebPDecodeBGRInto(frame.bitstream.bytes, frame.bitstream.size,
+                                    d->decode_buffer, d->decode_buffer_size, row_size);
+            }
             break;
         default:
             return false;
@@ -348,10 +416,16 @@ void webp_decoder_release(webp_decoder d)
  * @param buf_len The size of the output buffer.
  * @param icc The ICC profile data.
  * @param icc_len The size of the ICC profile data.
+ * @param exif The EXIF metadata.
+ * @param exif_len The size of the EXIF metadata.
+ * @param xmp The XMP packet.
+ * @param xmp_len The size of the XMP packet.
  * @param bgcolor The background color for the WebP image.
+ * @param loop_count The number of times the animation loops.
+ * @param growable Whether output larger than buf is kept by the encoder instead of failing.
  * @return A pointer to the created webp_encoder_struct, or nullptr if creation failed.
  */
-webp_encoder webp_encoder_create(void* buf, size_t buf_len, const void* icc, size_t icc_len, uint32_t bgcolor, int loop_count)
+webp_encoder webp_encoder_create(void* buf, size_t buf_len, const void* icc, size_t icc_len, const void* exif, size_t exif_len, const void* xmp, size_t xmp_len, uint32_t bgcolor, int loop_count, bool growable)
 {
     webp_encoder e = new struct webp_encoder_struct();
     memset(e, 0, sizeof(struct webp_encoder_struct));
@@ -362,13 +436,121 @@ webp_encoder webp_encoder_create(void* buf, size_t buf_len, const void* icc, siz
     e->first_frame_delay = 0;
     e->bgcolor = bgcolor;
     e->loop_count = loop_count;
+    e->growable = growable;
     if (icc_len) {
         e->icc = (const uint8_t*)(icc);
         e->icc_len = icc_len;
     }
+    if (exif_len) {
+        e->exif = (const uint8_t*)(exif);
+        e->exif_len = exif_len;
+    }
+    if (xmp_len) {
+        e->xmp = (const uint8_t*)(xmp);
+        e->xmp_len = xmp_len;
+    }
     return e;
 }
 
+/**
+ * Sets a flag which, once set to non-zero, abandons the frame being encoded.
+ * @param e The webp_encoder_struct pointer.
+ * @param cancel_flag The flag to poll, or nullptr to stop polling.
+ */
+void webp_encoder_set_cancel_flag(webp_encoder e, const int* cancel_flag)
+{
+    e->cancel_flag = cancel_flag;
+}
+
+/**
+ * Reports encoding progress, aborting the encode once the encoder has been cancelled.
+ * @param percent The encoding progress.
+ * @param picture The picture being encoded, whose user_data is the encoder.
+ * @return 0 to abort the encode, 1 to continue.
+ */
+static int webp_encoder_progress(int percent, const WebPPicture* picture)
+{
+    auto e = static_cast<const webp_encoder>(picture->user_data);
+    return !webp_is_cancelled(e->cancel_flag);
+}
+
+/**
+ * Adds the ICC profile, EXIF metadata and XMP packet chunks, if any, to the mux object.
+ * @param e The webp_encoder_struct pointer.
+ * @return true if the chunks were added, false otherwise.
+ */
+static bool webp_encoder_set_metadata(webp_encoder e)
+{
+    if (e->icc && e->icc_len > 0) {
+        WebPData icc_data = { e->icc, e->icc_len };
+        if (WebPMuxSetChunk(e->mux, "ICCP", &icc_data, 1) != WEBP_MUX_OK) {
+            return false;
+        }
+    }
+    if (e->exif && e->exif_len > 0) {
+        WebPData exif_data = { e->exif, e->exif_len };
+        if (WebPMuxSetChunk(e->mux, "EXIF", &exif_data, 1) != WEBP_MUX_OK) {
+            return false;
+        }
+    }
+    if (e->xmp && e->xmp_len > 0) {
+        WebPData xmp_data = { e->xmp, e->xmp_len };
+        if (WebPMuxSetChunk(e->mux, "XMP ", &xmp_data, 1) != WEBP_MUX_OK) {
+            return false;
+        }
+    }
+    return true;
+}
+
+/**
+ * Encodes a BGR or BGRA matrix, equivalent to the WebPEncode(Lossless)BGR(A) functions
+ * but with a progress hook which allows the encode to be cancelled.
+ * @param e The webp_encoder_struct pointer.
+ * @param mat The matrix to encode.
+ * @param quality The encode quality, where values above 100 select lossless encoding.
+ * @param output Set to the encoded data, which must be freed with WebPFree.
+ * @return The size of the encoded data, or 0 if encoding failed.
+ */
+static size_t webp_encoder_encode_picture(const webp_encoder e, const cv::Mat* mat, float quality, uint8_t** output)
+{
+    bool lossless = quality > 100.0f;
+    WebPConfig config;
+    WebPPicture picture;
+    if (!WebPConfigPreset(&config, WEBP_PRESET_DEFAULT, lossless ? 70.0f : quality) ||
+        !WebPPictureInit(&picture)) {
+        return 0;
+    }
+
+    WebPMemoryWriter writer;
+    WebPMemoryWriterInit(&writer);
+    config.lossless = lossless;
+    picture.use_argb = lossless;
+    picture.width = mat->cols;
+    picture.height = mat->rows;
+    picture.writer = WebPMemoryWrite;
+    picture.custom_ptr = &writer;
+    picture.progress_hook = webp_encoder_progress;
+    picture.user_data = e;
+
+    int ok;
+    if (mat->channels() == 3) {
+        ok = WebPPictureImportBGR(&picture, mat->data, mat->step);
+    } else {
+        ok = WebPPictureImportBGRA(&picture, mat->data, mat->step);
+    }
+    ok = ok && WebPEncode(&config, &picture);
+    WebPPictureFree(&picture);
+
+    if (!ok) {
+        WebPMemoryWriterClear(&writer);
+        *output = nullptr;
+        return 0;
+    }
+
+    *output = writer.mem;
+    return writer.size;
+}
+
 /**
  * Encodes the given OpenCV matrix as a WebP image and writes the encoded data to the output buffer.
  * @param e The webp_encoder_struct pointer.
@@ -413,6 +595,12 @@ size_t webp_encoder_write(webp_encoder e, const opencv_mat src, const int* opt,
         if (out_mux.size < e->dst_len) {
             memcpy(e->dst, out_mux.bytes, out_mux.size);
             copied = out_mux.size;
+        } else if (e->growable) {
+            // hand the assembled data over instead of clearing it
+            e->overflow = out_mux;
+            out_mux.bytes = nullptr;
+            out_mux.size = 0;
+            copied = e->overflow.size;
         }
 
         WebPDataClear(&out_mux);
@@ -459,22 +647,8 @@ size_t webp_encoder_write(webp_encoder e, const opencv_mat src, const int* opt,
 
     // webp will always allocate a region for the compressed image
     // we will have to copy from it, then deallocate this region
-    size_t size = 0;
     uint8_t* out_picture = nullptr;
-
-    if (quality > 100.0f) {
-        if (mat->channels() == 3) {
-            size = WebPEncodeLosslessBGR(mat->data, mat->cols, mat->rows, mat->step, &out_picture);
-        } else {
-            size = WebPEncodeLosslessBGRA(mat->data, mat->cols, mat->rows, mat->step, &out_picture);
-        }
-    } else {
-        if (mat->channels() == 3) {
-            size = WebPEncodeBGR(mat->data, mat->cols, mat->rows, mat->step, quality, &out_picture);
-        } else {
-            size = WebPEncodeBGRA(mat->data, mat->cols, mat->rows, mat->step, quality, &out_picture);
-        }
-    }
+    size_t size = webp_encoder_encode_picture(e, mat, quality, &out_picture);
 
     if (size == 0) {
         // Failed to encode image
@@ -490,11 +664,8 @@ size_t webp_encoder_write(webp_encoder e, const opencv_mat src, const int* opt,
         e->first_frame_x_offset = x_offset;
         e->first_frame_y_offset = y_offset;
 
-        // Add ICC profile to the mux object
-        if (e->icc) {
-            WebPData icc_data = { e->icc, e->icc_len };
-            WebPMuxError mux_error = WebPMuxSetChunk(e->mux, "ICCP", &icc_data, 0);
-        }
+        // Add ICC profile, EXIF metadata and XMP packet to the mux object
+        webp_encoder_set_metadata(e);
 
         WebPMuxError mux_error = WebPMuxSetImage(e->mux, &picture, 1);
         if (mux_error != WEBP_MUX_OK) {
@@ -522,16 +693,12 @@ size_t webp_encoder_write(webp_encoder e, const opencv_mat src, const int* opt,
             WebPMuxDelete(e->mux);
             e->mux = WebPMuxNew();
 
-            // Set the ICC profile if it exists
-            if (e->icc && e->icc_len > 0) {
-                WebPData icc_data = { e->icc, e->icc_len };
-                WebPMuxError mux_error = WebPMuxSetChunk(e->mux, "ICCP", &icc_data, 1);
-                if (mux_error != WEBP_MUX_OK) {
-                    if (out_picture) {
-                        WebPFree(out_picture);
-                    }
-                    return 0;
+            // Set the ICC profile, EXIF metadata and XMP packet if they exist
+            if (!webp_encoder_set_metadata(e)) {
+                if (out_picture) {
+                    WebPFree(out_picture);
                 }
+                return 0;
             }
 
             // Set animation parameters
@@ -603,6 +770,7 @@ void webp_encoder_release(webp_encoder e)
         if (e->mux) {
             WebPMuxDelete(e->mux);
         }
+        WebPDataClear(&e->overflow);
         delete e;
     }
 }
@@ -615,4 +783,18 @@ void webp_encoder_release(webp_encoder e)
 size_t webp_encoder_flush(webp_encoder e)
 {
     return webp_encoder_write(e, nullptr, nullptr, 0, 0, 0, 0, 0, 0);
+}
+
+/**
+ * Returns the finalized WebP data, which is either the output buffer or, for a
+ * growable encoder, data which did not fit in it.
+ * @param e The webp_encoder_struct pointer.
+ * @return A pointer to the encoded WebP data.
+ */
+const void* webp_encoder_get_output(const webp_encoder e)
+{
+    if (e->overflow.bytes) {
+        return e->overflow.bytes;
+    }
+    return e->dst;
 }
\ No newline at end of file
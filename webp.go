@@ -18,10 +18,11 @@ type webpDecoder struct {
 type webpEncoder struct {
 	encoder    C.webp_encoder
 	dstBuf     []byte
-	icc        []byte
+	metadata   encodeMetadata
 	isAnimated bool
 	frameIndex int
 	hasFlushed bool
+	growable   bool
 }
 
 func newWebpDecoder(buf []byte) (*webpDecoder, error) {
@@ -60,6 +61,10 @@ func (d *webpDecoder) Close() {
 	d.buf = nil
 }
 
+func (d *webpDecoder) setCancelFlag(flag *C.int) {
+	C.webp_decoder_set_cancel_flag(d.decoder, flag)
+}
+
 func (d *webpDecoder) Description() string {
 	return "WEBP"
 }
@@ -93,6 +98,20 @@ func (d *webpDecoder) ICC() []byte {
 	return iccDst[:iccLength]
 }
 
+func (d *webpDecoder) EXIF() []byte {
+	if exif := webpEXIF(d.buf); exif != nil {
+		return exif
+	}
+	return []byte{}
+}
+
+func (d *webpDecoder) XMP() []byte {
+	if xmp := webpXMP(d.buf); xmp != nil {
+		return xmp
+	}
+	return []byte{}
+}
+
 func (d *webpDecoder) BackgroundColor() uint32 {
 	return uint32(C.webp_decoder_get_bg_color(d.decoder))
 }
@@ -145,26 +164,37 @@ func (d *webpDecoder) SkipFrame() error {
 	return ErrSkipNotSupported
 }
 
-func newWebpEncoder(decodedBy Decoder, dstBuf []byte) (*webpEncoder, error) {
+func newWebpEncoder(decodedBy Decoder, dstBuf []byte, growable bool) (*webpEncoder, error) {
+	return newWebpEncoderWithMetadata(decodedBy, decodedMetadata(decodedBy), dstBuf, growable)
+}
+
+// newWebpEncoderWithMetadata returns a webpEncoder which embeds md rather
+// than the profile of the image decoded by decodedBy
+func newWebpEncoderWithMetadata(decodedBy Decoder, md encodeMetadata, dstBuf []byte, growable bool) (*webpEncoder, error) {
 	dstBuf = dstBuf[:1]
-	icc := decodedBy.ICC()
 	bgColor := decodedBy.BackgroundColor()
 	loopCount := decodedBy.LoopCount()
 
-	var enc C.webp_encoder
-	if len(icc) > 0 {
-		enc = C.webp_encoder_create(unsafe.Pointer(&dstBuf[0]), C.size_t(cap(dstBuf)), unsafe.Pointer(&icc[0]), C.size_t(len(icc)), C.uint32_t(bgColor), C.int(loopCount))
-	} else {
-		enc = C.webp_encoder_create(unsafe.Pointer(&dstBuf[0]), C.size_t(cap(dstBuf)), nil, 0, C.uint32_t(bgColor), C.int(loopCount))
+	var icc, exif, xmp unsafe.Pointer
+	if len(md.icc) > 0 {
+		icc = unsafe.Pointer(&md.icc[0])
+	}
+	if len(md.exif) > 0 {
+		exif = unsafe.Pointer(&md.exif[0])
+	}
+	if len(md.xmp) > 0 {
+		xmp = unsafe.Pointer(&md.xmp[0])
 	}
+	enc := C.webp_encoder_create(unsafe.Pointer(&dstBuf[0]), C.size_t(cap(dstBuf)), icc, C.size_t(len(md.icc)), exif, C.size_t(len(md.exif)), xmp, C.size_t(len(md.xmp)), C.uint32_t(bgColor), C.int(loopCount), C.bool(growable))
 	if enc == nil {
 		return nil, ErrBufTooSmall
 	}
 
 	return &webpEncoder{
-		encoder: enc,
-		dstBuf:  dstBuf,
-		icc:     icc,
+		encoder:  enc,
+		dstBuf:   dstBuf,
+		metadata: md,
+		growable: growable,
 	}, nil
 }
 
@@ -181,6 +211,12 @@ func (e *webpEncoder) Encode(f *Framebuffer, opt map[int]int) ([]byte, error) {
 		}
 
 		e.hasFlushed = true
+
+		output := C.webp_encoder_get_output(e.encoder)
+		if output != unsafe.Pointer(&e.dstBuf[0]) {
+			// the encoder kept output which outgrew dstBuf
+			return C.GoBytes(output, C.int(length)), nil
+		}
 		return e.dstBuf[:length], nil
 	}
 
@@ -206,6 +242,10 @@ func (e *webpEncoder) Encode(f *Framebuffer, opt map[int]int) ([]byte, error) {
 	return nil, nil
 }
 
+func (e *webpEncoder) setCancelFlag(flag *C.int) {
+	C.webp_encoder_set_cancel_flag(e.encoder, flag)
+}
+
 func (e *webpEncoder) Close() {
 	C.webp_encoder_release(e.encoder)
 }
@@ -11,6 +11,7 @@ typedef struct webp_decoder_struct* webp_decoder;
 typedef struct webp_encoder_struct* webp_encoder;
 
 webp_decoder webp_decoder_create(const opencv_mat buf);
+void webp_decoder_set_cancel_flag(webp_decoder d, const int* cancel_flag);
 int webp_decoder_get_width(const webp_decoder d);
 int webp_decoder_get_height(const webp_decoder d);
 int webp_decoder_get_pixel_type(const webp_decoder d);
@@ -27,10 +28,12 @@ size_t webp_decoder_get_icc(const webp_decoder d, void* buf, size_t buf_len);
 void webp_decoder_release(webp_decoder d);
 bool webp_decoder_decode(webp_decoder d, opencv_mat mat);
 
-webp_encoder webp_encoder_create(void* buf, size_t buf_len, const void* icc, size_t icc_len, uint32_t bgcolor, int loop_count);
+webp_encoder webp_encoder_create(void* buf, size_t buf_len, const void* icc, size_t icc_len, const void* exif, size_t exif_len, const void* xmp, size_t xmp_len, uint32_t bgcolor, int loop_count, bool growable);
+void webp_encoder_set_cancel_flag(webp_encoder e, const int* cancel_flag);
 size_t webp_encoder_write(webp_encoder e, const opencv_mat src, const int* opt, size_t opt_len, int delay, int blend, int dispose, int x_offset, int y_offset);
 void webp_encoder_release(webp_encoder e);
 size_t webp_encoder_flush(webp_encoder e);
+const void* webp_encoder_get_output(const webp_encoder e);
 void webp_decoder_advance_frame(webp_decoder d);
 int webp_decoder_has_more_frames(webp_decoder d);
 
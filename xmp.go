@@ -0,0 +1,204 @@
+package lilliput
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+)
+
+// maxXMPLength bounds the size a compressed XMP packet may inflate to
+const maxXMPLength = 1 << 20
+
+var (
+	xmpJPEGSignature  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpPNGKeyword     = []byte("XML:com.adobe.xmp\x00")
+	xmpGIFApplication = []byte("XMP DataXMP")
+
+	// properties which locate the image or identify the camera or its owner
+	xmpPrivateProperties = [][]byte{
+		[]byte("GPSLatitude"),
+		[]byte("GPSLongitude"),
+		[]byte("GPSAltitude"),
+		[]byte("SerialNumber"),
+		[]byte("OwnerName"),
+	}
+)
+
+// gifXMPTrailer is the "magic trailer" following the XMP packet of a GIF
+// application extension, which leads a reader stepping through the packet
+// as if it were sub-blocks to the block terminator
+var gifXMPTrailer = func() []byte {
+	trailer := []byte{0x01}
+	for i := 0xFF; i >= 0; i-- {
+		trailer = append(trailer, byte(i))
+	}
+	return trailer
+}()
+
+// filterXMP returns the XMP packet xmp if policy keeps it. MetadataKeepSafe
+// only keeps packets without a location or serial numbers, as XMP cannot be
+// edited without rewriting it.
+func filterXMP(xmp []byte, policy MetadataPolicy) []byte {
+	if policy.stripsEXIFAndXMP() || len(xmp) == 0 {
+		return nil
+	}
+	if policy == MetadataKeepSafe {
+		for _, property := range xmpPrivateProperties {
+			if bytes.Contains(xmp, property) {
+				return nil
+			}
+		}
+	}
+	return xmp
+}
+
+// jpegXMP returns the XMP packet of the APP1 segment of a JPEG, if any
+func jpegXMP(jpeg []byte) []byte {
+	return jpegAPP1Payload(jpeg, xmpJPEGSignature)
+}
+
+// pngXMP returns the XMP packet of the iTXt chunk of a PNG, if any
+func pngXMP(png []byte) []byte {
+	chunkIter, err := makePngChunkIter(png)
+	if err != nil {
+		return nil
+	}
+	for chunkIter.next() {
+		if !bytes.Equal(chunkIter.chunkType(), pngItxtChunkType) {
+			continue
+		}
+		data := chunkIter.chunkData()
+		if !bytes.HasPrefix(data, xmpPNGKeyword) {
+			continue
+		}
+
+		// the compression flag and method precede the language and translated keyword
+		data = data[len(xmpPNGKeyword):]
+		if len(data) < 2 {
+			return nil
+		}
+		compressed := data[0] == 1
+		data = data[2:]
+		for i := 0; i < 2; i++ {
+			end := bytes.IndexByte(data, 0)
+			if end < 0 {
+				return nil
+			}
+			data = data[end+1:]
+		}
+		if !compressed {
+			return data
+		}
+
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil
+		}
+		xmp, err := ioutil.ReadAll(io.LimitReader(r, maxXMPLength+1))
+		if err != nil || len(xmp) > maxXMPLength {
+			return nil
+		}
+		return xmp
+	}
+	return nil
+}
+
+// webpXMP returns the data of the XMP chunk of a WebP, if any
+func webpXMP(webp []byte) []byte {
+	return webpChunkData(webp, "XMP ")
+}
+
+// gifXMP returns the XMP packet of the application extension of a GIF, if any
+func gifXMP(gif []byte) []byte {
+	if len(gif) < 13 || !bytes.HasPrefix(gif, []byte("GIF8")) {
+		return nil
+	}
+
+	pos := 13
+	if flags := gif[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+	for pos < len(gif) {
+		switch gif[pos] {
+		case 0x21:
+			if pos+2 > len(gif) {
+				return nil
+			}
+			label := gif[pos+1]
+			pos += 2
+			if label == 0xFF && pos+1+len(xmpGIFApplication) <= len(gif) &&
+				gif[pos] == byte(len(xmpGIFApplication)) && bytes.Equal(gif[pos+1:pos+1+len(xmpGIFApplication)], xmpGIFApplication) {
+				// the packet is stored raw, rather than split into sub-blocks
+				start := pos + 1 + len(xmpGIFApplication)
+				end := skipGIFSubBlocks(gif, start)
+				if end < 0 {
+					return nil
+				}
+				return bytes.TrimSuffix(gif[start:end], gifXMPTrailer)
+			}
+		case 0x2C:
+			if pos+11 > len(gif) {
+				return nil
+			}
+			flags := gif[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			// skip the LZW minimum code size
+			pos++
+		default:
+			// the trailer, or data which is not a GIF block
+			return nil
+		}
+
+		end := skipGIFSubBlocks(gif, pos)
+		if end < 0 {
+			return nil
+		}
+		pos = end + 1
+	}
+	return nil
+}
+
+// skipGIFSubBlocks returns the position of the terminator of the data
+// sub-blocks starting at pos, or -1 if they are truncated
+func skipGIFSubBlocks(gif []byte, pos int) int {
+	for pos < len(gif) {
+		size := int(gif[pos])
+		if size == 0 {
+			return pos
+		}
+		pos += 1 + size
+	}
+	return -1
+}
+
+// xmpJPEGSegment returns an APP1 segment holding xmp, or nil if there is no
+// packet or it is too large to be embedded in a JPEG
+func xmpJPEGSegment(xmp []byte) []byte {
+	length := 2 + len(xmpJPEGSignature) + len(xmp)
+	if len(xmp) == 0 || length > 0xFFFF {
+		return nil
+	}
+
+	segment := make([]byte, 0, 2+length)
+	segment = append(segment, 0xFF, jpegAPP1SegmentType, byte(length>>8), byte(length))
+	segment = append(segment, xmpJPEGSignature...)
+	return append(segment, xmp...)
+}
+
+// xmpPNGChunk returns an uncompressed iTXt chunk holding xmp, or nil if there is no packet
+func xmpPNGChunk(xmp []byte) []byte {
+	if len(xmp) == 0 {
+		return nil
+	}
+
+	// the keyword is followed by the compression flag and method, and an
+	// empty language and translated keyword
+	data := append([]byte{}, xmpPNGKeyword...)
+	data = append(data, 0, 0, 0, 0)
+	data = append(data, xmp...)
+	return appendPNGChunk(nil, pngItxtChunkType, data)
+}
@@ -0,0 +1,164 @@
+package lilliput
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+var testXMP = []byte(`<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?><x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:rights>CC BY 4.0</dc:rights></rdf:Description></rdf:RDF></x:xmpmeta><?xpacket end="w"?>`)
+
+// insertTestGIFXMP adds an XMP application extension ahead of the first block of gif
+func insertTestGIFXMP(gif []byte, xmp []byte) []byte {
+	pos := 13
+	if flags := gif[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+	extension := append([]byte{0x21, 0xFF, byte(len(xmpGIFApplication))}, xmpGIFApplication...)
+	extension = append(extension, xmp...)
+	extension = append(extension, gifXMPTrailer...)
+	extension = append(extension, 0)
+
+	out := append([]byte{}, gif[:pos]...)
+	out = append(out, extension...)
+	return append(out, gif[pos:]...)
+}
+
+func TestXMP_Containers(t *testing.T) {
+	jpeg, err := embedMetadata([]byte{0xFF, 0xD8, 0xFF, 0xD9}, ".jpeg", encodeMetadata{xmp: testXMP}, true)
+	if err != nil {
+		t.Fatalf("embedMetadata failed: %v", err)
+	}
+	if got := jpegXMP(jpeg); !bytes.Equal(got, testXMP) {
+		t.Errorf("jpegXMP() = %q, want %q", got, testXMP)
+	}
+
+	png := append([]byte{}, pngMagic...)
+	png = appendPNGChunk(png, pngIhdrChunkType, make([]byte, 13))
+	png = append(png, xmpPNGChunk(testXMP)...)
+	png = appendPNGChunk(png, pngIendChunkType, nil)
+	if got := pngXMP(png); !bytes.Equal(got, testXMP) {
+		t.Errorf("pngXMP() = %q, want %q", got, testXMP)
+	}
+
+	// compressed, with a language and translated keyword
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	w.Write(testXMP)
+	w.Close()
+	itxt := append(append([]byte{}, xmpPNGKeyword...), 1, 0)
+	itxt = append(itxt, "en\x00XMP\x00"...)
+	itxt = append(itxt, compressed.Bytes()...)
+	png = append([]byte{}, pngMagic...)
+	png = appendPNGChunk(png, pngIhdrChunkType, make([]byte, 13))
+	png = appendPNGChunk(png, pngItxtChunkType, itxt)
+	if got := pngXMP(png); !bytes.Equal(got, testXMP) {
+		t.Errorf("pngXMP() of a compressed chunk = %q, want %q", got, testXMP)
+	}
+
+	// inflating to more than maxXMPLength
+	compressed.Reset()
+	w = zlib.NewWriter(&compressed)
+	w.Write(make([]byte, maxXMPLength+1))
+	w.Close()
+	itxt = append(append([]byte{}, xmpPNGKeyword...), 1, 0, 0, 0)
+	itxt = append(itxt, compressed.Bytes()...)
+	png = append([]byte{}, pngMagic...)
+	png = appendPNGChunk(png, pngIhdrChunkType, make([]byte, 13))
+	png = appendPNGChunk(png, pngItxtChunkType, itxt)
+	if got := pngXMP(png); got != nil {
+		t.Errorf("pngXMP() of a chunk inflating to %d bytes = %d bytes, want nil", maxXMPLength+1, len(got))
+	}
+
+	body := append([]byte("WEBPXMP "), make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(body[8:], uint32(len(testXMP)))
+	body = append(body, testXMP...)
+	webp := append([]byte("RIFF"), make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(webp[4:], uint32(len(body)))
+	webp = append(webp, body...)
+	if got := webpXMP(webp); !bytes.Equal(got, testXMP) {
+		t.Errorf("webpXMP() = %q, want %q", got, testXMP)
+	}
+
+	gifData, err := os.ReadFile("testdata/no-loop.gif")
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+	if gifXMP(gifData) != nil {
+		t.Errorf("Expected no XMP in the test GIF")
+	}
+	if got := gifXMP(insertTestGIFXMP(gifData, testXMP)); !bytes.Equal(got, testXMP) {
+		t.Errorf("gifXMP() = %q, want %q", got, testXMP)
+	}
+
+	// written by Photoshop, with the magic trailer
+	gifData, err = os.ReadFile("testdata/party-discord.gif")
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+	got := gifXMP(gifData)
+	if !bytes.HasPrefix(got, []byte("<?xpacket begin=")) || !bytes.HasSuffix(got, []byte(`<?xpacket end="r"?>`)) {
+		t.Errorf("gifXMP() = %q, want a whole XMP packet", got)
+	}
+}
+
+func TestFilterXMP(t *testing.T) {
+	located := bytes.Replace(testXMP, []byte("<dc:rights>"), []byte(`<exif:GPSLatitude>37,46.5N</exif:GPSLatitude><dc:rights>`), 1)
+
+	if filterXMP(testXMP, MetadataStrip) != nil {
+		t.Errorf("Expected MetadataStrip to remove the XMP packet")
+	}
+	if filterXMP(testXMP, MetadataDefault) != nil {
+		t.Errorf("Expected MetadataDefault to remove the XMP packet")
+	}
+	if !bytes.Equal(filterXMP(located, MetadataKeep), located) {
+		t.Errorf("Expected MetadataKeep to keep the XMP packet")
+	}
+	if !bytes.Equal(filterXMP(testXMP, MetadataKeepSafe), testXMP) {
+		t.Errorf("Expected MetadataKeepSafe to keep an XMP packet without a location")
+	}
+	if filterXMP(located, MetadataKeepSafe) != nil {
+		t.Errorf("Expected MetadataKeepSafe to remove an XMP packet with a location")
+	}
+}
+
+func TestTransform_GIFXMP(t *testing.T) {
+	testData, err := os.ReadFile("testdata/party-discord.gif")
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+	sourceXMP := gifXMP(testData)
+
+	for _, policy := range []MetadataPolicy{MetadataDefault, MetadataStrip, MetadataKeep} {
+		decoder, err := NewDecoder(testData)
+		if err != nil {
+			t.Fatalf("NewDecoder failed: %v", err)
+		}
+		if !bytes.Equal(decoder.(MetadataDecoder).XMP(), sourceXMP) {
+			t.Errorf("XMP() = %q, want %q", decoder.(MetadataDecoder).XMP(), sourceXMP)
+		}
+
+		ops := NewImageOps(2048)
+		output, err := ops.Transform(decoder, &ImageOptions{
+			FileType:     ".gif",
+			ResizeMethod: ImageOpsNoResize,
+			Metadata:     policy,
+		}, make([]byte, 10*1024*1024))
+		ops.Close()
+		decoder.Close()
+		if err != nil {
+			t.Fatalf("Transform failed: %v", err)
+		}
+
+		got := gifXMP(output)
+		if policy == MetadataStrip && got != nil {
+			t.Errorf("Expected GIF output without XMP")
+		}
+		// GIF extensions are kept by default, as they always have been
+		if policy != MetadataStrip && !bytes.Equal(got, sourceXMP) {
+			t.Errorf("GIF output XMP = %q, want %q", got, sourceXMP)
+		}
+	}
+}